@@ -0,0 +1,261 @@
+// Package ban bans addresses for a limited time using a hash:ip set.
+//
+// Every ban is an entry with a timeout, which the kernel removes once the
+// timeout has passed. Repeat offences of an address while it is banned, or
+// shortly afterwards, double its timeout up to a maximum. The number of
+// offences is kept in the comment of the entry, so that a Manager started
+// later picks it up by calling Load.
+package ban
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ipset "github.com/digineo/go-ipset/v2"
+	"github.com/ti-mo/netfilter"
+)
+
+// MaxTimeout is the longest timeout the kernel accepts for an entry.
+const MaxTimeout = 2147483 * time.Second
+
+const commentPrefix = "offences="
+
+// MinRevision is the first revision of hash:ip supporting comments,
+// available since Linux 3.13.
+const MinRevision = 2
+
+// Ban is an address currently banned.
+type Ban struct {
+	IP net.IP
+	// Remaining is the time until the ban expires.
+	Remaining time.Duration
+	// Offences is the number of offences the ban was extended for,
+	// or zero if the entry was not added by a Manager.
+	Offences int
+}
+
+type offender struct {
+	offences int
+	until    time.Time
+}
+
+type options struct {
+	base, max time.Duration
+	forget    time.Duration
+	revision  uint8
+}
+
+// Option configures a Manager.
+type Option func(o *options)
+
+// Backoff sets the timeout of the first ban of an address to base, which
+// doubles on every repeat offence up to max. It defaults to ten minutes
+// and a week. Timeouts are rounded down to seconds, the shortest being
+// one second, and are limited to MaxTimeout.
+func Backoff(base, max time.Duration) Option {
+	return func(o *options) { o.base, o.max = base, max }
+}
+
+// Forget sets for how long offences are remembered after a ban expired,
+// it defaults to a day. An address offending again later is banned as
+// if it offended for the first time.
+func Forget(d time.Duration) Option {
+	return func(o *options) { o.forget = d }
+}
+
+// Revision sets the revision of hash:ip the set is created with. It
+// defaults to MinRevision, so that Setup works on older kernels too.
+func Revision(rev uint8) Option {
+	return func(o *options) { o.revision = rev }
+}
+
+// Manager bans addresses in a set. It is safe for concurrent use,
+// provided the Conn is not used by anyone else meanwhile.
+type Manager struct {
+	c       *ipset.Conn
+	set     *ipset.Set
+	options options
+	now     func() time.Time
+
+	mu        sync.Mutex
+	offenders map[string]offender
+	pruned    time.Time
+}
+
+// New returns a Manager banning addresses in the set name of c. The set
+// must be a hash:ip set supporting timeouts and comments, as created by
+// Setup, and match the family of the addresses banned.
+func New(c *ipset.Conn, name string, opts ...Option) *Manager {
+	o := options{
+		base:     10 * time.Minute,
+		max:      7 * 24 * time.Hour,
+		forget:   24 * time.Hour,
+		revision: MinRevision,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.base = clamp(o.base)
+	o.max = clamp(o.max)
+	if o.max < o.base {
+		o.max = o.base
+	}
+
+	set := c.Set(name, ipset.HashIP)
+	set.Revision = o.revision
+
+	return &Manager{
+		c:         c,
+		set:       set,
+		options:   o,
+		now:       time.Now,
+		offenders: make(map[string]offender),
+	}
+}
+
+func clamp(d time.Duration) time.Duration {
+	d = d.Truncate(time.Second)
+	if d < time.Second {
+		return time.Second
+	}
+	if d > MaxTimeout {
+		return MaxTimeout
+	}
+	return d
+}
+
+// Setup creates the set of the Manager for addresses of family.
+// It succeeds if an identical set exists.
+func (m *Manager) Setup(family netfilter.ProtoFamily) error {
+	return m.set.Replace(family,
+		ipset.CreateDataTimeout(m.options.base),
+		ipset.CreateDataCadtFlags(uint32(ipset.WithComment)))
+}
+
+// Load remembers the offences of the addresses banned in the set,
+// e.g. after a restart.
+func (m *Manager) Load() error {
+	bans, err := m.Bans()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	for _, b := range bans {
+		if b.Offences == 0 {
+			continue
+		}
+		m.offenders[b.IP.String()] = offender{
+			offences: b.Offences,
+			until:    now.Add(b.Remaining),
+		}
+	}
+	return nil
+}
+
+// Ban bans ip for an offence and returns the timeout of the ban. If ip
+// is banned already, its ban is replaced by one with a longer timeout.
+func (m *Manager) Ban(ip net.IP) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.prune(now)
+
+	key := ip.String()
+	o := m.offenders[key]
+	if now.After(o.until.Add(m.options.forget)) {
+		o = offender{}
+	}
+	o.offences++
+
+	timeout := m.timeout(o.offences)
+	err := m.set.Add(ipset.NewEntry(
+		ipset.EntryIP(ip),
+		ipset.EntryTimeout(timeout),
+		ipset.EntryComment(commentPrefix+strconv.Itoa(o.offences)),
+	))
+	if err != nil {
+		return 0, err
+	}
+
+	o.until = now.Add(timeout)
+	m.offenders[key] = o
+	return timeout, nil
+}
+
+// Unban lifts the ban of ip and forgets its offences. It succeeds
+// if ip is not banned.
+func (m *Manager) Unban(ip net.IP) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.set.Delete(ipset.NewEntry(ipset.EntryIP(ip))); err != nil {
+		return err
+	}
+	delete(m.offenders, ip.String())
+	return nil
+}
+
+// Bans lists the addresses currently banned in the set, including
+// those not banned by the Manager.
+func (m *Manager) Bans() ([]Ban, error) {
+	s, err := m.c.List(m.set.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	bans := make([]Ban, 0, len(s.Entries))
+	for _, e := range s.Entries {
+		bans = append(bans, Ban{
+			IP:        e.IP.Get(),
+			Remaining: e.Timeout.Get(),
+			Offences:  offences(e.Comment.Get()),
+		})
+	}
+	return bans, nil
+}
+
+// timeout returns the timeout of a ban for the given number of offences.
+func (m *Manager) timeout(offences int) time.Duration {
+	d := m.options.base
+	for i := 1; i < offences && d < m.options.max; i++ {
+		d *= 2
+	}
+	if d > m.options.max {
+		return m.options.max
+	}
+	return d
+}
+
+// prune forgets the offenders whose bans expired long enough ago.
+// It walks all offenders at most once per forget period.
+func (m *Manager) prune(now time.Time) {
+	if now.Before(m.pruned.Add(m.options.forget)) {
+		return
+	}
+	for key, o := range m.offenders {
+		if now.After(o.until.Add(m.options.forget)) {
+			delete(m.offenders, key)
+		}
+	}
+	m.pruned = now
+}
+
+// offences parses the number of offences from the comment of an entry.
+func offences(comment string) int {
+	if !strings.HasPrefix(comment, commentPrefix) {
+		return 0
+	}
+	n, err := strconv.Atoi(comment[len(commentPrefix):])
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,154 @@
+package ban
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	ipset "github.com/digineo/go-ipset/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+func newClock() *clock                   { return &clock{t: time.Unix(1500000000, 0)} }
+func newConn(k *ipset.FakeKernel) *ipset.Conn {
+	return &ipset.Conn{Family: netfilter.ProtoIPv4, Conn: k}
+}
+
+func newManager(t *testing.T, k *ipset.FakeKernel, clk *clock, opts ...Option) *Manager {
+	m := New(newConn(k), "banned", opts...)
+	m.now = clk.now
+	if err := m.Setup(netfilter.ProtoIPv4); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestManager_Ban(t *testing.T) {
+	assert2 := assert.New(t)
+	clk := newClock()
+	k := ipset.NewFakeKernel()
+	k.Now = clk.now
+	m := newManager(t, k, clk, Backoff(time.Minute, 5*time.Minute), Forget(time.Hour))
+
+	ip := net.ParseIP("10.0.0.1")
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		timeout, err := m.Ban(ip)
+		assert2.NoError(err)
+		assert2.Equal(want, timeout)
+	}
+
+	clk.advance(90 * time.Second)
+	bans, err := m.Bans()
+	if assert2.NoError(err) && assert2.Len(bans, 1) {
+		assert2.Equal("10.0.0.1", bans[0].IP.String())
+		assert2.Equal(210*time.Second, bans[0].Remaining)
+		assert2.Equal(5, bans[0].Offences)
+	}
+
+	// The entry expires, but the offences are remembered for an hour.
+	clk.advance(4 * time.Minute)
+	bans, err = m.Bans()
+	assert2.NoError(err)
+	assert2.Len(bans, 0)
+
+	timeout, err := m.Ban(ip)
+	assert2.NoError(err)
+	assert2.Equal(5*time.Minute, timeout)
+
+	clk.advance(5*time.Minute + time.Hour + time.Second)
+	timeout, err = m.Ban(ip)
+	assert2.NoError(err)
+	assert2.Equal(time.Minute, timeout)
+
+	// Unbanning forgets the offences.
+	assert2.NoError(m.Unban(ip))
+	assert2.NoError(m.Unban(ip))
+	bans, err = m.Bans()
+	assert2.NoError(err)
+	assert2.Len(bans, 0)
+
+	timeout, err = m.Ban(ip)
+	assert2.NoError(err)
+	assert2.Equal(time.Minute, timeout)
+}
+
+func TestManager_Load(t *testing.T) {
+	assert2 := assert.New(t)
+	clk := newClock()
+	k := ipset.NewFakeKernel()
+	k.Now = clk.now
+	m := newManager(t, k, clk, Backoff(time.Minute, time.Hour))
+
+	ip := net.ParseIP("10.0.0.1")
+	for i := 0; i < 3; i++ {
+		_, err := m.Ban(ip)
+		assert2.NoError(err)
+	}
+	assert2.NoError(newConn(k).Add("banned", ipset.NewEntry(ipset.EntryIP(net.ParseIP("10.0.0.2")))))
+
+	// A new Manager continues with the offences found in the set.
+	m = newManager(t, k, clk, Backoff(time.Minute, time.Hour))
+	assert2.NoError(m.Load())
+
+	timeout, err := m.Ban(ip)
+	assert2.NoError(err)
+	assert2.Equal(8*time.Minute, timeout)
+
+	timeout, err = m.Ban(net.ParseIP("10.0.0.2"))
+	assert2.NoError(err)
+	assert2.Equal(time.Minute, timeout)
+}
+
+func TestManager_Errors(t *testing.T) {
+	assert2 := assert.New(t)
+	m := New(newConn(ipset.NewFakeKernel()), "banned")
+
+	_, err := m.Ban(net.ParseIP("10.0.0.1"))
+	assert2.True(errors.Is(err, ipset.ErrSetNotFound))
+
+	_, err = m.Bans()
+	assert2.True(errors.Is(err, ipset.ErrSetNotFound))
+}
+
+func TestManager_Revision(t *testing.T) {
+	assert2 := assert.New(t)
+	c := newConn(ipset.NewFakeKernel())
+
+	// The set is created with the first revision supporting comments.
+	m := New(c, "banned")
+	assert2.NoError(m.Setup(netfilter.ProtoIPv4))
+	h, err := c.Header("banned")
+	if assert2.NoError(err) {
+		assert2.Equal(uint8(MinRevision), h.Revision.Get())
+	}
+	_, err = m.Ban(net.ParseIP("10.0.0.1"))
+	assert2.NoError(err)
+
+	m = New(c, "latest", Revision(ipset.HashIP.Revision))
+	assert2.NoError(m.Setup(netfilter.ProtoIPv4))
+	h, err = c.Header("latest")
+	if assert2.NoError(err) {
+		assert2.Equal(ipset.HashIP.Revision, h.Revision.Get())
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	assert2 := assert.New(t)
+	c := newConn(ipset.NewFakeKernel())
+
+	m := New(c, "banned", Backoff(1500*time.Millisecond, 365*24*time.Hour))
+	assert2.Equal(time.Second, m.options.base)
+	assert2.Equal(MaxTimeout, m.options.max)
+	assert2.Equal(MaxTimeout, m.timeout(100))
+
+	m = New(c, "banned", Backoff(time.Hour, time.Minute))
+	assert2.Equal(time.Hour, m.timeout(3))
+}
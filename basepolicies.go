@@ -43,6 +43,13 @@ func (p NamePolicy) marshalAttributes() Attributes {
 	return attrs
 }
 
+func (p NamePolicy) setName() string {
+	if !p.Name.IsSet() {
+		return ""
+	}
+	return p.Name.Get()
+}
+
 func (p *NamePolicy) unmarshalAttribute(nfa netfilter.Attribute) {
 	if at := AttributeType(nfa.Type); at == AttrSetName {
 		p.Name = unmarshalNullStringBox(nfa)
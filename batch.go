@@ -0,0 +1,105 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"syscall"
+
+	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/netfilter"
+)
+
+// maxMessageLen is the maximum length of a message accepted by
+// netlink.Conn.Send, which is below the 16 bit limit of the attribute
+// length enclosing the entries.
+const maxMessageLen = 32 * 1024
+
+// linenoLen is the encoded length of the line number added to entries.
+const linenoLen = syscall.NLA_HDRLEN + 4
+
+// executeEntries sends the entries split into batches fitting into a single
+// message each. It stops at the first batch the kernel rejects, as ipset(8)
+// does, since the kernel also stops at the first entry it rejects within a
+// batch. The Applied field of a returned *Error tells how many entries made
+// it into the set. Type specific errors are resolved with typeName, or by
+// resolveError if it is empty.
+func (c *Conn) executeEntries(ctx context.Context, t messageType, flags netlink.HeaderFlags, name, typeName string, entries Entries) error {
+	// Determine the space left for the entries by encoding the message without them.
+	empty, err := c.marshal(t, 0, newEntryPolicy(newNamePolicy(name), 0, Entries{}))
+	if err != nil {
+		return err
+	}
+	maxLen := maxMessageLen - syscall.NLMSG_HDRLEN - len(empty.Data)
+
+	var offset int
+	for {
+		n := c.batchLen(entries[offset:], maxLen)
+
+		p := newEntryPolicy(newNamePolicy(name), 0, entries[offset:offset+n])
+		p.offset, p.typ = uint32(offset), typeName
+		if err := c.execute(ctx, t, flags, p); err != nil {
+			if typeName == "" {
+				err = c.resolveError(ctx, err)
+			}
+			var e *Error
+			if errors.As(err, &e) {
+				e.Applied = offset + applied(entries[offset:offset+n], e.Entry)
+			}
+			return err
+		}
+
+		offset += n
+		if offset >= len(entries) {
+			return nil
+		}
+	}
+}
+
+// applied returns the number of entries of a rejected batch preceding
+// the rejected entry, which the kernel applied. It returns zero if the
+// rejected entry is unknown.
+func applied(batch Entries, rejected *Entry) int {
+	for i, e := range batch {
+		if e == rejected {
+			return i
+		}
+	}
+	return 0
+}
+
+// batchLen returns the number of entries fitting into the next batch.
+// At least one entry is returned, leaving oversized entries to be
+// rejected by the kernel.
+func (c *Conn) batchLen(entries Entries, maxLen int) int {
+	var size int
+	for i, e := range entries {
+		if i > 0 && i == c.BatchSize {
+			return i
+		}
+		size += attributeLen(e.marshal(AttrData))
+		if !e.Lineno.IsSet() {
+			size += linenoLen
+		}
+		if i > 0 && size > maxLen {
+			return i
+		}
+	}
+	return len(entries)
+}
+
+// attributeLen returns the encoded length of a including its padding.
+func attributeLen(a netfilter.Attribute) int {
+	if !a.Nested {
+		return syscall.NLA_HDRLEN + nlaAlign(len(a.Data))
+	}
+
+	n := syscall.NLA_HDRLEN
+	for _, child := range a.Children {
+		n += attributeLen(child)
+	}
+	return n
+}
+
+func nlaAlign(n int) int {
+	return (n + syscall.NLA_ALIGNTO - 1) & ^(syscall.NLA_ALIGNTO - 1)
+}
@@ -0,0 +1,112 @@
+package ipset
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// CreateDataIPRange sets the range of addresses a bitmap:ip or
+// bitmap:ip,mac set stores, from first to last.
+func CreateDataIPRange(first, last net.IP) CreateDataOption {
+	return func(d *CreateData) {
+		d.IP, d.IPTo, d.Cidr = NewIPAddrBox(first), NewIPAddrBox(last), nil
+	}
+}
+
+// CreateDataIPNet sets the range of addresses a bitmap:ip or
+// bitmap:ip,mac set stores to the network n.
+func CreateDataIPNet(n *net.IPNet) CreateDataOption {
+	ones, _ := n.Mask.Size()
+	return func(d *CreateData) {
+		d.IP, d.IPTo, d.Cidr = NewIPAddrBox(n.IP), nil, NewUInt8Box(uint8(ones))
+	}
+}
+
+// CreateDataPortRange sets the range of ports a bitmap:port
+// set stores, from first to last.
+func CreateDataPortRange(first, last uint16) CreateDataOption {
+	return func(d *CreateData) {
+		d.Port, d.PortTo = NewUInt16Box(first), NewUInt16Box(last)
+	}
+}
+
+// ValidateRange checks that the element of e lies within the range of
+// a bitmap set of type t created with d, like the kernel does on add and
+// delete. ErrOutOfRange is returned otherwise. Entries of other types,
+// and entries for which d holds no range, are not checked.
+func (t *SetType) ValidateRange(d *CreateData, e *Entry) error {
+	if !t.bitmap() || d == nil {
+		return nil
+	}
+
+	var first, last, v, to uint32
+	switch {
+	case t.has("ip"):
+		var ok bool
+		if !d.IPTo.IsSet() && !d.Cidr.IsSet() {
+			return nil
+		}
+		if first, last, ok = ipv4Range(d.IP, d.IPTo, d.Cidr); !ok {
+			return nil
+		}
+		if d.NetMask.IsSet() {
+			mask := prefixMask(d.NetMask.Get())
+			first, last = first&mask, last|^mask
+		}
+		if v, to, ok = ipv4Range(e.IP, e.IPTo, e.Cidr); !ok {
+			return nil
+		}
+	case t.has("port"):
+		if !d.Port.IsSet() || !d.PortTo.IsSet() {
+			return nil
+		}
+		first, last = uint32(d.Port.Get()), uint32(d.PortTo.Get())
+		v, to = uint32(e.Port.Get()), uint32(e.Port.Get())
+		if e.PortTo.IsSet() {
+			to = uint32(e.PortTo.Get())
+		}
+	}
+
+	if first > last {
+		first, last = last, first
+	}
+	if v > to {
+		v, to = to, v
+	}
+	if v < first || to > last {
+		return ErrOutOfRange
+	}
+	return nil
+}
+
+// ipv4Range returns the first and last address of an IPv4 address,
+// range or network, and false for other addresses.
+func ipv4Range(ip, to *IPAddrBox, cidr *UInt8Box) (first, last uint32, ok bool) {
+	v4 := ip.Get().To4()
+	if v4 == nil {
+		return 0, 0, false
+	}
+	first = binary.BigEndian.Uint32(v4)
+	last = first
+
+	switch {
+	case to.IsSet():
+		v4 := to.Get().To4()
+		if v4 == nil {
+			return 0, 0, false
+		}
+		last = binary.BigEndian.Uint32(v4)
+	case cidr.IsSet():
+		mask := prefixMask(cidr.Get())
+		first, last = first&mask, first|^mask
+	}
+	return first, last, true
+}
+
+// prefixMask returns the IPv4 netmask of the prefix length n.
+func prefixMask(n uint8) uint32 {
+	if n > 32 {
+		n = 32
+	}
+	return ^(^uint32(0) >> n)
+}
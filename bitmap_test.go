@@ -0,0 +1,204 @@
+package ipset
+
+import (
+	stderrors "errors"
+	"net"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+func TestCreateDataRange(t *testing.T) {
+	assert2 := assert.New(t)
+
+	_, n, _ := net.ParseCIDR("10.0.0.0/16")
+	d := newCreateData(CreateDataIPRange(net.ParseIP("10.0.0.0"), net.ParseIP("10.0.0.255")), CreateDataIPNet(n))
+	assert2.Equal(n.IP, d.IP.Get())
+	assert2.False(d.IPTo.IsSet())
+	assert2.Equal(uint8(16), d.Cidr.Get())
+
+	d = newCreateData(CreateDataIPNet(n), CreateDataIPRange(net.ParseIP("10.0.0.0"), net.ParseIP("10.0.0.255")))
+	assert2.Equal(net.ParseIP("10.0.0.255"), d.IPTo.Get())
+	assert2.False(d.Cidr.IsSet())
+
+	d = newCreateData(CreateDataPortRange(1024, 65535))
+	assert2.Equal(uint16(1024), d.Port.Get())
+	assert2.Equal(uint16(65535), d.PortTo.Get())
+}
+
+func TestSetType_ValidateRange(t *testing.T) {
+	ip := func(s string) EntryOption { return EntryIP(net.ParseIP(s)) }
+	ipTo := func(s string) EntryOption { return EntryIPTo(net.ParseIP(s)) }
+	_, n, _ := net.ParseCIDR("10.0.0.0/24")
+
+	ipRange := newCreateData(CreateDataIPNet(n))
+	masked := newCreateData(CreateDataIPRange(net.ParseIP("10.0.0.0"), net.ParseIP("10.0.0.200")), CreateDataNetMask(26))
+	ports := newCreateData(CreateDataPortRange(2048, 1024))
+
+	for i, tt := range []struct {
+		typ   *SetType
+		data  *CreateData
+		entry *Entry
+		err   error
+	}{
+		{BitmapIP, ipRange, NewEntry(ip("10.0.0.1")), nil},
+		{BitmapIP, ipRange, NewEntry(ip("10.0.1.1")), ErrOutOfRange},
+		{BitmapIP, ipRange, NewEntry(ip("10.0.0.128"), EntryCidr(25)), nil},
+		{BitmapIP, ipRange, NewEntry(ip("10.0.0.0"), EntryCidr(23)), ErrOutOfRange},
+		{BitmapIP, ipRange, NewEntry(ip("10.0.0.10"), ipTo("10.0.0.1")), nil},
+		{BitmapIP, ipRange, NewEntry(ip("10.0.0.250"), ipTo("10.0.1.1")), ErrOutOfRange},
+		{BitmapIP, masked, NewEntry(ip("10.0.0.255")), nil},
+		{BitmapIP, masked, NewEntry(ip("10.0.1.0")), ErrOutOfRange},
+		{BitmapIPMac, ipRange, NewEntry(ip("9.255.255.255")), ErrOutOfRange},
+		{BitmapPort, ports, NewEntry(EntryPort(1024)), nil},
+		{BitmapPort, ports, NewEntry(EntryPort(2000), EntryPortTo(2048)), nil},
+		{BitmapPort, ports, NewEntry(EntryPort(80)), ErrOutOfRange},
+		{BitmapPort, ports, NewEntry(EntryPort(2000), EntryPortTo(3000)), ErrOutOfRange},
+
+		// Without a range, the kernel decides.
+		{BitmapIP, nil, NewEntry(ip("10.0.1.1")), nil},
+		{BitmapIP, newCreateData(CreateDataIP(net.ParseIP("10.0.0.0"))), NewEntry(ip("10.0.1.1")), nil},
+		{BitmapPort, newCreateData(), NewEntry(EntryPort(80)), nil},
+		{HashIP, ipRange, NewEntry(ip("10.0.1.1")), nil},
+	} {
+		err := tt.typ.ValidateRange(tt.data, tt.entry)
+		assert.Equal(t, tt.err, err, "%d: %s", i, tt.typ)
+	}
+}
+
+func TestConn_Bitmap(t *testing.T) {
+	assert2 := assert.New(t)
+	c, _ := newFakeConn()
+
+	s := c.Set("ports", BitmapPort)
+	err := s.Create(netfilter.ProtoUnspec)
+	assert2.True(stderrors.Is(err, ErrFieldMissing))
+	assert2.NoError(s.Create(netfilter.ProtoUnspec, CreateDataPortRange(1024, 2048)))
+
+	h, err := c.Header("ports")
+	if assert2.NoError(err) {
+		assert2.Equal(uint16(1024), h.Data.Port.Get())
+		assert2.Equal(uint16(2048), h.Data.PortTo.Get())
+	}
+
+	assert2.NoError(s.Add(NewEntry(EntryPort(1500), EntryPortTo(1502))))
+	err = s.Add(NewEntry(EntryPort(1600)), NewEntry(EntryPort(80)))
+	assert2.True(stderrors.Is(err, ErrOutOfRange))
+	var e *Error
+	if assert2.True(stderrors.As(err, &e)) {
+		assert2.Equal(uint32(2), e.Line)
+	}
+
+	// The range of existing sets is read from the kernel.
+	_, n, _ := net.ParseCIDR("10.0.0.0/24")
+	assert2.NoError(c.Create("net", BitmapIP.Name, BitmapIP.Revision, netfilter.ProtoIPv4, CreateDataIPNet(n)))
+	s = c.Set("net", BitmapIP)
+	assert2.True(stderrors.Is(s.Add(NewEntry(EntryIP(net.ParseIP("10.0.1.1")))), ErrOutOfRange))
+	assert2.True(stderrors.Is(s.Delete(NewEntry(EntryIP(net.ParseIP("10.0.1.1")))), ErrOutOfRange))
+	assert2.NoError(s.Add(NewEntry(EntryIP(net.ParseIP("10.0.0.1")), EntryIPTo(net.ParseIP("10.0.0.2")))))
+	assert2.Equal([]string{"10.0.0.1", "10.0.0.2"}, listIPs(t, c, "net"))
+
+	h, err = c.Header("net")
+	if assert2.NoError(err) {
+		assert2.Equal(net.ParseIP("10.0.0.0").To4(), h.Data.IP.Get().To4())
+		assert2.Equal(net.ParseIP("10.0.0.255").To4(), h.Data.IPTo.Get().To4())
+		assert2.False(h.Data.Cidr.IsSet())
+	}
+}
+
+// headerCounter counts the list requests sent to the fake kernel,
+// which Conn.Header is made of.
+type headerCounter struct {
+	*FakeKernel
+	headers int
+}
+
+func (k *headerCounter) Query(nlm netlink.Message) ([]netlink.Message, error) {
+	if messageType(nlm.Header.Type&0xff) == CmdList {
+		k.headers++
+	}
+	return k.FakeKernel.Query(nlm)
+}
+
+func TestSet_Recreated(t *testing.T) {
+	assert2 := assert.New(t)
+	k := &headerCounter{FakeKernel: NewFakeKernel()}
+	c := &Conn{Family: netfilter.ProtoIPv4, Conn: k}
+	port := func(p uint16) *Entry { return NewEntry(EntryPort(p)) }
+
+	s := c.Set("ports", BitmapPort)
+	assert2.NoError(s.Create(netfilter.ProtoUnspec, CreateDataPortRange(1024, 2048)))
+	assert2.NoError(s.Add(port(1500)))
+	assert2.Equal(0, k.headers)
+
+	// The range is read again once it rejects an entry.
+	assert2.NoError(c.Destroy("ports"))
+	assert2.NoError(c.Create("ports", BitmapPort.Name, BitmapPort.Revision, netfilter.ProtoUnspec, CreateDataPortRange(3000, 4000)))
+	assert2.NoError(s.Add(port(3500)))
+	assert2.True(stderrors.Is(s.Add(port(1500)), ErrOutOfRange))
+	assert2.Equal(2, k.headers)
+
+	// The kernel rejects entries out of a wider range than known,
+	// which the set type resolves without asking for it.
+	assert2.NoError(c.Destroy("ports"))
+	assert2.NoError(c.Create("ports", BitmapPort.Name, BitmapPort.Revision, netfilter.ProtoUnspec, CreateDataPortRange(3200, 3300)))
+	assert2.True(stderrors.Is(s.Add(port(3500)), ErrOutOfRange))
+	assert2.NoError(s.Add(port(3250)))
+	assert2.Equal(3, k.headers)
+
+	// A failed header request is not repeated until Reset.
+	s = c.Set("missing", BitmapPort)
+	assert2.True(stderrors.Is(s.Add(port(80)), ErrSetNotFound))
+	assert2.True(stderrors.Is(s.Add(port(81)), ErrSetNotFound))
+	assert2.Equal(4, k.headers)
+	assert2.NoError(c.Create("missing", BitmapPort.Name, BitmapPort.Revision, netfilter.ProtoUnspec, CreateDataPortRange(1024, 2048)))
+	s.Reset()
+	assert2.True(stderrors.Is(s.Add(port(80)), ErrOutOfRange))
+	assert2.Equal(5, k.headers)
+}
+
+func TestFakeKernel_Bitmap(t *testing.T) {
+	assert2 := assert.New(t)
+	c, _ := newFakeConn()
+
+	ipRange := func(first, last string) CreateDataOption {
+		return CreateDataIPRange(net.ParseIP(first), net.ParseIP(last))
+	}
+	for i, tt := range []struct {
+		typ     string
+		family  netfilter.ProtoFamily
+		options []CreateDataOption
+		err     error
+	}{
+		{"bitmap:ip", netfilter.ProtoIPv4, nil, ErrProtocol},
+		{"bitmap:ip", netfilter.ProtoIPv6, []CreateDataOption{ipRange("10.0.0.0", "10.0.0.255")}, ErrTypeNotFound},
+		{"bitmap:ip", netfilter.ProtoIPv4, []CreateDataOption{ipRange("10.0.0.0", "10.1.0.0")}, ErrRangeTooLarge},
+		{"bitmap:ip", netfilter.ProtoIPv4, []CreateDataOption{ipRange("10.0.0.3", "10.0.0.3"), CreateDataNetMask(24)}, ErrOutOfRange},
+		{"bitmap:ip", netfilter.ProtoIPv4, []CreateDataOption{ipRange("10.0.0.0", "10.0.0.255"), CreateDataNetMask(33)}, ErrInvalidNetmask},
+		{"bitmap:ip", netfilter.ProtoIPv4, []CreateDataOption{CreateDataIP(net.ParseIP("10.0.0.0")), CreateDataCidr(32)}, ErrInvalidCIDR},
+		{"bitmap:port", netfilter.ProtoUnspec, []CreateDataOption{CreateDataPort(1024)}, ErrProtocol},
+		{"bitmap:port", netfilter.ProtoUnspec, []CreateDataOption{CreateDataPortRange(0, 1), CreateDataNetMask(24)}, ErrProtocol},
+	} {
+		err := c.Create("foo", tt.typ, 3, tt.family, tt.options...)
+		assert2.True(stderrors.Is(err, tt.err), "%d: %v", i, err)
+	}
+
+	assert2.NoError(c.Create("net", "bitmap:ip", 3, netfilter.ProtoIPv4,
+		ipRange("10.0.0.0", "10.255.255.255"), CreateDataNetMask(16)))
+	assert2.NoError(c.Add("net", NewEntry(EntryIP(net.ParseIP("10.3.4.5")))))
+	assert2.NoError(c.Add("net", NewEntry(EntryIP(net.ParseIP("10.1.0.0")), EntryIPTo(net.ParseIP("10.2.0.0")))))
+	assert2.True(stderrors.Is(c.Add("net", NewEntry(EntryIP(net.ParseIP("11.0.0.0")))), ErrOutOfRange))
+	assert2.True(stderrors.Is(c.Test("net", EntryIP(net.ParseIP("11.0.0.0"))), ErrElementNotFound))
+	assert2.NoError(c.Test("net", EntryIP(net.ParseIP("10.3.0.1"))))
+	assert2.Equal([]string{"10.1.0.0", "10.2.0.0", "10.3.0.0"}, listIPs(t, c, "net"))
+
+	assert2.NoError(c.Create("ports", "bitmap:port", 3, netfilter.ProtoIPv4, CreateDataPortRange(2048, 1024)))
+	assert2.True(stderrors.Is(c.Add("ports", NewEntry(EntryPort(1030), EntryProto(6))), ErrProtocol))
+	h, err := c.Header("ports")
+	if assert2.NoError(err) {
+		assert2.Equal(uint8(netfilter.ProtoUnspec), h.Family.Get())
+		assert2.Equal(uint16(1024), h.Data.Port.Get())
+	}
+}
@@ -0,0 +1,11 @@
+package ipset
+
+// MaxCommentSize is the maximum length in bytes of the comment of an
+// entry. The kernel rejects longer comments with ErrProtocol.
+const MaxCommentSize = 255
+
+// CreateDataComment enables the comments of the entries of the set,
+// like CreateDataCounters does for counters.
+func CreateDataComment() CreateDataOption {
+	return func(d *CreateData) { d.addFlags(WithComment) }
+}
@@ -0,0 +1,52 @@
+package ipset
+
+import (
+	stderrors "errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+func TestConn_Comment(t *testing.T) {
+	assert2 := assert.New(t)
+	c, _ := newFakeConn()
+	ip := EntryIP(net.ParseIP("10.0.0.1"))
+
+	assert2.NoError(c.Create("foo", "hash:ip", 6, netfilter.ProtoIPv4, CreateDataCounters(), CreateDataComment()))
+	h, err := c.Header("foo")
+	if assert2.NoError(err) {
+		assert2.Equal(uint32(WithCounters|WithComment), h.Data.CadtFlags.Get())
+	}
+
+	comment := func() *NullStringBox {
+		p, err := c.List("foo")
+		if !assert2.NoError(err) || !assert2.Len(p.Entries, 1) {
+			return nil
+		}
+		return p.Entries[0].Comment
+	}
+
+	assert2.NoError(c.Add("foo", NewEntry(ip, EntryComment("first"))))
+	assert2.Equal("first", comment().Get())
+
+	// Adding the entry again replaces its comment.
+	assert2.NoError(c.Add("foo", NewEntry(ip, EntryComment("second"))))
+	assert2.Equal("second", comment().Get())
+	assert2.NoError(c.Add("foo", NewEntry(ip)))
+	assert2.False(comment().IsSet())
+
+	long := strings.Repeat("x", MaxCommentSize+1)
+	err = c.Add("foo", NewEntry(ip, EntryComment(long)))
+	assert2.True(stderrors.Is(err, ErrProtocol))
+
+	err = c.Set("foo", HashIP).Add(NewEntry(ip, EntryComment(long)))
+	var e *Error
+	if assert2.True(stderrors.As(err, &e)) {
+		assert2.True(stderrors.Is(err, ErrCommentTooLong))
+		assert2.Equal(uint32(1), e.Line)
+	}
+	assert2.EqualError(err, "ipset add foo: line 1: hash:ip: Comment is longer than MaxCommentSize")
+}
@@ -1,7 +1,9 @@
 package ipset
 
 import (
+	"context"
 	"io"
+	"syscall"
 
 	"github.com/mdlayher/netlink"
 	"github.com/ti-mo/netfilter"
@@ -15,15 +17,46 @@ type connector interface {
 
 // Conn represents a Netlink connection to the Netfilter
 // subsystem and implements all Ipset actions.
+//
+// Every command has a variant taking a context.Context, which aborts the
+// command once the context is done. The deadline of the context is applied
+// to the socket, so that a command never blocks beyond it.
+//
+// A Conn must not be used concurrently, use a Pool instead.
 type Conn struct {
 	Family netfilter.ProtoFamily
 	Conn   connector
+
+	// BatchSize limits the number of entries Add and Delete send in
+	// a single message. If zero, entries are only split as required
+	// by the netlink message size limit.
+	BatchSize int
 }
 
 // Dial opens a new Netfilter Netlink connection and returns it
 // wrapped in a Conn structure that implements the Ipset API.
-func Dial(family netfilter.ProtoFamily, config *netlink.Config) (*Conn, error) {
-	c, err := netfilter.Dial(config)
+func Dial(family netfilter.ProtoFamily, config *netlink.Config, options ...DialOption) (*Conn, error) {
+	var dc dialConfig
+	for _, option := range options {
+		option(&dc)
+	}
+
+	if dc.netns != nil {
+		fd, release, err := dc.netns.open()
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		cfg := netlink.Config{}
+		if config != nil {
+			cfg = *config
+		}
+		cfg.NetNS = fd
+		config = &cfg
+	}
+
+	c, err := dialConnector(config)
 	if err != nil {
 		return nil, err
 	}
@@ -39,8 +72,8 @@ type attributesMarshaller interface {
 	marshalAttributes() Attributes
 }
 
-func (c *Conn) query(t messageType, flags netlink.HeaderFlags, m attributesMarshaller) ([]netlink.Message, error) {
-	req, err := netfilter.MarshalNetlink(
+func (c *Conn) marshal(t messageType, flags netlink.HeaderFlags, m attributesMarshaller) (netlink.Message, error) {
+	return netfilter.MarshalNetlink(
 		netfilter.Header{
 			Family:      c.Family,
 			SubsystemID: netfilter.NFSubsysIPSet,
@@ -49,15 +82,23 @@ func (c *Conn) query(t messageType, flags netlink.HeaderFlags, m attributesMarsh
 		},
 		m.marshalAttributes(),
 	)
+}
+
+func (c *Conn) query(ctx context.Context, t messageType, flags netlink.HeaderFlags, m attributesMarshaller) ([]netlink.Message, error) {
+	req, err := c.marshal(t, flags, m)
 	if err != nil {
 		return nil, err
 	}
 
-	return c.Conn.Query(req)
+	nlm, err := c.queryContext(ctx, req)
+	if err != nil {
+		return nil, newError(t, m, err)
+	}
+	return nlm, nil
 }
 
-func (c *Conn) request(t messageType, req attributesMarshaller, res attributeUnmarshaller) error {
-	nlm, err := c.query(t, 0, req)
+func (c *Conn) request(ctx context.Context, t messageType, req attributesMarshaller, res attributeUnmarshaller) error {
+	nlm, err := c.query(ctx, t, 0, req)
 	if err != nil {
 		return err
 	}
@@ -65,15 +106,19 @@ func (c *Conn) request(t messageType, req attributesMarshaller, res attributeUnm
 	return unmarshalMessage(nlm[0], res)
 }
 
-func (c *Conn) execute(t messageType, flags netlink.HeaderFlags, m attributesMarshaller) error {
-	// Todo(ags): Handle response in case it is an error.
-	_, err := c.query(t, netlink.Acknowledge|flags, m)
+func (c *Conn) execute(ctx context.Context, t messageType, flags netlink.HeaderFlags, m attributesMarshaller) error {
+	_, err := c.query(ctx, t, netlink.Acknowledge|flags, m)
 	return err
 }
 
 func (c *Conn) Protocol() (*ProtocolResponsePolicy, error) {
+	return c.ProtocolContext(context.Background())
+}
+
+// ProtocolContext is like Protocol but aborts once ctx is done.
+func (c *Conn) ProtocolContext(ctx context.Context) (*ProtocolResponsePolicy, error) {
 	p := &ProtocolResponsePolicy{}
-	if err := c.request(CmdProtocol, newBasePolicy(), p); err != nil {
+	if err := c.request(ctx, CmdProtocol, newBasePolicy(), p); err != nil {
 		return nil, err
 	}
 	return p, nil
@@ -81,87 +126,267 @@ func (c *Conn) Protocol() (*ProtocolResponsePolicy, error) {
 
 // Replace replaces a given set if it already exists, creating a new one otherwise.
 func (c *Conn) Replace(setName, typeName string, revision uint8, family netfilter.ProtoFamily, options ...CreateDataOption) error {
-	return c.execute(CmdCreate, netlink.Create|netlink.Replace, newCreatePolicy(
+	return c.ReplaceContext(context.Background(), setName, typeName, revision, family, options...)
+}
+
+// ReplaceContext is like Replace but aborts once ctx is done.
+func (c *Conn) ReplaceContext(ctx context.Context, setName, typeName string, revision uint8, family netfilter.ProtoFamily, options ...CreateDataOption) error {
+	return c.execute(ctx, CmdCreate, netlink.Create|netlink.Replace, newCreatePolicy(
 		newHeaderPolicy(newNamePolicy(setName), typeName, revision, family),
 		newCreateData(options...)))
 }
 
 // Create creates a new set, returning an error if the set already exists.
 func (c *Conn) Create(setName, typeName string, revision uint8, family netfilter.ProtoFamily, options ...CreateDataOption) error {
-	return c.execute(CmdCreate, netlink.Create|netlink.Excl, newCreatePolicy(
+	return c.CreateContext(context.Background(), setName, typeName, revision, family, options...)
+}
+
+// CreateContext is like Create but aborts once ctx is done.
+func (c *Conn) CreateContext(ctx context.Context, setName, typeName string, revision uint8, family netfilter.ProtoFamily, options ...CreateDataOption) error {
+	return c.execute(ctx, CmdCreate, netlink.Create|netlink.Excl, newCreatePolicy(
 		newHeaderPolicy(newNamePolicy(setName), typeName, revision, family),
 		newCreateData(options...)))
 }
 
 func (c *Conn) Destroy(name string) error {
-	return c.execute(CmdDestroy, 0, newNamePolicy(name))
+	return c.DestroyContext(context.Background(), name)
+}
+
+// DestroyContext is like Destroy but aborts once ctx is done.
+func (c *Conn) DestroyContext(ctx context.Context, name string) error {
+	return c.execute(ctx, CmdDestroy, 0, newNamePolicy(name))
 }
 
 func (c *Conn) DestroyAll() error {
-	return c.execute(CmdDestroy, 0, newBasePolicy())
+	return c.DestroyAllContext(context.Background())
+}
+
+// DestroyAllContext is like DestroyAll but aborts once ctx is done.
+func (c *Conn) DestroyAllContext(ctx context.Context) error {
+	return c.execute(ctx, CmdDestroy, 0, newBasePolicy())
 }
 
 func (c *Conn) Flush(name string) error {
-	return c.execute(CmdFlush, 0, newNamePolicy(name))
+	return c.FlushContext(context.Background(), name)
+}
+
+// FlushContext is like Flush but aborts once ctx is done.
+func (c *Conn) FlushContext(ctx context.Context, name string) error {
+	return c.execute(ctx, CmdFlush, 0, newNamePolicy(name))
 }
 
 func (c *Conn) FlushAll() error {
-	return c.execute(CmdFlush, 0, newBasePolicy())
+	return c.FlushAllContext(context.Background())
+}
+
+// FlushAllContext is like FlushAll but aborts once ctx is done.
+func (c *Conn) FlushAllContext(ctx context.Context) error {
+	return c.execute(ctx, CmdFlush, 0, newBasePolicy())
 }
 
 func (c *Conn) Rename(from, to string) error {
-	return c.execute(CmdRename, 0, newMovePolicy(from, to))
+	return c.RenameContext(context.Background(), from, to)
+}
+
+// RenameContext is like Rename but aborts once ctx is done.
+func (c *Conn) RenameContext(ctx context.Context, from, to string) error {
+	return c.execute(ctx, CmdRename, 0, newMovePolicy(from, to))
 }
 
 func (c *Conn) Swap(from, to string) error {
-	return c.execute(CmdSwap, 0, newMovePolicy(from, to))
+	return c.SwapContext(context.Background(), from, to)
+}
+
+// SwapContext is like Swap but aborts once ctx is done.
+func (c *Conn) SwapContext(ctx context.Context, from, to string) error {
+	return c.execute(ctx, CmdSwap, 0, newMovePolicy(from, to))
 }
 
+// ListAll dumps all sets including their entries.
 func (c *Conn) ListAll() ([]SetPolicy, error) {
-	nlm, err := c.query(CmdList, netlink.Dump, newBasePolicy())
+	return c.ListAllContext(context.Background())
+}
+
+// ListAllContext is like ListAll but aborts the dump once ctx is done.
+func (c *Conn) ListAllContext(ctx context.Context) ([]SetPolicy, error) {
+	return c.dump(ctx, CmdList, newBasePolicy())
+}
+
+// List dumps a single set including all of its entries.
+func (c *Conn) List(name string) (*SetPolicy, error) {
+	return c.ListContext(context.Background(), name)
+}
+
+// ListContext is like List but aborts the dump once ctx is done.
+func (c *Conn) ListContext(ctx context.Context, name string) (*SetPolicy, error) {
+	sets, err := c.dump(ctx, CmdList, newNamePolicy(name))
 	if err != nil {
 		return nil, err
 	}
+	if len(sets) == 0 {
+		return nil, &Error{Cmd: CmdList, Set: name, Errno: syscall.ENOENT, Err: ErrSetNotFound}
+	}
+	return &sets[0], nil
+}
+
+// Save dumps all sets including their entries in the format used by
+// `ipset save`. The kernel answers it the same way as ListAll.
+func (c *Conn) Save() ([]SetPolicy, error) {
+	return c.SaveContext(context.Background())
+}
+
+// SaveContext is like Save but aborts the dump once ctx is done.
+func (c *Conn) SaveContext(ctx context.Context) ([]SetPolicy, error) {
+	return c.dump(ctx, CmdSave, newBasePolicy())
+}
 
+// dump issues a dump request and merges the response into one SetPolicy per set.
+func (c *Conn) dump(ctx context.Context, t messageType, m attributesMarshaller) ([]SetPolicy, error) {
 	sets := make([]SetPolicy, 0)
-	for i, el := range nlm {
-		sets = append(sets, SetPolicy{})
-		if err := unmarshalMessage(el, &sets[i]); err != nil {
-			return nil, err
+	err := c.walk(ctx, t, m, func(h *HeaderPolicy, e *Entry) error {
+		if e == nil {
+			sets = append(sets, SetPolicy{HeaderPolicy: *h})
+		} else {
+			p := &sets[len(sets)-1]
+			p.Entries = append(p.Entries, e)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return sets, nil
 }
 
+// Add adds the entries to the set name. Like `ipset -exist add`, entries
+// of elements already in the set replace them, updating their timeout,
+// comment, counters and skbinfo. Extensions an entry omits are reset to
+// their defaults, except for the counters.
+//
+// The error codes specific to set types, e.g. of ErrHashFull, overlap. If
+// the kernel returns one, Add, Delete and Test request the type of the set
+// with Header to resolve it. Set knows the type and does without.
 func (c *Conn) Add(name string, entries ...*Entry) error {
-	return c.execute(CmdAdd, 0, newEntryPolicy(newNamePolicy(name), 0, entries))
+	return c.AddContext(context.Background(), name, entries...)
+}
+
+// AddContext is like Add but aborts once ctx is done. Entries of
+// batches sent before have been added in that case.
+func (c *Conn) AddContext(ctx context.Context, name string, entries ...*Entry) error {
+	return c.executeEntries(ctx, CmdAdd, 0, name, "", entries)
 }
 
+// AddExclusive is like Add, but fails with ErrElementExists for
+// elements already in the set, like `ipset add` without -exist.
+func (c *Conn) AddExclusive(name string, entries ...*Entry) error {
+	return c.AddExclusiveContext(context.Background(), name, entries...)
+}
+
+// AddExclusiveContext is like AddExclusive but aborts once ctx is done.
+func (c *Conn) AddExclusiveContext(ctx context.Context, name string, entries ...*Entry) error {
+	return c.executeEntries(ctx, CmdAdd, netlink.Excl, name, "", entries)
+}
+
+// Delete deletes the entries from the set name. Like `ipset -exist del`,
+// elements not in the set are skipped.
 func (c *Conn) Delete(name string, entries ...*Entry) error {
-	return c.execute(CmdDel, 0, newEntryPolicy(newNamePolicy(name), 0, entries))
+	return c.DeleteContext(context.Background(), name, entries...)
+}
+
+// DeleteContext is like Delete but aborts once ctx is done. Entries of
+// batches sent before have been deleted in that case.
+func (c *Conn) DeleteContext(ctx context.Context, name string, entries ...*Entry) error {
+	return c.executeEntries(ctx, CmdDel, 0, name, "", entries)
+}
+
+// DeleteExclusive is like Delete, but fails with ErrElementNotFound for
+// elements not in the set, like `ipset del` without -exist.
+func (c *Conn) DeleteExclusive(name string, entries ...*Entry) error {
+	return c.DeleteExclusiveContext(context.Background(), name, entries...)
+}
+
+// DeleteExclusiveContext is like DeleteExclusive but aborts once ctx is done.
+func (c *Conn) DeleteExclusiveContext(ctx context.Context, name string, entries ...*Entry) error {
+	return c.executeEntries(ctx, CmdDel, netlink.Excl, name, "", entries)
 }
 
 func (c *Conn) Test(name string, options ...EntryOption) error {
-	return c.execute(CmdTest, 0, TestPolicy{
-		NamePolicy: newNamePolicy(name),
-		Entry:      NewEntry(options...),
-	})
+	return c.TestContext(context.Background(), name, options...)
 }
 
-func (c *Conn) Header(name string) (p *HeaderPolicy, err error) {
-	// The ipset header command only requires the NamePolicy fields
-	// for a request but will return the full Header policy.
-	p = &HeaderPolicy{}
-	if err := c.request(CmdHeader, newNamePolicy(name), p); err != nil {
+// TestContext is like Test but aborts once ctx is done.
+func (c *Conn) TestContext(ctx context.Context, name string, options ...EntryOption) error {
+	return c.test(ctx, name, "", NewEntry(options...))
+}
+
+// test tests whether e is in the set name, resolving type specific errors
+// with typeName, or by resolveError if it is empty.
+func (c *Conn) test(ctx context.Context, name, typeName string, e *Entry) error {
+	err := c.execute(ctx, CmdTest, 0, TestPolicy{NamePolicy: newNamePolicy(name), Entry: e, typ: typeName})
+	if err != nil && typeName == "" {
+		err = c.resolveError(ctx, err)
+	}
+	return err
+}
+
+// Header returns the header of the set name, including its create
+// options, number of entries, references and memory size.
+func (c *Conn) Header(name string) (*HeaderPolicy, error) {
+	return c.HeaderContext(context.Background(), name)
+}
+
+// HeaderContext is like Header but aborts once ctx is done.
+func (c *Conn) HeaderContext(ctx context.Context, name string) (*HeaderPolicy, error) {
+	// The ipset header command does not report the nested data,
+	// while a header only list dump does.
+	nlm, err := c.query(ctx, CmdList, netlink.Dump, newListPolicy(name, FlagListHeader))
+	if err != nil {
 		return nil, err
 	}
-	return p, nil
+
+	for i := range nlm {
+		if !isDumpMessage(nlm[i]) {
+			continue
+		}
+		p := &HeaderPolicy{}
+		if err := unmarshalMessage(nlm[i], p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	return nil, &Error{Cmd: CmdList, Set: name, Errno: syscall.ENOENT, Err: ErrSetNotFound}
+}
+
+// Headers returns the headers of all sets, like Header, without dumping
+// their entries.
+func (c *Conn) Headers() ([]HeaderPolicy, error) {
+	return c.HeadersContext(context.Background())
+}
+
+// HeadersContext is like Headers but aborts the dump once ctx is done.
+func (c *Conn) HeadersContext(ctx context.Context) ([]HeaderPolicy, error) {
+	p := listPolicy{NamePolicy: NamePolicy{BasePolicy: newBasePolicy()}, Flags: NewUInt32Box(uint32(FlagListHeader))}
+	sets, err := c.dump(ctx, CmdList, p)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make([]HeaderPolicy, len(sets))
+	for i := range sets {
+		headers[i] = sets[i].HeaderPolicy
+	}
+	return headers, nil
 }
 
 func (c *Conn) Type(name string, family netfilter.ProtoFamily) (*TypeResponsePolicy, error) {
+	return c.TypeContext(context.Background(), name, family)
+}
+
+// TypeContext is like Type but aborts once ctx is done.
+func (c *Conn) TypeContext(ctx context.Context, name string, family netfilter.ProtoFamily) (*TypeResponsePolicy, error) {
 	p := &TypeResponsePolicy{}
-	if err := c.request(CmdType, newTypePolicy(name, family), p); err != nil {
+	if err := c.request(ctx, CmdType, newTypePolicy(name, family), p); err != nil {
 		return nil, err
 	}
 	return p, nil
@@ -1,7 +1,9 @@
 package ipset
 
 import (
+	"errors"
 	"net"
+	"syscall"
 	"testing"
 	"time"
 
@@ -11,15 +13,29 @@ import (
 	"github.com/ti-mo/netfilter"
 )
 
+// causeError mimics the github.com/pkg/errors wrapper the netfilter
+// package puts around the errors returned by netlink.
+type causeError struct {
+	msg   string
+	cause error
+}
+
+func (e *causeError) Error() string { return e.msg + ": " + e.cause.Error() }
+func (e *causeError) Cause() error  { return e.cause }
+
+func wrapQueryError(err error) error {
+	return &causeError{msg: "netfilter query", cause: err}
+}
+
 type queryMock struct {
 	mock.Mock
 }
 
-func (q queryMock) Close() error {
+func (q *queryMock) Close() error {
 	return nil
 }
 
-func (q queryMock) Query(nlm netlink.Message) ([]netlink.Message, error) {
+func (q *queryMock) Query(nlm netlink.Message) ([]netlink.Message, error) {
 	args := q.Called(nlm.Data)
 	return args.Get(0).([]netlink.Message), args.Error(1)
 }
@@ -205,9 +221,10 @@ func TestConn_Header(t *testing.T) {
 
 	m := new(queryMock)
 
+	// Header sends a header only list dump.
 	data := []byte{
 		0x02, 0x00, 0x00, 0x00, 0x05, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00, 0x00, 0x08, 0x00, 0x02, 0x00,
-		0x62, 0x61, 0x7a, 0x00,
+		0x62, 0x61, 0x7a, 0x00, 0x08, 0x00, 0x06, 0x40, 0x00, 0x00, 0x00, 0x04,
 	}
 	m.On("Query", data).Return([]netlink.Message{
 		{Data: []byte{
@@ -227,6 +244,44 @@ func TestConn_Header(t *testing.T) {
 	m.AssertExpectations(t)
 }
 
+func TestConn_Header_Data(t *testing.T) {
+	assert2 := assert.New(t)
+
+	m := new(queryMock)
+
+	m.On("Query", mock.Anything).Return([]netlink.Message{
+		{Data: []byte{
+			0x02, 0x00, 0x00, 0x00, 0x05, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00, 0x00, 0x08, 0x00, 0x02, 0x00,
+			0x62, 0x61, 0x7a, 0x00, 0x0c, 0x00, 0x03, 0x00, 0x68, 0x61, 0x73, 0x68, 0x3a, 0x69, 0x70, 0x00,
+			0x05, 0x00, 0x05, 0x00, 0x02, 0x00, 0x00, 0x00, 0x05, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x24, 0x00, 0x07, 0x80, 0x08, 0x00, 0x12, 0x40, 0x00, 0x00, 0x04, 0x00, 0x08, 0x00, 0x18, 0x40,
+			0x00, 0x00, 0x00, 0x03, 0x08, 0x00, 0x19, 0x40, 0x00, 0x00, 0x00, 0x01, 0x08, 0x00, 0x1a, 0x40,
+			0x00, 0x00, 0x01, 0x98,
+		}},
+	}, nil)
+
+	c := Conn{Family: netfilter.ProtoIPv4, Conn: m}
+
+	res, err := c.Header("baz")
+	if !assert2.NoError(err) {
+		return
+	}
+	assert2.Equal(uint32(1024), res.Data.HashSize.Get())
+	assert2.Equal(uint32(3), res.Elements.Get())
+	assert2.Equal(uint32(1), res.References.Get())
+	assert2.Equal(uint32(408), res.MemSize.Get())
+
+	// The attributes reported by the kernel are never sent.
+	for _, nfa := range res.marshalAttributes() {
+		assert2.NotEqual(AttrData, AttributeType(nfa.Type))
+	}
+	for _, nfa := range newCreatePolicy(*res, res.Data).marshalAttributes() {
+		for _, child := range nfa.Children {
+			assert2.NotContains([]AttributeType{AttrElements, AttrReferences, AttrMemSize}, AttributeType(child.Type))
+		}
+	}
+}
+
 func TestConn_List(t *testing.T) {
 	assert2 := assert.New(t)
 
@@ -306,9 +361,9 @@ func TestConn_Add(t *testing.T) {
 	m.On("Query", []byte{
 		0x02, 0x00, 0x00, 0x00, 0x05, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00, 0x00, 0x08, 0x00, 0x02, 0x00,
 		0x66, 0x6f, 0x6f, 0x00, 0x34, 0x00, 0x08, 0x80, 0x18, 0x00, 0x07, 0x80, 0x0c, 0x00, 0x01, 0x80,
-		0x08, 0x00, 0x01, 0x40, 0xc0, 0xa8, 0x01, 0x01, 0x08, 0x00, 0x09, 0x40, 0x00, 0x00, 0x00, 0x00,
+		0x08, 0x00, 0x01, 0x40, 0xc0, 0xa8, 0x01, 0x01, 0x08, 0x00, 0x09, 0x40, 0x00, 0x00, 0x00, 0x01,
 		0x18, 0x00, 0x07, 0x80, 0x0c, 0x00, 0x01, 0x80, 0x08, 0x00, 0x01, 0x40, 0xc0, 0xa8, 0x01, 0x02,
-		0x08, 0x00, 0x09, 0x40, 0x00, 0x00, 0x00, 0x01, 0x08, 0x00, 0x09, 0x40, 0x00, 0x00, 0x00, 0x00,
+		0x08, 0x00, 0x09, 0x40, 0x00, 0x00, 0x00, 0x02, 0x08, 0x00, 0x09, 0x40, 0x00, 0x00, 0x00, 0x00,
 	}).Return([]netlink.Message{}, nil)
 
 	c := Conn{Family: netfilter.ProtoIPv4, Conn: m}
@@ -318,3 +373,449 @@ func TestConn_Add(t *testing.T) {
 
 	m.AssertExpectations(t)
 }
+
+// sentEntries returns the line numbers of the entries sent by each call of m.
+func sentEntries(t *testing.T, m *queryMock) [][]uint32 {
+	var sent [][]uint32
+	for _, call := range m.Calls {
+		_, attrs, err := netfilter.UnmarshalNetlink(netlink.Message{Data: call.Arguments.Get(0).([]byte)})
+		if !assert.NoError(t, err) {
+			return nil
+		}
+
+		var lines []uint32
+		for _, nfa := range attrs {
+			if AttributeType(nfa.Type) != AttrADT {
+				continue
+			}
+			for _, e := range unmarshalEntries(nfa) {
+				lines = append(lines, e.Lineno.Get())
+			}
+		}
+		sent = append(sent, lines)
+	}
+	return sent
+}
+
+func TestConn_Add_BatchSize(t *testing.T) {
+	assert2 := assert.New(t)
+
+	m := new(queryMock)
+	m.On("Query", mock.Anything).Return([]netlink.Message{}, nil)
+
+	var entries []*Entry
+	for i := 0; i < 5; i++ {
+		entries = append(entries, NewEntry(EntryIP(net.IPv4(192, 168, 1, byte(i)))))
+	}
+
+	c := Conn{Family: netfilter.ProtoIPv4, Conn: m, BatchSize: 2}
+	assert2.NoError(c.Add("foo", entries...))
+	assert2.Equal([][]uint32{{1, 2}, {3, 4}, {5}}, sentEntries(t, m))
+
+	for _, e := range entries {
+		assert2.False(e.Lineno.IsSet())
+	}
+}
+
+func TestConn_Delete_MessageSize(t *testing.T) {
+	assert2 := assert.New(t)
+
+	m := new(queryMock)
+	m.On("Query", mock.Anything).Return([]netlink.Message{}, nil)
+
+	var entries []*Entry
+	for i := 0; i < 10000; i++ {
+		entries = append(entries, NewEntry(EntryIP(net.IPv4(10, 0, byte(i>>8), byte(i)))))
+	}
+
+	c := Conn{Family: netfilter.ProtoIPv4, Conn: m}
+	assert2.NoError(c.Delete("foo", entries...))
+
+	for _, call := range m.Calls {
+		assert2.True(len(call.Arguments.Get(0).([]byte)) <= maxMessageLen-syscall.NLMSG_HDRLEN)
+	}
+
+	var n uint32
+	for _, lines := range sentEntries(t, m) {
+		for _, line := range lines {
+			n++
+			assert2.Equal(n, line)
+		}
+	}
+	assert2.Equal(uint32(len(entries)), n)
+	assert2.True(len(m.Calls) > 1)
+}
+
+func TestConn_Add_BatchError(t *testing.T) {
+	assert2 := assert.New(t)
+
+	m := new(queryMock)
+	m.On("Query", mock.Anything).Return([]netlink.Message{}, nil).Once()
+	m.On("Query", mock.Anything).Return([]netlink.Message{},
+		&netlink.OpError{Op: "receive", Err: syscall.Errno(4103)}).Once()
+
+	var entries []*Entry
+	for i := 0; i < 5; i++ {
+		entries = append(entries, NewEntry(EntryIP(net.IPv4(192, 168, 1, byte(i)))))
+	}
+
+	c := Conn{Family: netfilter.ProtoIPv4, Conn: m, BatchSize: 2}
+	err := c.Add("foo", entries...)
+
+	// The third batch is not sent.
+	assert2.True(errors.Is(err, ErrElementExists))
+	m.AssertNumberOfCalls(t, "Query", 2)
+
+	// The entries of the first batch have been applied.
+	var e *Error
+	if assert2.True(errors.As(err, &e)) {
+		assert2.Equal(2, e.Applied)
+	}
+}
+
+func TestConn_Add_Error(t *testing.T) {
+	assert2 := assert.New(t)
+
+	m := new(queryMock)
+
+	m.On("Query", mock.Anything).Return([]netlink.Message{},
+		wrapQueryError(&netlink.OpError{Op: "receive", Err: syscall.Errno(4103)}))
+
+	c := Conn{Family: netfilter.ProtoIPv4, Conn: m}
+	entry := NewEntry(EntryIP(net.ParseIP("192.168.1.1")))
+	err := c.Add("foo", entry)
+
+	assert2.True(errors.Is(err, ErrElementExists))
+	assert2.True(errors.Is(err, syscall.Errno(4103)))
+	assert2.EqualError(err, "ipset add foo: element is already added")
+
+	var e *Error
+	if assert2.True(errors.As(err, &e)) {
+		assert2.Equal(CmdAdd, e.Cmd)
+		assert2.Equal("foo", e.Set)
+		assert2.Equal(entry, e.Entry)
+	}
+
+	m.AssertExpectations(t)
+}
+
+func TestConn_Add_LineError(t *testing.T) {
+	assert2 := assert.New(t)
+
+	entries := []*Entry{
+		NewEntry(EntryIP(net.ParseIP("192.168.1.1"))),
+		NewEntry(EntryIP(net.ParseIP("192.168.1.2"))),
+	}
+
+	// The kernel echoes the request with the line number of the rejected entry.
+	echo, err := netfilter.MarshalNetlink(netfilter.Header{}, []netfilter.Attribute{
+		{Type: uint16(AttrSetName), Data: []byte("foo\x00")},
+		{Type: uint16(AttrLineNo), Data: []byte{0, 0, 0, 2}, NetByteOrder: true},
+	})
+	if !assert2.NoError(err) {
+		return
+	}
+	echo.Header.Length = uint32(syscall.NLMSG_HDRLEN + len(echo.Data))
+	request, err := echo.MarshalBinary()
+	if !assert2.NoError(err) {
+		return
+	}
+
+	m := new(queryMock)
+	m.On("Query", mock.Anything).Return([]netlink.Message{}, &netlink.OpError{
+		Op:  "receive",
+		Err: &errorMessage{errno: syscall.Errno(4103), request: request},
+	})
+
+	c := Conn{Family: netfilter.ProtoIPv4, Conn: m}
+	err = c.Add("foo", entries...)
+
+	assert2.True(errors.Is(err, ErrElementExists))
+	assert2.EqualError(err, "ipset add foo: line 2: element is already added")
+
+	var e *Error
+	if assert2.True(errors.As(err, &e)) {
+		assert2.Equal(uint32(2), e.Line)
+		assert2.Equal(entries[1], e.Entry)
+		assert2.Equal(1, e.Applied)
+	}
+
+	m.AssertExpectations(t)
+}
+
+func TestConn_Swap_Error(t *testing.T) {
+	assert2 := assert.New(t)
+
+	m := new(queryMock)
+
+	m.On("Query", mock.Anything).Return([]netlink.Message{},
+		wrapQueryError(&netlink.OpError{Op: "receive", Err: syscall.Errno(4101)}))
+
+	c := Conn{Family: netfilter.ProtoIPv4, Conn: m}
+	err := c.Swap("bar", "baz")
+
+	assert2.True(errors.Is(err, ErrSetNotFound))
+	assert2.False(errors.Is(err, ErrSetExists))
+
+	m.AssertExpectations(t)
+}
+
+func TestConn_Add_TypeSpecificError(t *testing.T) {
+	assert2 := assert.New(t)
+
+	m := new(queryMock)
+
+	// The add request fails with a type specific error code ...
+	m.On("Query", mock.MatchedBy(func(data []byte) bool { return len(data) > 28 })).Return([]netlink.Message{},
+		wrapQueryError(&netlink.OpError{Op: "receive", Err: syscall.Errno(4352)}))
+
+	// ... which is resolved with the set type returned by a header request.
+	m.On("Query", []byte{
+		0x02, 0x00, 0x00, 0x00, 0x05, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00, 0x00, 0x08, 0x00, 0x02, 0x00,
+		0x62, 0x61, 0x7a, 0x00, 0x08, 0x00, 0x06, 0x40, 0x00, 0x00, 0x00, 0x04,
+	}).Return([]netlink.Message{
+		{Data: []byte{
+			0x02, 0x00, 0x00, 0x00, 0x05, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00, 0x00, 0x08, 0x00, 0x02, 0x00,
+			0x62, 0x61, 0x7a, 0x00, 0x0c, 0x00, 0x03, 0x00, 0x68, 0x61, 0x73, 0x68, 0x3a, 0x69, 0x70, 0x00,
+			0x05, 0x00, 0x05, 0x00, 0x02, 0x00, 0x00, 0x00, 0x05, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00,
+		}},
+	}, nil)
+
+	c := Conn{Family: netfilter.ProtoIPv4, Conn: m}
+	err := c.Add("baz", NewEntry(EntryIP(net.ParseIP("192.168.1.1"))))
+
+	assert2.True(errors.Is(err, ErrHashFull))
+
+	m.AssertExpectations(t)
+}
+
+func TestLookupError_TypeSpecific(t *testing.T) {
+	// The error codes of linux/netfilter/ipset/ip_set_{hash,bitmap,list}.h.
+	for _, tt := range []struct {
+		typeName string
+		errno    syscall.Errno
+		want     error
+	}{
+		{"hash:ip", 4352, ErrHashFull},
+		{"hash:ip", 4353, ErrHashElem},
+		{"hash:ip,port", 4354, ErrInvalidProto},
+		{"hash:ip,port", 4355, ErrMissingProto},
+		{"hash:net", 4356, ErrRangeUnsupported},
+		{"hash:net", 4357, ErrInvalidRange},
+		{"bitmap:ip", 4352, ErrOutOfRange},
+		{"bitmap:port", 4353, ErrRangeTooLarge},
+		{"list:set", 4352, ErrMemberSetNotFound},
+		{"list:set", 4353, ErrListLoop},
+		{"list:set", 4354, ErrRefSetMissing},
+		{"list:set", 4355, ErrRefSetNotFound},
+		{"list:set", 4356, ErrListFull},
+		{"list:set", 4357, ErrRefSetNotMember},
+	} {
+		assert.Equal(t, tt.want, lookupError(CmdAdd, tt.errno, tt.typeName), "%s %d", tt.typeName, tt.errno)
+	}
+}
+
+func TestSet_TypeSpecificError(t *testing.T) {
+	assert2 := assert.New(t)
+
+	m := new(queryMock)
+	m.On("Query", mock.Anything).Return([]netlink.Message{},
+		wrapQueryError(&netlink.OpError{Op: "receive", Err: syscall.Errno(4352)}))
+
+	// The set knows its type, so no header is requested.
+	c := Conn{Family: netfilter.ProtoIPv4, Conn: m}
+	err := c.Set("baz", HashIP).Add(NewEntry(EntryIP(net.ParseIP("192.168.1.1"))))
+	assert2.True(errors.Is(err, ErrHashFull))
+	err = c.Set("baz", BitmapPort).Test(EntryPort(80))
+	assert2.True(errors.Is(err, ErrOutOfRange))
+	m.AssertNumberOfCalls(t, "Query", 2)
+}
+
+func TestConn_List_Multipart(t *testing.T) {
+	assert2 := assert.New(t)
+
+	m := new(queryMock)
+
+	data := []byte{
+		0x02, 0x00, 0x00, 0x00, 0x05, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00, 0x00, 0x08, 0x00, 0x02, 0x00,
+		0x62, 0x61, 0x72, 0x00,
+	}
+	m.On("Query", data).Return([]netlink.Message{
+		{Data: []byte{
+			0x02, 0x00, 0x00, 0x00, 0x05, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00, 0x00, 0x08, 0x00, 0x02, 0x00,
+			0x62, 0x61, 0x72, 0x00, 0x0d, 0x00, 0x03, 0x00, 0x68, 0x61, 0x73, 0x68, 0x3a, 0x6d, 0x61, 0x63,
+			0x00, 0x00, 0x00, 0x00, 0x05, 0x00, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 0x00, 0x04, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x07, 0x80, 0x08, 0x00, 0x12, 0x40, 0x00, 0x00, 0x04, 0x00,
+			0x08, 0x00, 0x13, 0x40, 0x00, 0x01, 0x00, 0x00, 0x08, 0x00, 0x19, 0x40, 0x00, 0x00, 0x00, 0x00,
+			0x08, 0x00, 0x1a, 0x40, 0x00, 0x00, 0x01, 0x18, 0x08, 0x00, 0x18, 0x40, 0x00, 0x00, 0x00, 0x05,
+			0x34, 0x00, 0x08, 0x80, 0x10, 0x00, 0x07, 0x80, 0x0a, 0x00, 0x11, 0x00, 0x01, 0x23, 0x45, 0x67,
+			0x89, 0xaf, 0x00, 0x00, 0x10, 0x00, 0x07, 0x80, 0x0a, 0x00, 0x11, 0x00, 0x01, 0x23, 0x45, 0x67,
+			0x89, 0xae, 0x00, 0x00, 0x10, 0x00, 0x07, 0x80, 0x0a, 0x00, 0x11, 0x00, 0x01, 0x23, 0x45, 0x67,
+			0x89, 0xad, 0x00, 0x00,
+		}},
+		{Data: []byte{
+			0x02, 0x00, 0x00, 0x00, 0x05, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00, 0x00, 0x08, 0x00, 0x02, 0x00,
+			0x62, 0x61, 0x72, 0x00, 0x24, 0x00, 0x08, 0x80, 0x10, 0x00, 0x07, 0x80, 0x0a, 0x00, 0x11, 0x00,
+			0x01, 0x23, 0x45, 0x67, 0x89, 0xac, 0x00, 0x00, 0x10, 0x00, 0x07, 0x80, 0x0a, 0x00, 0x11, 0x00,
+			0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0x00, 0x00,
+		}},
+		{Header: netlink.Header{Type: netlink.Done}, Data: []byte{0x00, 0x00, 0x00, 0x00}},
+	}, nil)
+
+	c := Conn{Family: netfilter.ProtoIPv4, Conn: m}
+
+	p, err := c.List("bar")
+	if assert2.NoError(err) {
+		assert2.Equal("bar", p.Name.Get())
+		assert2.Equal("hash:mac", p.TypeName.Get())
+		assert2.Len(p.Entries, 5)
+
+		assert2.Equal(net.HardwareAddr{0x01, 0x23, 0x45, 0x67, 0x89, 0xaf}, p.Entries[0].Ether.Get())
+		assert2.Equal(net.HardwareAddr{0x01, 0x23, 0x45, 0x67, 0x89, 0xab}, p.Entries[4].Ether.Get())
+	}
+
+	m.AssertExpectations(t)
+}
+
+func TestConn_WalkSet(t *testing.T) {
+	assert2 := assert.New(t)
+
+	m := new(queryMock)
+
+	data := []byte{
+		0x02, 0x00, 0x00, 0x00, 0x05, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00, 0x00, 0x08, 0x00, 0x02, 0x00,
+		0x62, 0x61, 0x7a, 0x00,
+	}
+	m.On("Query", data).Return([]netlink.Message{
+		{Data: []byte{
+			0x02, 0x00, 0x00, 0x00, 0x05, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00, 0x00, 0x08, 0x00, 0x02, 0x00,
+			0x62, 0x61, 0x7a, 0x00, 0x0c, 0x00, 0x03, 0x00, 0x68, 0x61, 0x73, 0x68, 0x3a, 0x69, 0x70, 0x00,
+			0x05, 0x00, 0x05, 0x00, 0x02, 0x00, 0x00, 0x00, 0x05, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x2c, 0x00, 0x07, 0x80, 0x08, 0x00, 0x12, 0x40, 0x00, 0x00, 0x04, 0x00, 0x08, 0x00, 0x13, 0x40,
+			0x00, 0x01, 0x00, 0x00, 0x08, 0x00, 0x19, 0x40, 0x00, 0x00, 0x00, 0x00, 0x08, 0x00, 0x1a, 0x40,
+			0x00, 0x00, 0x00, 0xe8, 0x08, 0x00, 0x18, 0x40, 0x00, 0x00, 0x00, 0x03, 0x34, 0x00, 0x08, 0x80,
+			0x10, 0x00, 0x07, 0x80, 0x0c, 0x00, 0x01, 0x80, 0x08, 0x00, 0x01, 0x00, 0xc0, 0xa8, 0x08, 0x03,
+			0x10, 0x00, 0x07, 0x80, 0x0c, 0x00, 0x01, 0x80, 0x08, 0x00, 0x01, 0x00, 0xc0, 0xa8, 0x08, 0x02,
+			0x10, 0x00, 0x07, 0x80, 0x0c, 0x00, 0x01, 0x80, 0x08, 0x00, 0x01, 0x00, 0xc0, 0xa8, 0x08, 0x01,
+		}},
+	}, nil)
+
+	c := Conn{Family: netfilter.ProtoIPv4, Conn: m}
+
+	var (
+		sets []string
+		ips  []net.IP
+	)
+	err := c.WalkSet("baz", func(h *HeaderPolicy, e *Entry) error {
+		if e == nil {
+			sets = append(sets, h.Name.Get())
+			return nil
+		}
+		ips = append(ips, e.IP.Get())
+		if len(ips) == 2 {
+			return ErrStopWalk
+		}
+		return nil
+	})
+	if assert2.NoError(err) {
+		assert2.Equal([]string{"baz"}, sets)
+		assert2.Equal([]net.IP{{192, 168, 8, 3}, {192, 168, 8, 2}}, ips)
+	}
+
+	m.AssertExpectations(t)
+}
+
+// decodeRequest decodes the request of the i-th call of m into p.
+func decodeRequest(t *testing.T, m *queryMock, i int, p attributeUnmarshaller) {
+	err := unmarshalMessage(netlink.Message{Data: m.Calls[i].Arguments.Get(0).([]byte)}, p)
+	assert.NoError(t, err)
+}
+
+// sentPolicy decodes the request of the i-th call of m as create request.
+func sentPolicy(t *testing.T, m *queryMock, i int) *CreatePolicy {
+	p := &CreatePolicy{}
+	decodeRequest(t, m, i, p)
+	return p
+}
+
+func TestConn_ReplaceContents(t *testing.T) {
+	assert2 := assert.New(t)
+
+	header, err := netfilter.MarshalNetlink(netfilter.Header{}, newCreatePolicy(
+		newHeaderPolicy(newNamePolicy("foo"), "hash:ip", 4, netfilter.ProtoIPv4),
+		newCreateData(CreateDataHashSize(2048), CreateDataTimeout(time.Hour)),
+	).marshalAttributes())
+	if !assert2.NoError(err) {
+		return
+	}
+
+	m := new(queryMock)
+	m.On("Query", mock.Anything).Return([]netlink.Message{header}, nil).Once()
+	m.On("Query", mock.Anything).Return([]netlink.Message{}, nil)
+
+	c := Conn{Family: netfilter.ProtoIPv4, Conn: m}
+	err = c.ReplaceContents("foo", NewEntry(EntryIP(net.ParseIP("192.168.1.1"))))
+	if !assert2.NoError(err) || !assert2.Len(m.Calls, 5) {
+		return
+	}
+
+	// create, add, swap, destroy
+	create := sentPolicy(t, m, 1)
+	tmp := create.Name.Get()
+	assert2.Regexp(`^foo-[0-9a-f]{8}$`, tmp)
+	assert2.Equal("hash:ip", create.TypeName.Get())
+	assert2.Equal(uint8(4), create.Revision.Get())
+	assert2.Equal(uint32(2048), create.Data.HashSize.Get())
+	assert2.Equal(time.Hour, create.Data.Timeout.Get())
+
+	assert2.Equal(tmp, sentPolicy(t, m, 2).Name.Get())
+	swap := &MovePolicy{}
+	decodeRequest(t, m, 3, swap)
+	assert2.Equal(tmp, swap.Name.Get())
+	assert2.Equal("foo", swap.To.Get())
+	assert2.Equal(tmp, sentPolicy(t, m, 4).Name.Get())
+}
+
+func TestConn_ReplaceContents_Error(t *testing.T) {
+	assert2 := assert.New(t)
+
+	header, err := netfilter.MarshalNetlink(netfilter.Header{}, newHeaderPolicy(
+		newNamePolicy("foo"), "hash:ip", 4, netfilter.ProtoIPv4).marshalAttributes())
+	if !assert2.NoError(err) {
+		return
+	}
+
+	m := new(queryMock)
+	m.On("Query", mock.Anything).Return([]netlink.Message{header}, nil).Once()
+	m.On("Query", mock.Anything).Return([]netlink.Message{}, nil).Once()
+	m.On("Query", mock.Anything).Return([]netlink.Message{},
+		&netlink.OpError{Op: "receive", Err: syscall.Errno(4111)}).Once()
+	m.On("Query", mock.Anything).Return([]netlink.Message{}, nil).Once()
+
+	c := Conn{Family: netfilter.ProtoIPv4, Conn: m}
+	err = c.ReplaceContents("foo", NewEntry(EntryIP(net.ParseIP("192.168.1.1"))))
+	assert2.True(errors.Is(err, ErrNoCounters))
+
+	// The temporary set is destroyed without swapping it.
+	if assert2.Len(m.Calls, 4) {
+		assert2.Equal(sentPolicy(t, m, 1).Name.Get(), sentPolicy(t, m, 3).Name.Get())
+	}
+	m.AssertExpectations(t)
+}
+
+func TestConn_Headers(t *testing.T) {
+	assert2 := assert.New(t)
+	c, _ := newFakeConn()
+
+	assert2.NoError(c.Create("foo", "hash:ip", 6, netfilter.ProtoIPv4))
+	assert2.NoError(c.Create("bar", "hash:net", 7, netfilter.ProtoIPv4, CreateDataCounters()))
+	assert2.NoError(c.Add("bar", NewEntry(EntryIP(net.ParseIP("10.0.0.0")), EntryCidr(8))))
+
+	headers, err := c.Headers()
+	if assert2.NoError(err) && assert2.Len(headers, 2) {
+		assert2.Equal("foo", headers[0].Name.Get())
+		assert2.Equal("bar", headers[1].Name.Get())
+		assert2.Equal(uint32(1), headers[1].Elements.Get())
+		assert2.Equal(uint32(WithCounters), headers[1].Data.CadtFlags.Get())
+	}
+}
@@ -0,0 +1,78 @@
+package ipset
+
+import (
+	"context"
+	"time"
+
+	"github.com/mdlayher/netlink"
+)
+
+// deadliner is implemented by connectors whose blocking reads and
+// writes can be interrupted by a deadline, like netlink.Conn.
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// aLongTimeAgo is a deadline in the past, which interrupts blocked calls immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// withContext calls fn, which uses the connector, and interrupts it once
+// ctx is done by moving the deadline of the socket into the past. If fn fails
+// after ctx is done, the error of ctx is returned instead.
+//
+// A request interrupted while the kernel is still answering it leaves the
+// rest of the response unread, which the next request skips.
+func (c *Conn) withContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	d, ok := c.Conn.(deadliner)
+	if !ok || ctx.Done() == nil {
+		return fn()
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := d.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			_ = d.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+
+	err := fn()
+	close(stop)
+	<-stopped
+	if derr := d.SetDeadline(time.Time{}); err == nil {
+		err = derr
+	}
+
+	if err != nil {
+		if cerr := ctx.Err(); cerr != nil {
+			return cerr
+		}
+		// The socket deadline may expire right before the context.
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
+
+// queryContext sends req and returns the response, aborting once ctx is done.
+func (c *Conn) queryContext(ctx context.Context, req netlink.Message) (nlm []netlink.Message, err error) {
+	err = c.withContext(ctx, func() error {
+		nlm, err = c.Conn.Query(req)
+		return err
+	})
+	return nlm, err
+}
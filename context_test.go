@@ -0,0 +1,128 @@
+package ipset
+
+import (
+	"context"
+	stderrors "errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+// wedgedConn is a connector whose queries block until its deadline expires.
+type wedgedConn struct {
+	mu        sync.Mutex
+	deadlines []time.Time
+	changed   chan struct{}
+}
+
+func newWedgedConn() *wedgedConn {
+	return &wedgedConn{changed: make(chan struct{}, 1)}
+}
+
+func (w *wedgedConn) Close() error {
+	return nil
+}
+
+func (w *wedgedConn) SetDeadline(t time.Time) error {
+	w.mu.Lock()
+	w.deadlines = append(w.deadlines, t)
+	w.mu.Unlock()
+
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (w *wedgedConn) Query(nlm netlink.Message) ([]netlink.Message, error) {
+	for {
+		w.mu.Lock()
+		var deadline time.Time
+		if n := len(w.deadlines); n > 0 {
+			deadline = w.deadlines[n-1]
+		}
+		w.mu.Unlock()
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return nil, &netlink.OpError{Op: "receive", Err: stderrors.New("i/o timeout")}
+		}
+
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			expired = time.After(time.Until(deadline))
+		}
+		select {
+		case <-w.changed:
+		case <-expired:
+		}
+	}
+}
+
+func TestConn_Context_Deadline(t *testing.T) {
+	assert2 := assert.New(t)
+
+	w := newWedgedConn()
+	c := Conn{Family: netfilter.ProtoIPv4, Conn: w}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := c.CreateContext(ctx, "foo", "hash:ip", 6, netfilter.ProtoIPv4)
+	assert2.True(stderrors.Is(err, context.DeadlineExceeded))
+
+	// The deadline of the context is applied and reset afterwards.
+	if assert2.NotEmpty(w.deadlines) {
+		deadline, _ := ctx.Deadline()
+		assert2.Equal(deadline, w.deadlines[0])
+		assert2.True(w.deadlines[len(w.deadlines)-1].IsZero())
+	}
+}
+
+func TestConn_Context_Cancel(t *testing.T) {
+	assert2 := assert.New(t)
+
+	w := newWedgedConn()
+	c := Conn{Family: netfilter.ProtoIPv4, Conn: w}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	_, err := c.ListAllContext(ctx)
+	assert2.True(stderrors.Is(err, context.Canceled))
+
+	// A done context fails before sending anything.
+	err = c.DestroyContext(ctx, "foo")
+	assert2.Equal(context.Canceled, err)
+}
+
+func TestConn_WalkContext_Cancel(t *testing.T) {
+	assert2 := assert.New(t)
+	c, _ := newFakeConn()
+
+	var entries []*Entry
+	for i := 0; i < 2500; i++ {
+		entries = append(entries, NewEntry(EntryIP(net.IPv4(10, 0, byte(i>>8), byte(i)))))
+	}
+	assert2.NoError(c.Create("foo", "hash:ip", 6, netfilter.ProtoIPv4))
+	assert2.NoError(c.AddContext(context.Background(), "foo", entries...))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The dump is aborted at the next message.
+	var n int
+	err := c.WalkSetContext(ctx, "foo", func(h *HeaderPolicy, e *Entry) error {
+		if n++; n == 10 {
+			cancel()
+		}
+		return nil
+	})
+	assert2.Equal(context.Canceled, err)
+	assert2.Equal(fakeListBatch+1, n)
+}
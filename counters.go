@@ -0,0 +1,156 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrCountersMismatch is returned by TestCounters if the entry is in
+// the set, but its counters do not match.
+var ErrCountersMismatch = errors.New("counters do not match")
+
+// Counters are the packet and byte counters of an entry.
+type Counters struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// Counters returns the counters of e and whether it has any,
+// which is the case for entries listed from sets with counters.
+func (e *Entry) Counters() (Counters, bool) {
+	if !e.Packets.IsSet() && !e.Bytes.IsSet() {
+		return Counters{}, false
+	}
+	return Counters{Packets: e.Packets.Get(), Bytes: e.Bytes.Get()}, true
+}
+
+// EntryCounters sets the initial counters of an entry.
+func EntryCounters(v Counters) EntryOption {
+	return func(e *Entry) {
+		e.Packets = NewUInt64Box(v.Packets)
+		e.Bytes = NewUInt64Box(v.Bytes)
+	}
+}
+
+// CreateDataCounters enables the counters of the set, keeping the flags
+// set by preceding options. It must follow CreateDataCadtFlags, which
+// replaces all flags.
+func CreateDataCounters() CreateDataOption {
+	return func(d *CreateData) { d.addFlags(WithCounters) }
+}
+
+// EntryStats is an entry of a set along with its counters.
+type EntryStats struct {
+	Entry *Entry
+	Counters
+}
+
+// Stats lists the set name and returns the counters of its entries.
+// It fails with ErrNoCounters if the set was created without counters.
+func (c *Conn) Stats(name string) ([]EntryStats, error) {
+	return c.StatsContext(context.Background(), name)
+}
+
+// StatsContext is like Stats but aborts once ctx is done.
+func (c *Conn) StatsContext(ctx context.Context, name string) ([]EntryStats, error) {
+	s, err := c.listCounters(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]EntryStats, len(s.Entries))
+	for i, e := range s.Entries {
+		stats[i].Entry = e
+		stats[i].Counters, _ = e.Counters()
+	}
+	return stats, nil
+}
+
+// ResetCounters zeroes the counters of all entries of the set name.
+//
+// The kernel has no command for it, so the entries are listed and added
+// again with zero counters, keeping their remaining timeout and comment.
+// This is not atomic: entries added meanwhile are not reset, and entries
+// deleted or expired meanwhile are added back. Packets counted between
+// listing and adding are lost.
+func (c *Conn) ResetCounters(name string) error {
+	return c.ResetCountersContext(context.Background(), name)
+}
+
+// ResetCountersContext is like ResetCounters but aborts once ctx is done.
+func (c *Conn) ResetCountersContext(ctx context.Context, name string) error {
+	s, err := c.listCounters(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	entries := make(Entries, len(s.Entries))
+	for i, e := range s.Entries {
+		reset := *e
+		reset.set(EntryCounters(Counters{}))
+		entries[i] = &reset
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return c.AddContext(ctx, name, entries...)
+}
+
+// CounterMatch matches the counters of an entry, like the counter
+// options of the set match of iptables.
+type CounterMatch func(Counters) bool
+
+func PacketsEq(v uint64) CounterMatch { return func(c Counters) bool { return c.Packets == v } }
+func PacketsNe(v uint64) CounterMatch { return func(c Counters) bool { return c.Packets != v } }
+func PacketsLt(v uint64) CounterMatch { return func(c Counters) bool { return c.Packets < v } }
+func PacketsGt(v uint64) CounterMatch { return func(c Counters) bool { return c.Packets > v } }
+func BytesEq(v uint64) CounterMatch   { return func(c Counters) bool { return c.Bytes == v } }
+func BytesNe(v uint64) CounterMatch   { return func(c Counters) bool { return c.Bytes != v } }
+func BytesLt(v uint64) CounterMatch   { return func(c Counters) bool { return c.Bytes < v } }
+func BytesGt(v uint64) CounterMatch   { return func(c Counters) bool { return c.Bytes > v } }
+
+// TestCounters tests whether the element of e is in the set name and its
+// counters satisfy all matches. It fails with ErrElementNotFound if it is
+// not in the set and with ErrCountersMismatch if any match fails.
+//
+// The kernel does not match counters when testing, so the set is listed
+// and its entries compared by ElementKey. Unlike Test, e must therefore
+// name the element as added, e.g. a network rather than an address in it.
+func (c *Conn) TestCounters(name string, e *Entry, matches ...CounterMatch) error {
+	return c.TestCountersContext(context.Background(), name, e, matches...)
+}
+
+// TestCountersContext is like TestCounters but aborts once ctx is done.
+func (c *Conn) TestCountersContext(ctx context.Context, name string, e *Entry, matches ...CounterMatch) error {
+	s, err := c.listCounters(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	key := e.ElementKey()
+	for _, item := range s.Entries {
+		if item.ElementKey() != key {
+			continue
+		}
+		counters, _ := item.Counters()
+		for _, match := range matches {
+			if !match(counters) {
+				return &Error{Cmd: CmdTest, Set: name, Entry: e, Err: ErrCountersMismatch}
+			}
+		}
+		return nil
+	}
+	return &Error{Cmd: CmdTest, Set: name, Entry: e, Err: ErrElementNotFound}
+}
+
+// listCounters lists the set name, failing if it has no counters.
+func (c *Conn) listCounters(ctx context.Context, name string) (*SetPolicy, error) {
+	s, err := c.ListContext(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if s.Data == nil || CadtFlags(s.Data.CadtFlags.Get())&WithCounters == 0 {
+		return nil, &Error{Cmd: CmdList, Set: name, Err: ErrNoCounters}
+	}
+	return s, nil
+}
@@ -0,0 +1,78 @@
+package ipset
+
+import (
+	stderrors "errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+func TestConn_Stats(t *testing.T) {
+	assert2 := assert.New(t)
+	c, k := newFakeConn()
+
+	now := time.Unix(1000, 0)
+	k.Now = func() time.Time { return now }
+
+	options := []CreateDataOption{
+		CreateDataTimeout(time.Hour),
+		CreateDataCadtFlags(uint32(WithComment)),
+		CreateDataCounters(),
+	}
+	assert2.Equal(uint32(WithCounters|WithComment), newCreateData(options...).CadtFlags.Get())
+	// CreateDataCadtFlags replaces the flags of preceding options.
+	assert2.Equal(uint32(WithComment), newCreateData(CreateDataCounters(), CreateDataCadtFlags(uint32(WithComment))).CadtFlags.Get())
+	assert2.NoError(c.Create("counted", "hash:net", 7, netfilter.ProtoIPv4, options...))
+	assert2.NoError(c.Replace("counted", "hash:net", 7, netfilter.ProtoIPv4, options...))
+
+	assert2.NoError(c.Add("counted",
+		NewEntry(EntryIP(net.ParseIP("10.0.0.0")), EntryCidr(24), EntryCounters(Counters{Packets: 3, Bytes: 120}), EntryComment("lan")),
+		NewEntry(EntryIP(net.ParseIP("10.1.0.1")), EntryTimeout(0)),
+	))
+
+	stats, err := c.Stats("counted")
+	if assert2.NoError(err) && assert2.Len(stats, 2) {
+		assert2.Equal("10.0.0.0", stats[0].Entry.IP.Get().String())
+		assert2.Equal(Counters{Packets: 3, Bytes: 120}, stats[0].Counters)
+		assert2.Equal(Counters{}, stats[1].Counters)
+	}
+
+	// Adding the entry again keeps its counters unless given.
+	assert2.NoError(c.Add("counted", NewEntry(EntryIP(net.ParseIP("10.0.0.0")), EntryCidr(24), EntryComment("lan"))))
+
+	assert2.NoError(c.TestCounters("counted", NewEntry(EntryIP(net.ParseIP("10.0.0.0")), EntryCidr(24)),
+		PacketsEq(3), PacketsGt(2), BytesLt(121), BytesNe(0)))
+	assert2.NoError(c.TestCounters("counted", NewEntry(EntryIP(net.ParseIP("10.1.0.1"))), PacketsEq(0), BytesEq(0)))
+
+	err = c.TestCounters("counted", NewEntry(EntryIP(net.ParseIP("10.0.0.0")), EntryCidr(24)), PacketsLt(3))
+	assert2.True(stderrors.Is(err, ErrCountersMismatch))
+	assert2.EqualError(err, "ipset test counted: counters do not match")
+	err = c.TestCounters("counted", NewEntry(EntryIP(net.ParseIP("10.0.0.1"))), PacketsEq(0))
+	assert2.True(stderrors.Is(err, ErrElementNotFound))
+
+	// Resetting keeps the remaining timeout and the comment.
+	now = now.Add(time.Minute)
+	assert2.NoError(c.ResetCounters("counted"))
+	p, err := c.List("counted")
+	if assert2.NoError(err) && assert2.Len(p.Entries, 2) {
+		counters, ok := p.Entries[0].Counters()
+		assert2.True(ok)
+		assert2.Equal(Counters{}, counters)
+		assert2.Equal(time.Hour-time.Minute, p.Entries[0].Timeout.Get())
+		assert2.Equal("lan", p.Entries[0].Comment.Get())
+		assert2.Equal(time.Duration(0), p.Entries[1].Timeout.Get())
+	}
+
+	// Sets without counters are rejected.
+	assert2.NoError(c.Create("plain", "hash:ip", 6, netfilter.ProtoIPv4))
+	_, err = c.Stats("plain")
+	assert2.True(stderrors.Is(err, ErrNoCounters))
+	assert2.True(stderrors.Is(c.ResetCounters("plain"), ErrNoCounters))
+	assert2.True(stderrors.Is(c.TestCounters("plain", NewEntry(EntryIP(net.ParseIP("10.0.0.1")))), ErrNoCounters))
+
+	_, ok := NewEntry(EntryIP(net.ParseIP("10.0.0.1"))).Counters()
+	assert2.False(ok)
+}
@@ -1,6 +1,7 @@
 package ipset
 
 import (
+	"net"
 	"time"
 
 	"github.com/ti-mo/netfilter"
@@ -8,10 +9,16 @@ import (
 
 type CreateData struct {
 	CadtFlags *UInt32Box
+	Cidr      *UInt8Box
 	HashSize  *UInt32Box
+	InitVal   *UInt32Box
+	IPTo      *IPAddrBox
+	IP        *IPAddrBox
 	MarkMask  *UInt32Box
 	MaxElem   *UInt32Box
 	NetMask   *UInt8Box
+	PortTo    *UInt16Box
+	Port      *UInt16Box
 	Probes    *UInt8Box
 	Proto     *UInt8Box
 	Resize    *UInt8Box
@@ -21,12 +28,33 @@ type CreateData struct {
 
 type CreateDataOption func(d *CreateData)
 
+// CreateDataCadtFlags sets the flags of the set to v, replacing those
+// added by preceding options like CreateDataCounters.
 func CreateDataCadtFlags(v uint32) CreateDataOption {
 	return func(d *CreateData) { d.CadtFlags = NewUInt32Box(v) }
 }
+
+func CreateDataCidr(v uint8) CreateDataOption {
+	return func(d *CreateData) { d.Cidr = NewUInt8Box(v) }
+}
+
+// CreateDataBucketSize sets the bucket size of hash sets, which
+// shares its attribute with the obsolete probes parameter.
+func CreateDataBucketSize(v uint8) CreateDataOption {
+	return func(d *CreateData) { d.Probes = NewUInt8Box(v) }
+}
 func CreateDataHashSize(v uint32) CreateDataOption {
 	return func(d *CreateData) { d.HashSize = NewUInt32Box(v) }
 }
+func CreateDataInitVal(v uint32) CreateDataOption {
+	return func(d *CreateData) { d.InitVal = NewUInt32Box(v) }
+}
+func CreateDataIPTo(v net.IP) CreateDataOption {
+	return func(d *CreateData) { d.IPTo = NewIPAddrBox(v) }
+}
+func CreateDataIP(v net.IP) CreateDataOption {
+	return func(d *CreateData) { d.IP = NewIPAddrBox(v) }
+}
 func CreateDataMarkMask(v uint32) CreateDataOption {
 	return func(d *CreateData) { d.MarkMask = NewUInt32Box(v) }
 }
@@ -36,6 +64,12 @@ func CreateDataMaxElem(v uint32) CreateDataOption {
 func CreateDataNetMask(v uint8) CreateDataOption {
 	return func(d *CreateData) { d.NetMask = NewUInt8Box(v) }
 }
+func CreateDataPortTo(v uint16) CreateDataOption {
+	return func(d *CreateData) { d.PortTo = NewUInt16Box(v) }
+}
+func CreateDataPort(v uint16) CreateDataOption {
+	return func(d *CreateData) { d.Port = NewUInt16Box(v) }
+}
 func CreateDataProbes(v uint8) CreateDataOption {
 	return func(d *CreateData) { d.Probes = NewUInt8Box(v) }
 }
@@ -52,6 +86,21 @@ func CreateDataTimeout(v time.Duration) CreateDataOption {
 	return func(d *CreateData) { d.Timeout = NewUInt32SecondsDurationBox(v) }
 }
 
+// CreateDataFrom takes over all options of d, e.g. to create a set
+// alike to an existing one. Options following it override single values.
+func CreateDataFrom(d *CreateData) CreateDataOption {
+	return func(x *CreateData) {
+		if d != nil {
+			*x = *d
+		}
+	}
+}
+
+// addFlags adds flags to the CadtFlags of d.
+func (d *CreateData) addFlags(flags CadtFlags) {
+	d.CadtFlags = NewUInt32Box(d.CadtFlags.Get() | uint32(flags))
+}
+
 func newCreateData(options ...CreateDataOption) *CreateData {
 	d := &CreateData{}
 	for _, option := range options {
@@ -60,6 +109,49 @@ func newCreateData(options ...CreateDataOption) *CreateData {
 	return d
 }
 
+func unmarshalCreateData(nfa netfilter.Attribute) *CreateData {
+	d := &CreateData{}
+	unmarshalAttributes(nfa.Children, d)
+	return d
+}
+
+func (d *CreateData) unmarshalAttribute(nfa netfilter.Attribute) {
+	switch at := AttributeType(nfa.Type); at {
+	case AttrCadtFlags:
+		d.CadtFlags = unmarshalUInt32Box(nfa)
+	case AttrCidr:
+		d.Cidr = unmarshalUInt8Box(nfa)
+	case AttrHashSize:
+		d.HashSize = unmarshalUInt32Box(nfa)
+	case AttrInitVal:
+		d.InitVal = unmarshalUInt32Box(nfa)
+	case AttrIPTo:
+		d.IPTo = unmarshalIPAddrBox(nfa)
+	case AttrIP:
+		d.IP = unmarshalIPAddrBox(nfa)
+	case AttrMarkMask:
+		d.MarkMask = unmarshalUInt32Box(nfa)
+	case AttrMaxElem:
+		d.MaxElem = unmarshalUInt32Box(nfa)
+	case AttrNetmask:
+		d.NetMask = unmarshalUInt8Box(nfa)
+	case AttrPortTo:
+		d.PortTo = unmarshalUInt16Box(nfa)
+	case AttrPort:
+		d.Port = unmarshalUInt16Box(nfa)
+	case AttrProbes:
+		d.Probes = unmarshalUInt8Box(nfa)
+	case AttrProto:
+		d.Proto = unmarshalUInt8Box(nfa)
+	case AttrResize:
+		d.Resize = unmarshalUInt8Box(nfa)
+	case AttrSize:
+		d.Size = unmarshalUInt32Box(nfa)
+	case AttrTimeout:
+		d.Timeout = unmarshalUInt32SecondsDurationBox(nfa)
+	}
+}
+
 func (d *CreateData) IsSet() bool {
 	return d != nil
 }
@@ -67,10 +159,16 @@ func (d *CreateData) IsSet() bool {
 func (d CreateData) marshal(t AttributeType) netfilter.Attribute {
 	attrs := newAttributes()
 	attrs.append(AttrCadtFlags, d.CadtFlags)
+	attrs.append(AttrCidr, d.Cidr)
 	attrs.append(AttrHashSize, d.HashSize)
+	attrs.append(AttrInitVal, d.InitVal)
+	attrs.append(AttrIPTo, d.IPTo)
+	attrs.append(AttrIP, d.IP)
 	attrs.append(AttrMarkMask, d.MarkMask)
 	attrs.append(AttrMaxElem, d.MaxElem)
 	attrs.append(AttrNetmask, d.NetMask)
+	attrs.append(AttrPortTo, d.PortTo)
+	attrs.append(AttrPort, d.Port)
 	attrs.append(AttrProbes, d.Probes)
 	attrs.append(AttrProto, d.Proto)
 	attrs.append(AttrResize, d.Resize)
@@ -83,17 +181,15 @@ func (d CreateData) marshal(t AttributeType) netfilter.Attribute {
 	}
 }
 
+// CreatePolicy is the request of a create command. Its create options
+// are held in the Data field of the embedded HeaderPolicy.
 type CreatePolicy struct {
 	HeaderPolicy
-
-	Data *CreateData
 }
 
 func newCreatePolicy(p HeaderPolicy, data *CreateData) *CreatePolicy {
-	return &CreatePolicy{
-		HeaderPolicy: p,
-		Data:         data,
-	}
+	p.Data = data
+	return &CreatePolicy{HeaderPolicy: p}
 }
 
 func (p CreatePolicy) marshalAttributes() Attributes {
@@ -0,0 +1,80 @@
+package ipset
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ElementKey identifies the element of e, ignoring its options. Entries
+// differing only in their options, e.g. their timeout or counters, share
+// a key. The NoMatch and PhysDev flags change what the element matches,
+// so they are part of the key.
+func (e *Entry) ElementKey() string {
+	var b strings.Builder
+	if flags := CadtFlags(e.CadtFlags.Get()) & (NoMatch | PhysDev); flags != 0 {
+		fmt.Fprintf(&b, "%#x|", uint32(flags))
+	}
+	writeIP(&b, e.IP, e.IPTo, e.Cidr)
+	writeIP(&b, e.IP2, e.IP2To, e.Cidr2)
+	if e.Proto.IsSet() || e.Port.IsSet() {
+		fmt.Fprintf(&b, "%d:%d-%d|", e.Proto.Get(), e.Port.Get(), e.PortTo.Get())
+	}
+	if e.Ether.IsSet() {
+		fmt.Fprintf(&b, "%s|", e.Ether.Get())
+	}
+	if e.Iface.IsSet() {
+		fmt.Fprintf(&b, "%s|", e.Iface.Get())
+	}
+	if e.Mark.IsSet() {
+		fmt.Fprintf(&b, "%#x|", e.Mark.Get())
+	}
+	if e.Name.IsSet() {
+		fmt.Fprintf(&b, "%s|", e.Name.Get())
+	}
+	return b.String()
+}
+
+// Element returns a copy of e without its options, as listed by the kernel.
+func (e *Entry) Element() *Entry {
+	return &Entry{
+		CadtFlags: e.CadtFlags,
+		IP:        e.IP,
+		IPTo:      e.IPTo,
+		Cidr:      e.Cidr,
+		IP2:       e.IP2,
+		IP2To:     e.IP2To,
+		Cidr2:     e.Cidr2,
+		Proto:     e.Proto,
+		Port:      e.Port,
+		PortTo:    e.PortTo,
+		Ether:     e.Ether,
+		Iface:     e.Iface,
+		Mark:      e.Mark,
+		Name:      e.Name,
+	}
+}
+
+// writeIP writes an address, range or network. The kernel lists host
+// addresses of network types with their full prefix length, which is
+// therefore assumed if none is given.
+func writeIP(b *strings.Builder, ip, to *IPAddrBox, cidr *UInt8Box) {
+	if !ip.IsSet() {
+		return
+	}
+
+	addr := ip.Get()
+	bits := net.IPv6len * 8
+	if v4 := addr.To4(); v4 != nil {
+		addr, bits = v4, net.IPv4len*8
+	}
+	if cidr.IsSet() {
+		bits = int(cidr.Get())
+	}
+
+	fmt.Fprintf(b, "%s/%d", addr.Mask(net.CIDRMask(bits, len(addr)*8)), bits)
+	if to.IsSet() {
+		fmt.Fprintf(b, "-%s", to.Get().String())
+	}
+	b.WriteByte('|')
+}
@@ -21,6 +21,8 @@ type Entry struct {
 	IP        *IPAddrBox
 	Lineno    *NetUInt32Box
 	Mark      *UInt32Box
+	Name      *NullStringBox
+	NameRef   *NullStringBox
 	Packets   *UInt64Box
 	PortTo    *UInt16Box
 	Port      *UInt16Box
@@ -48,6 +50,8 @@ func EntryIPTo(v net.IP) EntryOption     { return func(e *Entry) { e.IPTo = NewI
 func EntryIP(v net.IP) EntryOption       { return func(e *Entry) { e.IP = NewIPAddrBox(v) } }
 func EntryLineno(v uint32) EntryOption   { return func(e *Entry) { e.Lineno = NewNetUInt32Box(v) } }
 func EntryMark(v uint32) EntryOption     { return func(e *Entry) { e.Mark = NewUInt32Box(v) } }
+func EntryName(v string) EntryOption     { return func(e *Entry) { e.Name = NewNullStringBox(v) } }
+func EntryNameRef(v string) EntryOption  { return func(e *Entry) { e.NameRef = NewNullStringBox(v) } }
 func EntryPackets(v uint64) EntryOption  { return func(e *Entry) { e.Packets = NewUInt64Box(v) } }
 func EntryPortTo(v uint16) EntryOption   { return func(e *Entry) { e.PortTo = NewUInt16Box(v) } }
 func EntryPort(v uint16) EntryOption     { return func(e *Entry) { e.Port = NewUInt16Box(v) } }
@@ -105,6 +109,10 @@ func (e *Entry) unmarshalAttribute(nfa netfilter.Attribute) {
 		e.Lineno = unmarshalNetUInt32Box(nfa)
 	case AttrMark:
 		e.Mark = unmarshalUInt32Box(nfa)
+	case AttrName:
+		e.Name = unmarshalNullStringBox(nfa)
+	case AttrNameRef:
+		e.NameRef = unmarshalNullStringBox(nfa)
 	case AttrPackets:
 		e.Packets = unmarshalUInt64Box(nfa)
 	case AttrPortTo:
@@ -139,6 +147,8 @@ func (e *Entry) marshal(t AttributeType) netfilter.Attribute {
 	attrs.append(AttrIP, e.IP)
 	attrs.append(AttrLineNo, e.Lineno)
 	attrs.append(AttrMark, e.Mark)
+	attrs.append(AttrName, e.Name)
+	attrs.append(AttrNameRef, e.NameRef)
 	attrs.append(AttrPackets, e.Packets)
 	attrs.append(AttrPortTo, e.PortTo)
 	attrs.append(AttrPort, e.Port)
@@ -173,8 +183,7 @@ func (e Entries) IsSet() bool {
 
 func (e Entries) marshal(t AttributeType) netfilter.Attribute {
 	children := newAttributes()
-	for i, item := range e {
-		item.set(EntryLineno(uint32(i)))
+	for _, item := range e {
 		children.append(AttrData, item)
 	}
 
@@ -185,6 +194,39 @@ func (e Entries) marshal(t AttributeType) netfilter.Attribute {
 	}
 }
 
+// numbered returns a copy of the entries in which entries without a line
+// number are numbered by their position, starting after offset. This allows
+// the kernel to report which entry it rejected.
+func (e Entries) numbered(offset uint32) Entries {
+	if e == nil {
+		return nil
+	}
+	numbered := make(Entries, len(e))
+	for i, item := range e {
+		if !item.Lineno.IsSet() {
+			c := *item
+			c.set(EntryLineno(offset + uint32(i) + 1))
+			item = &c
+		}
+		numbered[i] = item
+	}
+	return numbered
+}
+
+// lookup returns the entry the kernel reported by its line number,
+// reversing numbered.
+func (e Entries) lookup(offset, lineNo uint32) *Entry {
+	for _, item := range e {
+		if item.Lineno.IsSet() && item.Lineno.Get() == lineNo {
+			return item
+		}
+	}
+	if i := int(lineNo) - int(offset) - 1; i >= 0 && i < len(e) && !e[i].Lineno.IsSet() {
+		return e[i]
+	}
+	return nil
+}
+
 func (e *Entries) unmarshalAttribute(nfa netfilter.Attribute) {
 	for i := range nfa.Children {
 		*e = append(*e, unmarshalEntry(nfa.Children[i]))
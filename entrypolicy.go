@@ -1,11 +1,20 @@
 package ipset
 
+import (
+	"github.com/ti-mo/netfilter"
+)
+
 type EntryAddDelPolicy struct {
 	NamePolicy
 
 	LineNo *NetUInt32Box
 
 	Entries Entries
+
+	// offset is the number of entries sent in preceding batches.
+	offset uint32
+	// typ is the type of the set, if known, to resolve errors.
+	typ string
 }
 
 func newEntryPolicy(p NamePolicy, lineNo uint32, entries Entries) EntryAddDelPolicy {
@@ -18,7 +27,36 @@ func newEntryPolicy(p NamePolicy, lineNo uint32, entries Entries) EntryAddDelPol
 
 func (p EntryAddDelPolicy) marshalAttributes() Attributes {
 	attrs := p.NamePolicy.marshalAttributes()
-	attrs.append(AttrADT, p.Entries)
+	attrs.append(AttrADT, p.Entries.numbered(p.offset))
 	attrs.append(AttrLineNo, p.LineNo)
 	return attrs
 }
+
+func (p *EntryAddDelPolicy) unmarshalAttribute(nfa netfilter.Attribute) {
+	switch at := AttributeType(nfa.Type); at {
+	case AttrADT:
+		p.Entries = unmarshalEntries(nfa)
+	case AttrData:
+		// Single entries may be sent without the surrounding ADT attribute.
+		p.Entries = append(p.Entries, unmarshalEntry(nfa))
+	case AttrLineNo:
+		p.LineNo = unmarshalNetUInt32Box(nfa)
+	default:
+		p.NamePolicy.unmarshalAttribute(nfa)
+	}
+}
+
+func (p EntryAddDelPolicy) entry() *Entry {
+	if len(p.Entries) != 1 {
+		return nil
+	}
+	return p.Entries[0]
+}
+
+func (p EntryAddDelPolicy) typeName() string {
+	return p.typ
+}
+
+func (p EntryAddDelPolicy) entryAt(lineNo uint32) *Entry {
+	return p.Entries.lookup(p.offset, lineNo)
+}
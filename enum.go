@@ -1,6 +1,8 @@
 package ipset
 
 import (
+	"strconv"
+
 	"github.com/ti-mo/netfilter"
 )
 
@@ -28,6 +30,29 @@ const (
 	CmdType     // 13: Get set type
 )
 
+var messageTypeNames = [...]string{
+	CmdProtocol: "protocol",
+	CmdCreate:   "create",
+	CmdDestroy:  "destroy",
+	CmdFlush:    "flush",
+	CmdRename:   "rename",
+	CmdSwap:     "swap",
+	CmdList:     "list",
+	CmdSave:     "save",
+	CmdAdd:      "add",
+	CmdDel:      "del",
+	CmdTest:     "test",
+	CmdHeader:   "header",
+	CmdType:     "type",
+}
+
+func (t messageType) String() string {
+	if int(t) < len(messageTypeNames) && messageTypeNames[t] != "" {
+		return messageTypeNames[t]
+	}
+	return "cmd(" + strconv.Itoa(int(t)) + ")"
+}
+
 const (
 	_ uint16 = iota
 	SetAttrIPAddrIPV4
@@ -87,6 +112,10 @@ const (
 	AttrElements   // 24:
 	AttrReferences // 25:
 	AttrMemSize    // 26:
+
+	// Recent kernels reuse the slots of obsolete attributes.
+	AttrInitVal    = AttrGc
+	AttrBucketSize = AttrProbes
 )
 
 const (
@@ -118,3 +147,14 @@ const (
 	WithForceDdd
 	WithSkbInfo
 )
+
+// CmdFlags are sent at command level in AttrFlags.
+type CmdFlags uint32
+
+const (
+	FlagExist CmdFlags = 1 << iota
+	FlagListSetName
+	FlagListHeader
+	FlagSkipCounterUpdate
+	FlagSkipSubcounterUpdate
+)
@@ -0,0 +1,351 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mdlayher/netlink"
+)
+
+// Error codes private to the ipset subsystem, as defined in
+// linux/netfilter/ipset/ip_set.h.
+const (
+	errPrivate         = 4096 + iota
+	errProtocol               // 4097: Protocol error
+	errFindType               // 4098: Cannot find set type
+	errMaxSets                // 4099: Max sets reached
+	errBusy                   // 4100: Set is busy (referenced by a kernel component)
+	errExistSetName2          // 4101: Second set exists (rename) or is missing (swap)
+	errTypeMismatch           // 4102: Set types do not match (swap)
+	errExist                  // 4103: Element exists (add) or is missing (del, test)
+	errInvalidCidr            // 4104: Invalid CIDR value
+	errInvalidNetmask         // 4105: Invalid netmask value
+	errInvalidFamily          // 4106: Invalid family
+	errTimeout                // 4107: Timeout not supported
+	errReferenced             // 4108: Set is referenced (rename)
+	errIPAddrIPv4             // 4109: IPv4 address expected
+	errIPAddrIPv6             // 4110: IPv6 address expected
+	errCounter                // 4111: Counters not supported
+	errComment                // 4112: Comment not supported
+	errInvalidMarkmask        // 4113: Invalid markmask value
+	errSkbInfo                // 4114: Skbinfo not supported
+	errTypeSpecific    = 4352 // Start of the set type specific error codes
+)
+
+// Error codes specific to the hash, bitmap and list set types.
+// They overlap and can only be resolved with the set type at hand.
+const (
+	errHashFull = errTypeSpecific + iota
+	errHashElem
+	errInvalidProto
+	errMissingProto
+	errHashRangeUnsupported
+	errHashRange
+)
+
+const (
+	errBitmapRange = errTypeSpecific + iota
+	errBitmapRangeSize
+)
+
+const (
+	errListName = errTypeSpecific + iota
+	errListLoop
+	errListBefore
+	errListNameRef
+	errListFull
+	errListRefExist
+)
+
+// Sentinel errors reported by the kernel. Errors returned by Conn methods
+// wrap one of these in an *Error and can be checked using errors.Is.
+var (
+	ErrProtocol          = errors.New("ipset protocol error")
+	ErrSetNotFound       = errors.New("set does not exist")
+	ErrSetExists         = errors.New("set with the same name already exists")
+	ErrTypeNotFound      = errors.New("set type not supported")
+	ErrMaxSets           = errors.New("maximal number of sets reached")
+	ErrBusy              = errors.New("set is in use by a kernel component")
+	ErrReferenced        = errors.New("set is referenced and cannot be renamed")
+	ErrTypeMismatch      = errors.New("set types do not match")
+	ErrElementExists     = errors.New("element is already added")
+	ErrElementNotFound   = errors.New("element is not added")
+	ErrInvalidCIDR       = errors.New("invalid CIDR value")
+	ErrInvalidNetmask    = errors.New("invalid netmask value")
+	ErrInvalidMarkmask   = errors.New("invalid markmask value")
+	ErrInvalidFamily     = errors.New("protocol family not supported by the set type")
+	ErrIPv4Expected      = errors.New("IPv4 address expected")
+	ErrIPv6Expected      = errors.New("IPv6 address expected")
+	ErrNoTimeout         = errors.New("set was created without timeout support")
+	ErrNoCounters        = errors.New("set was created without counter support")
+	ErrNoComment         = errors.New("set was created without comment support")
+	ErrNoSkbInfo         = errors.New("set was created without skbinfo support")
+	ErrHashFull          = errors.New("hash is full")
+	ErrHashElem          = errors.New("null-valued element cannot be stored in a hash")
+	ErrInvalidProto      = errors.New("invalid protocol")
+	ErrMissingProto      = errors.New("protocol missing")
+	ErrRangeUnsupported  = errors.New("range is not supported in the net component")
+	ErrInvalidRange      = errors.New("range covers the whole address space")
+	ErrOutOfRange        = errors.New("element is out of the range of the set")
+	ErrRangeTooLarge     = errors.New("range exceeds the size limit of the set type")
+	ErrMemberSetNotFound = errors.New("member set does not exist")
+	ErrListLoop          = errors.New("list:set sets cannot be members of a list")
+	ErrRefSetMissing     = errors.New("before requires a referenced set")
+	ErrListFull          = errors.New("list is full")
+	ErrRefSetNotFound    = errors.New("referenced set does not exist")
+	ErrRefSetNotMember   = errors.New("referenced set is not a member of the list")
+)
+
+// Error is returned by Conn methods if the kernel rejects a command,
+// and by Set methods if an entry or option fails validation.
+type Error struct {
+	// Cmd is the command that failed.
+	Cmd messageType
+	// Set is the name of the set the command was issued on, if any.
+	Set string
+	// Entry is the entry the command was issued with, if it
+	// can be attributed to a single entry.
+	Entry *Entry
+	// Line is the line number of the entry the kernel rejected in a batch,
+	// either taken from the entry or its position starting at 1.
+	// Entries preceding it in the batch have been applied.
+	Line uint32
+	// Applied is the number of entries of an add or del command applied
+	// before it failed: the entries of all batches sent before, and the
+	// entries preceding Entry in the rejected batch.
+	Applied int
+	// Errno is the raw error code returned by the kernel, or zero
+	// if the command was not sent.
+	Errno syscall.Errno
+	// Err is the sentinel error Errno resolves to, or Errno itself
+	// if it is not specific to ipset.
+	Err error
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString("ipset ")
+	b.WriteString(e.Cmd.String())
+	if e.Set != "" {
+		b.WriteByte(' ')
+		b.WriteString(e.Set)
+	}
+	if e.Line != 0 {
+		b.WriteString(": line ")
+		b.WriteString(strconv.Itoa(int(e.Line)))
+	}
+	b.WriteString(": ")
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the raw error code of e, so that
+// errors.Is(err, syscall.ENOENT) keeps working.
+func (e *Error) Is(target error) bool {
+	errno, ok := target.(syscall.Errno)
+	return ok && errno == e.Errno
+}
+
+type namedPolicy interface {
+	setName() string
+}
+
+type typedPolicy interface {
+	typeName() string
+}
+
+type entryPolicy interface {
+	entry() *Entry
+}
+
+type batchPolicy interface {
+	entryAt(lineNo uint32) *Entry
+}
+
+// newError wraps err into an *Error if it carries an errno returned by the kernel.
+// Type specific error codes are only resolved if m knows the type of the set,
+// see resolveError otherwise.
+func newError(t messageType, m attributesMarshaller, err error) error {
+	errno, ok := unwrapErrno(err)
+	if !ok {
+		return err
+	}
+
+	e := &Error{Cmd: t, Errno: errno}
+	if p, ok := m.(namedPolicy); ok {
+		e.Set = p.setName()
+	}
+	if p, ok := m.(entryPolicy); ok {
+		e.Entry = p.entry()
+	}
+	if e.Line = errorLineNo(err); e.Line != 0 {
+		if p, ok := m.(batchPolicy); ok {
+			e.Entry = p.entryAt(e.Line)
+		}
+	}
+
+	var typeName string
+	if p, ok := m.(typedPolicy); ok {
+		typeName = p.typeName()
+	}
+
+	e.Err = lookupError(t, errno, typeName)
+	return e
+}
+
+// resolveError resolves the type specific error code of an *Error returned
+// for a command on a set of unknown type. The codes overlap between the set
+// types, so the type is requested from the kernel with Header, which costs
+// a second round trip. Other errors are returned as they are.
+func (c *Conn) resolveError(ctx context.Context, err error) error {
+	var e *Error
+	if !errors.As(err, &e) || e.Errno < errTypeSpecific || e.Set == "" {
+		return err
+	}
+	if h, herr := c.HeaderContext(ctx, e.Set); herr == nil {
+		e.Err = lookupError(e.Cmd, e.Errno, h.TypeName.Get())
+	}
+	return err
+}
+
+// lookupError resolves an errno to a sentinel error. Some error codes
+// depend on the command or the type of the set they were returned for.
+func lookupError(t messageType, errno syscall.Errno, typeName string) error {
+	switch errno {
+	case syscall.ENOENT:
+		return ErrSetNotFound
+	case syscall.EEXIST:
+		if t == CmdType {
+			return ErrTypeNotFound
+		}
+		return ErrSetExists
+	case errProtocol:
+		return ErrProtocol
+	case errFindType:
+		return ErrTypeNotFound
+	case errMaxSets:
+		return ErrMaxSets
+	case errBusy:
+		return ErrBusy
+	case errExistSetName2:
+		if t == CmdSwap {
+			return ErrSetNotFound
+		}
+		return ErrSetExists
+	case errTypeMismatch:
+		return ErrTypeMismatch
+	case errExist:
+		if t == CmdAdd {
+			return ErrElementExists
+		}
+		return ErrElementNotFound
+	case errInvalidCidr:
+		return ErrInvalidCIDR
+	case errInvalidNetmask:
+		return ErrInvalidNetmask
+	case errInvalidFamily:
+		return ErrInvalidFamily
+	case errTimeout:
+		return ErrNoTimeout
+	case errReferenced:
+		return ErrReferenced
+	case errIPAddrIPv4:
+		return ErrIPv4Expected
+	case errIPAddrIPv6:
+		return ErrIPv6Expected
+	case errCounter:
+		return ErrNoCounters
+	case errComment:
+		return ErrNoComment
+	case errInvalidMarkmask:
+		return ErrInvalidMarkmask
+	case errSkbInfo:
+		return ErrNoSkbInfo
+	}
+
+	switch {
+	case strings.HasPrefix(typeName, "hash:"):
+		switch errno {
+		case errHashFull:
+			return ErrHashFull
+		case errHashElem:
+			return ErrHashElem
+		case errInvalidProto:
+			return ErrInvalidProto
+		case errMissingProto:
+			return ErrMissingProto
+		case errHashRangeUnsupported:
+			return ErrRangeUnsupported
+		case errHashRange:
+			return ErrInvalidRange
+		}
+	case strings.HasPrefix(typeName, "bitmap:"):
+		switch errno {
+		case errBitmapRange:
+			return ErrOutOfRange
+		case errBitmapRangeSize:
+			return ErrRangeTooLarge
+		}
+	case strings.HasPrefix(typeName, "list:"):
+		switch errno {
+		case errListName:
+			return ErrMemberSetNotFound
+		case errListLoop:
+			return ErrListLoop
+		case errListBefore:
+			return ErrRefSetMissing
+		case errListNameRef:
+			return ErrRefSetNotFound
+		case errListFull:
+			return ErrListFull
+		case errListRefExist:
+			return ErrRefSetNotMember
+		}
+	}
+
+	if errno >= errPrivate {
+		return fmt.Errorf("unknown ipset error code %d", int(errno))
+	}
+	return errno
+}
+
+// unwrap returns the error wrapped by err, understanding the
+// wrappers used by the netfilter and netlink packages.
+func unwrap(err error) error {
+	switch e := err.(type) {
+	case *netlink.OpError:
+		return e.Err
+	case interface{ Cause() error }:
+		return e.Cause()
+	}
+	return errors.Unwrap(err)
+}
+
+// unwrapErrno digs the errno out of the error chain returned by
+// the netfilter and netlink packages.
+func unwrapErrno(err error) (syscall.Errno, bool) {
+	for ; err != nil; err = unwrap(err) {
+		if errno, ok := err.(syscall.Errno); ok {
+			return errno, true
+		}
+	}
+	return 0, false
+}
+
+// errorLineNo returns the line number of the entry rejected by the kernel, if any.
+func errorLineNo(err error) uint32 {
+	for ; err != nil; err = unwrap(err) {
+		if m, ok := err.(*errorMessage); ok {
+			return m.lineNo()
+		}
+	}
+	return 0
+}
@@ -0,0 +1,154 @@
+// Package exporter exports the sets of the kernel as Prometheus metrics.
+//
+// A Collector reads the headers of all sets on every scrape and reports
+// the number of entries, the memory size and the references of each set.
+// Only the sets with counters are listed in full, to report the packet
+// and byte counters of their entries:
+//
+//	c, err := ipset.Dial(netfilter.ProtoUnspec, nil)
+//	if err != nil {
+//		return err
+//	}
+//	prometheus.MustRegister(exporter.New(c))
+//
+// Only this package imports the Prometheus client, so programs not using
+// it do not link it. The module still requires it, so it is downloaded
+// along with the other dependencies of the module.
+package exporter
+
+import (
+	"sync"
+
+	ipset "github.com/digineo/go-ipset/v2"
+	"github.com/digineo/go-ipset/v2/restore"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "ipset"
+
+var (
+	setLabels   = []string{"set", "type"}
+	entryLabels = []string{"set", "type", "entry"}
+
+	upDesc = prometheus.NewDesc(namespace+"_up",
+		"Whether listing the sets succeeded.", nil, nil)
+	entriesDesc = prometheus.NewDesc(namespace+"_entries",
+		"Number of entries of the set.", setLabels, nil)
+	memoryDesc = prometheus.NewDesc(namespace+"_memory_bytes",
+		"Memory used by the set.", setLabels, nil)
+	referencesDesc = prometheus.NewDesc(namespace+"_references",
+		"Number of references to the set, e.g. by iptables rules.", setLabels, nil)
+	packetsDesc = prometheus.NewDesc(namespace+"_entry_packets_total",
+		"Packets counted by the entry.", entryLabels, nil)
+	bytesDesc = prometheus.NewDesc(namespace+"_entry_bytes_total",
+		"Bytes counted by the entry.", entryLabels, nil)
+)
+
+type options struct {
+	entries func(set string) bool
+}
+
+// Option configures a Collector.
+type Option func(o *options)
+
+// Entries limits the counters of entries to the sets for which fn returns
+// true, e.g. to leave out large sets. By default the counters of the
+// entries of all sets with counters are exported.
+func Entries(fn func(set string) bool) Option {
+	return func(o *options) { o.entries = fn }
+}
+
+// Collector is a prometheus.Collector exporting the sets of a Conn.
+type Collector struct {
+	options options
+
+	mu sync.Mutex
+	c  *ipset.Conn
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// New returns a Collector listing the sets using c. Scrapes do not use c
+// concurrently, but c must not be used by anyone else meanwhile.
+func New(c *ipset.Conn, opts ...Option) *Collector {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Collector{options: o, c: c}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- upDesc
+	ch <- entriesDesc
+	ch <- memoryDesc
+	ch <- referencesDesc
+	ch <- packetsDesc
+	ch <- bytesDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	headers, err := c.c.Headers()
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, 1)
+
+	for i := range headers {
+		h := &headers[i]
+		collectHeader(ch, h)
+		if !c.listEntries(h) {
+			continue
+		}
+		s, err := c.c.List(h.Name.Get())
+		if err != nil {
+			// The set may be gone since its header was read.
+			continue
+		}
+		collectEntries(ch, s)
+	}
+}
+
+// listEntries reports whether the entries of the set h are exported.
+func (c *Collector) listEntries(h *ipset.HeaderPolicy) bool {
+	if h.Data == nil || ipset.CadtFlags(h.Data.CadtFlags.Get())&ipset.WithCounters == 0 {
+		return false
+	}
+	return c.options.entries == nil || c.options.entries(h.Name.Get())
+}
+
+func collectHeader(ch chan<- prometheus.Metric, h *ipset.HeaderPolicy) {
+	name, typeName := h.Name.Get(), h.TypeName.Get()
+
+	gauge := func(desc *prometheus.Desc, v *ipset.UInt32Box) {
+		if v.IsSet() {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(v.Get()), name, typeName)
+		}
+	}
+	gauge(entriesDesc, h.Elements)
+	gauge(memoryDesc, h.MemSize)
+	gauge(referencesDesc, h.References)
+}
+
+func collectEntries(ch chan<- prometheus.Metric, s *ipset.SetPolicy) {
+	name, typeName := s.Name.Get(), s.TypeName.Get()
+	for _, e := range s.Entries {
+		counters, ok := e.Counters()
+		if !ok {
+			continue
+		}
+		elem, err := restore.FormatElement(typeName, e)
+		if err != nil {
+			// The type is not known to restore, so neither are its entries.
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(packetsDesc, prometheus.CounterValue, float64(counters.Packets), name, typeName, elem)
+		ch <- prometheus.MustNewConstMetric(bytesDesc, prometheus.CounterValue, float64(counters.Bytes), name, typeName, elem)
+	}
+}
@@ -0,0 +1,122 @@
+package exporter
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	ipset "github.com/digineo/go-ipset/v2"
+	"github.com/mdlayher/netlink"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+func newConn(t *testing.T) *ipset.Conn {
+	c := &ipset.Conn{Family: netfilter.ProtoIPv4, Conn: ipset.NewFakeKernel()}
+
+	err := c.Create("counted", "hash:net,port", 8, netfilter.ProtoIPv4, ipset.CreateDataCounters())
+	if err == nil {
+		err = c.Add("counted",
+			ipset.NewEntry(ipset.EntryIP(net.ParseIP("10.0.0.0")), ipset.EntryCidr(24),
+				ipset.EntryProto(6), ipset.EntryPort(80), ipset.EntryCounters(ipset.Counters{Packets: 3, Bytes: 120})),
+			ipset.NewEntry(ipset.EntryIP(net.ParseIP("10.0.1.1")),
+				ipset.EntryProto(17), ipset.EntryPort(53)),
+		)
+	}
+	if err == nil {
+		err = c.Create("plain", "hash:ip", 6, netfilter.ProtoIPv4)
+	}
+	if err == nil {
+		err = c.Add("plain", ipset.NewEntry(ipset.EntryIP(net.ParseIP("10.0.0.1"))))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+const setMetrics = `
+# HELP ipset_entries Number of entries of the set.
+# TYPE ipset_entries gauge
+ipset_entries{set="counted",type="hash:net,port"} 2
+ipset_entries{set="plain",type="hash:ip"} 1
+# HELP ipset_memory_bytes Memory used by the set.
+# TYPE ipset_memory_bytes gauge
+ipset_memory_bytes{set="counted",type="hash:net,port"} 344
+ipset_memory_bytes{set="plain",type="hash:ip"} 280
+# HELP ipset_references Number of references to the set, e.g. by iptables rules.
+# TYPE ipset_references gauge
+ipset_references{set="counted",type="hash:net,port"} 0
+ipset_references{set="plain",type="hash:ip"} 0
+# HELP ipset_up Whether listing the sets succeeded.
+# TYPE ipset_up gauge
+ipset_up 1
+`
+
+const entryMetrics = `
+# HELP ipset_entry_bytes_total Bytes counted by the entry.
+# TYPE ipset_entry_bytes_total counter
+ipset_entry_bytes_total{entry="10.0.0.0/24,tcp:80",set="counted",type="hash:net,port"} 120
+ipset_entry_bytes_total{entry="10.0.1.1,udp:53",set="counted",type="hash:net,port"} 0
+# HELP ipset_entry_packets_total Packets counted by the entry.
+# TYPE ipset_entry_packets_total counter
+ipset_entry_packets_total{entry="10.0.0.0/24,tcp:80",set="counted",type="hash:net,port"} 3
+ipset_entry_packets_total{entry="10.0.1.1,udp:53",set="counted",type="hash:net,port"} 0
+`
+
+func TestCollector(t *testing.T) {
+	assert2 := assert.New(t)
+	c := newConn(t)
+
+	assert2.NoError(testutil.CollectAndCompare(New(c), strings.NewReader(setMetrics+entryMetrics)))
+
+	// Entries are left out for the sets not selected.
+	collector := New(c, Entries(func(set string) bool { return set != "counted" }))
+	assert2.NoError(testutil.CollectAndCompare(collector, strings.NewReader(setMetrics)))
+}
+
+// countingConn counts the queries sent to the kernel.
+type countingConn struct {
+	*ipset.FakeKernel
+	queries int
+}
+
+func (c *countingConn) Query(m netlink.Message) ([]netlink.Message, error) {
+	c.queries++
+	return c.FakeKernel.Query(m)
+}
+
+func TestCollector_ListsCountedSets(t *testing.T) {
+	assert2 := assert.New(t)
+	c := newConn(t)
+	k := &countingConn{FakeKernel: c.Conn.(*ipset.FakeKernel)}
+	c.Conn = k
+
+	// The headers of all sets, then the entries of the counted set.
+	assert2.Equal(11, testutil.CollectAndCount(New(c)))
+	assert2.Equal(2, k.queries)
+
+	k.queries = 0
+	assert2.Equal(7, testutil.CollectAndCount(New(c, Entries(func(string) bool { return false }))))
+	assert2.Equal(1, k.queries)
+}
+
+type brokenConn struct{}
+
+func (brokenConn) Close() error { return nil }
+func (brokenConn) Query(netlink.Message) ([]netlink.Message, error) {
+	return nil, errors.New("broken socket")
+}
+
+func TestCollector_Error(t *testing.T) {
+	assert2 := assert.New(t)
+	c := &ipset.Conn{Family: netfilter.ProtoIPv4, Conn: brokenConn{}}
+
+	assert2.NoError(testutil.CollectAndCompare(New(c), strings.NewReader(`
+# HELP ipset_up Whether listing the sets succeeded.
+# TYPE ipset_up gauge
+ipset_up 0
+`)))
+}
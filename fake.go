@@ -0,0 +1,1331 @@
+package ipset
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/netfilter"
+)
+
+// FakeKernel emulates the ipset subsystem of the kernel in memory. A Conn
+// using it as connector behaves like a Conn dialed to the kernel, which
+// allows testing code using Conn without root privileges or a kernel:
+//
+//	c := &ipset.Conn{Family: netfilter.ProtoIPv4, Conn: ipset.NewFakeKernel()}
+//
+// All set types are supported, including the timeout, counters, comment
+// and skbinfo extensions. Ranges of IPv4 addresses and of ports are expanded
+// into single elements, or into networks for the net types. Testing an
+// address against networks finds the most specific one containing it, which
+// reports the address missing if flagged nomatch. Bitmap sets reject
+// elements outside of their range. Members of list:set sets reference their
+// set like in the kernel, so it cannot be destroyed or renamed.
+//
+// A FakeKernel is safe for concurrent use and may be shared by several Conns.
+type FakeKernel struct {
+	// Now returns the current time, which expires entries with a timeout.
+	// If nil, time.Now is used.
+	Now func() time.Time
+
+	mu   sync.Mutex
+	sets []*fakeSet
+	seq  uint64
+}
+
+// NewFakeKernel returns a FakeKernel without any sets.
+func NewFakeKernel() *FakeKernel {
+	return &FakeKernel{}
+}
+
+// Close implements the connector interface. The sets are kept.
+func (k *FakeKernel) Close() error {
+	return nil
+}
+
+// findFakeType returns the set type name if it is emulated.
+func findFakeType(name string) *SetType {
+	return LookupSetType(name)
+}
+
+type fakeSet struct {
+	name     string
+	typ      *SetType
+	revision uint8
+	family   netfilter.ProtoFamily
+	data     CreateData
+	entries  map[string]*fakeEntry
+}
+
+type fakeEntry struct {
+	*Entry
+
+	seq     uint64
+	expires time.Time
+}
+
+// fakeError is returned for errors the kernel reports with an error message.
+func fakeError(errno syscall.Errno) error {
+	return &netlink.OpError{Op: "receive", Err: errno}
+}
+
+// Query implements the connector interface by executing the request
+// on the emulated sets.
+func (k *FakeKernel) Query(nlm netlink.Message) ([]netlink.Message, error) {
+	h, attrs, err := netfilter.UnmarshalNetlink(nlm)
+	if err != nil {
+		return nil, err
+	}
+	if h.SubsystemID != netfilter.NFSubsysIPSet {
+		return nil, fakeError(syscall.EINVAL)
+	}
+
+	var base BasePolicy
+	unmarshalAttributes(attrs, &base)
+	if base.Protocol.Get() != Protocol {
+		return nil, fakeError(errProtocol)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	excl := nlm.Header.Flags&netlink.Excl != 0
+	t := messageType(h.MessageType)
+
+	switch t {
+	case CmdProtocol:
+		a := newBasePolicy().marshalAttributes()
+		a.append(AttrProtocolMin, NewUInt8Box(Protocol))
+		return k.reply(h, 0, a)
+
+	case CmdType:
+		var p TypePolicy
+		unmarshalAttributes(attrs, &p)
+		return k.typ(h, &p)
+
+	case CmdCreate:
+		var p CreatePolicy
+		unmarshalAttributes(attrs, &p)
+		return nil, k.create(&p, excl)
+
+	case CmdDestroy, CmdFlush:
+		var p NamePolicy
+		unmarshalAttributes(attrs, &p)
+		return nil, k.destroyOrFlush(t, &p, excl)
+
+	case CmdRename, CmdSwap:
+		var p MovePolicy
+		unmarshalAttributes(attrs, &p)
+		return nil, k.move(t, &p)
+
+	case CmdList, CmdSave:
+		var p listPolicy
+		unmarshalAttributes(attrs, &p)
+		return k.list(h, &p)
+
+	case CmdHeader:
+		var p NamePolicy
+		unmarshalAttributes(attrs, &p)
+		s := k.find(p.setName())
+		if s == nil {
+			return nil, fakeError(syscall.ENOENT)
+		}
+		return k.reply(h, 0, s.header().marshalAttributes())
+
+	case CmdAdd, CmdDel:
+		var p EntryAddDelPolicy
+		unmarshalAttributes(attrs, &p)
+		return nil, k.addDel(nlm, t, &p, excl)
+
+	case CmdTest:
+		var p TestPolicy
+		unmarshalAttributes(attrs, &p)
+		s := k.find(p.setName())
+		if s == nil {
+			return nil, fakeError(syscall.ENOENT)
+		}
+		if p.Entry == nil {
+			return nil, fakeError(errProtocol)
+		}
+		if errno := k.test(s, p.Entry); errno != 0 {
+			return nil, fakeError(errno)
+		}
+		return nil, nil
+	}
+
+	return nil, fakeError(syscall.EOPNOTSUPP)
+}
+
+func (k *FakeKernel) reply(h netfilter.Header, flags netlink.HeaderFlags, attrs Attributes) ([]netlink.Message, error) {
+	nlm, err := netfilter.MarshalNetlink(netfilter.Header{
+		Family:      h.Family,
+		SubsystemID: netfilter.NFSubsysIPSet,
+		MessageType: h.MessageType,
+		Flags:       flags,
+	}, attrs)
+	if err != nil {
+		return nil, err
+	}
+	return []netlink.Message{nlm}, nil
+}
+
+func (k *FakeKernel) now() time.Time {
+	if k.Now != nil {
+		return k.Now()
+	}
+	return time.Now()
+}
+
+func (k *FakeKernel) find(name string) *fakeSet {
+	for _, s := range k.sets {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (k *FakeKernel) typ(h netfilter.Header, p *TypePolicy) ([]netlink.Message, error) {
+	if !p.TypeName.IsSet() || !p.Family.IsSet() {
+		return nil, fakeError(errProtocol)
+	}
+	t := findFakeType(p.TypeName.Get())
+	if t == nil {
+		return nil, fakeError(syscall.EEXIST)
+	}
+
+	attrs := newTypePolicy(t.Name, netfilter.ProtoFamily(p.Family.Get())).marshalAttributes()
+	attrs.append(AttrRevision, NewUInt8Box(t.Revision))
+	attrs.append(AttrRevisionMin, NewUInt8Box(0))
+	return k.reply(h, 0, attrs)
+}
+
+func (k *FakeKernel) create(p *CreatePolicy, excl bool) error {
+	if !p.Name.IsSet() || !p.TypeName.IsSet() || !p.Revision.IsSet() || !p.Family.IsSet() {
+		return fakeError(errProtocol)
+	}
+	if len(p.Name.Get()) > maxNameLen {
+		return fakeError(errProtocol)
+	}
+
+	t := findFakeType(p.TypeName.Get())
+	if t == nil || p.Revision.Get() > t.Revision {
+		return fakeError(errFindType)
+	}
+
+	s := &fakeSet{
+		name:     p.Name.Get(),
+		typ:      t,
+		revision: p.Revision.Get(),
+		family:   netfilter.ProtoFamily(p.Family.Get()),
+		entries:  make(map[string]*fakeEntry),
+	}
+	switch {
+	case t.bitmap() && t.has("ip") && s.family != netfilter.ProtoIPv4:
+		// Like the kernel, which registers bitmap:ip for IPv4 only.
+		return fakeError(errFindType)
+	case t.bitmap() && t.has("port"), t.list() && s.family == netfilter.ProtoUnspec:
+		// bitmap:port is registered for any family and reports none.
+		if t.bitmap() {
+			s.family = netfilter.ProtoUnspec
+		}
+	case s.family == netfilter.ProtoIPv4, s.family == netfilter.ProtoIPv6:
+	default:
+		return fakeError(errInvalidFamily)
+	}
+	if p.Data != nil {
+		s.data = *p.Data
+	}
+	if errno := s.setDefaults(); errno != 0 {
+		return fakeError(errno)
+	}
+
+	if existing := k.find(s.name); existing != nil {
+		// Without NLM_F_EXCL, creating an identical set succeeds.
+		if !excl && existing.sameAs(s) {
+			return nil
+		}
+		return fakeError(syscall.EEXIST)
+	}
+
+	k.sets = append(k.sets, s)
+	return nil
+}
+
+// setDefaults validates the create options and fills in the defaults
+// reported by the kernel.
+func (s *fakeSet) setDefaults() syscall.Errno {
+	d := &s.data
+	if s.typ.list() {
+		// The size is only reported, like by the kernel,
+		// which does not limit the number of members.
+		switch {
+		case !d.Size.IsSet():
+			d.Size = NewUInt32Box(fakeListSize)
+		case d.Size.Get() < fakeListMinSize:
+			d.Size = NewUInt32Box(fakeListMinSize)
+		}
+		return 0
+	}
+	if d.NetMask.IsSet() {
+		if s.revision < s.typ.revs.netmask {
+			return errProtocol
+		}
+		if n := d.NetMask.Get(); n == 0 || int(n) > s.bits() {
+			return errInvalidNetmask
+		}
+	}
+	if s.typ.bitmap() {
+		return s.setRange()
+	}
+	if !d.HashSize.IsSet() {
+		d.HashSize = NewUInt32Box(1024)
+	}
+	if !d.MaxElem.IsSet() {
+		d.MaxElem = NewUInt32Box(65536)
+	}
+	if s.typ.Name == "hash:ip,mark" {
+		if !d.MarkMask.IsSet() {
+			d.MarkMask = NewUInt32Box(0xffffffff)
+		} else if d.MarkMask.Get() == 0 {
+			return errInvalidMarkmask
+		}
+	}
+	return 0
+}
+
+func (s *fakeSet) bits() int {
+	if s.family == netfilter.ProtoIPv4 {
+		return net.IPv4len * 8
+	}
+	return net.IPv6len * 8
+}
+
+func (s *fakeSet) flag(f CadtFlags) bool {
+	return CadtFlags(s.data.CadtFlags.Get())&f != 0
+}
+
+func (s *fakeSet) sameAs(o *fakeSet) bool {
+	return s.typ == o.typ && s.family == o.family && s.revision == o.revision &&
+		s.data.HashSize.Get() == o.data.HashSize.Get() &&
+		s.data.MaxElem.Get() == o.data.MaxElem.Get() &&
+		s.data.Size.Get() == o.data.Size.Get() &&
+		s.data.IP.Get().Equal(o.data.IP.Get()) && s.data.IPTo.Get().Equal(o.data.IPTo.Get()) &&
+		s.data.Port.Get() == o.data.Port.Get() && s.data.PortTo.Get() == o.data.PortTo.Get() &&
+		s.data.Timeout.Get() == o.data.Timeout.Get() &&
+		s.data.CadtFlags.Get() == o.data.CadtFlags.Get()
+}
+
+func (s *fakeSet) header() HeaderPolicy {
+	return newHeaderPolicy(newNamePolicy(s.name), s.typ.Name, s.revision, s.family)
+}
+
+func (k *FakeKernel) destroyOrFlush(t messageType, p *NamePolicy, excl bool) error {
+	if !p.Name.IsSet() {
+		if t == CmdDestroy {
+			for _, s := range k.sets {
+				if k.references(s.name) > 0 {
+					return fakeError(errBusy)
+				}
+			}
+			k.sets = nil
+		} else {
+			for _, s := range k.sets {
+				s.entries = make(map[string]*fakeEntry)
+			}
+		}
+		return nil
+	}
+
+	for i, s := range k.sets {
+		if s.name != p.Name.Get() {
+			continue
+		}
+		if t == CmdDestroy {
+			if k.references(s.name) > 0 {
+				return fakeError(errBusy)
+			}
+			k.sets = append(k.sets[:i], k.sets[i+1:]...)
+		} else {
+			s.entries = make(map[string]*fakeEntry)
+		}
+		return nil
+	}
+
+	// Like adding existing entries, destroying a missing set is only an
+	// error with NLM_F_EXCL.
+	if t == CmdDestroy && !excl {
+		return nil
+	}
+	return fakeError(syscall.ENOENT)
+}
+
+func (k *FakeKernel) move(t messageType, p *MovePolicy) error {
+	from, to := k.find(p.setName()), k.find(p.To.Get())
+	if from == nil {
+		return fakeError(syscall.ENOENT)
+	}
+
+	if t == CmdRename {
+		if to != nil {
+			return fakeError(errExistSetName2)
+		}
+		if len(p.To.Get()) > maxNameLen {
+			return fakeError(errProtocol)
+		}
+		if k.references(from.name) > 0 {
+			return fakeError(errReferenced)
+		}
+		from.name = p.To.Get()
+		return nil
+	}
+
+	if to == nil {
+		return fakeError(errExistSetName2)
+	}
+	if from.typ != to.typ || from.family != to.family {
+		return fakeError(errTypeMismatch)
+	}
+	// Swapping exchanges the contents, the names stay in place.
+	*from, *to = *to, *from
+	from.name, to.name = to.name, from.name
+	return nil
+}
+
+// fakeListBatch is the number of entries per message of a list dump.
+const fakeListBatch = 1000
+
+// Memory sizes reported for sets, similar to those of a hash:ip set.
+const (
+	fakeSetSize   = 216
+	fakeEntrySize = 64
+)
+
+// headerData returns the nested data of a listed set, holding its
+// create options as well as its size and references.
+func (k *FakeKernel) headerData(s *fakeSet, entries int) netfilter.Attribute {
+	nfa := s.data.marshal(AttrData)
+	attrs := Attributes(nfa.Children)
+	attrs.append(AttrElements, NewUInt32Box(uint32(entries)))
+	attrs.append(AttrReferences, NewUInt32Box(uint32(k.references(s.name))))
+	attrs.append(AttrMemSize, NewUInt32Box(uint32(fakeSetSize+entries*fakeEntrySize)))
+	nfa.Children = attrs
+	return nfa
+}
+
+func (k *FakeKernel) list(h netfilter.Header, p *listPolicy) ([]netlink.Message, error) {
+	sets := k.sets
+	if p.Name.IsSet() {
+		s := k.find(p.Name.Get())
+		if s == nil {
+			return nil, fakeError(syscall.ENOENT)
+		}
+		sets = []*fakeSet{s}
+	}
+	headerOnly := CmdFlags(p.Flags.Get())&FlagListHeader != 0
+
+	var res []netlink.Message
+	for _, s := range sets {
+		entries := k.listEntries(s)
+		attrs := s.header().marshalAttributes()
+		attrs = append(attrs, k.headerData(s, len(entries)))
+
+		if headerOnly {
+			entries = nil
+		}
+		for {
+			n := len(entries)
+			if n > fakeListBatch {
+				n = fakeListBatch
+			}
+			if n > 0 {
+				attrs.append(AttrADT, entries[:n])
+			}
+
+			nlm, err := k.reply(h, netlink.Multi, attrs)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, nlm...)
+
+			entries = entries[n:]
+			if len(entries) == 0 {
+				break
+			}
+			// Continuation messages only carry the set name.
+			attrs = newNamePolicy(s.name).marshalAttributes()
+		}
+	}
+	return res, nil
+}
+
+// sorted returns the entries of s in the order they were added,
+// or for list:set in the order of the list.
+func (s *fakeSet) sorted() []*fakeEntry {
+	list := make([]*fakeEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].seq < list[j].seq })
+	return list
+}
+
+// listEntries returns the entries of s as listed by the kernel.
+func (k *FakeKernel) listEntries(s *fakeSet) Entries {
+	k.expire(s)
+	list := s.sorted()
+
+	now := k.now()
+	entries := make(Entries, len(list))
+	for i, fe := range list {
+		e := *fe.Entry
+		if s.data.Timeout.IsSet() {
+			// Like the kernel, report at least a second for entries
+			// about to expire, as zero denotes permanent entries.
+			var remaining time.Duration
+			if !fe.expires.IsZero() {
+				remaining = fe.expires.Sub(now).Truncate(time.Second)
+				if remaining < time.Second {
+					remaining = time.Second
+				}
+			}
+			e.Timeout = NewUInt32SecondsDurationBox(remaining)
+		}
+		if s.flag(WithCounters) {
+			e.Packets = NewUInt64Box(e.Packets.Get())
+			e.Bytes = NewUInt64Box(e.Bytes.Get())
+		}
+		entries[i] = &e
+	}
+	return entries
+}
+
+// expire removes the entries of s whose timeout has passed.
+func (k *FakeKernel) expire(s *fakeSet) {
+	now := k.now()
+	for key, e := range s.entries {
+		if !e.expires.IsZero() && !now.Before(e.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+func (k *FakeKernel) addDel(nlm netlink.Message, t messageType, p *EntryAddDelPolicy, excl bool) error {
+	s := k.find(p.setName())
+	if s == nil {
+		return fakeError(syscall.ENOENT)
+	}
+	k.expire(s)
+
+	for _, e := range p.Entries {
+		var errno syscall.Errno
+		if t == CmdAdd {
+			errno = k.add(s, e, excl)
+		} else {
+			errno = k.del(s, e, excl)
+		}
+		if errno == 0 {
+			continue
+		}
+
+		// The kernel reports the line number of the rejected entry
+		// in the echoed request, as long as the request carries one.
+		if p.LineNo.IsSet() && e.Lineno.IsSet() && e.Lineno.Get() != 0 {
+			if request, err := echoLineNo(nlm, e.Lineno.Get()); err == nil {
+				return &netlink.OpError{Op: "receive", Err: &errorMessage{errno: errno, request: request}}
+			}
+		}
+		return fakeError(errno)
+	}
+	return nil
+}
+
+// echoLineNo returns the request nlm with its line number replaced by lineNo.
+func echoLineNo(nlm netlink.Message, lineNo uint32) ([]byte, error) {
+	data := make([]byte, len(nlm.Data))
+	copy(data, nlm.Data)
+
+	// Skip the netfilter header, then find the line number attribute.
+	for i := 4; i+syscall.NLA_HDRLEN <= len(data); {
+		l := int(binary.LittleEndian.Uint16(data[i:]))
+		typ := binary.LittleEndian.Uint16(data[i+2:]) &^ (syscall.NLA_F_NESTED | syscall.NLA_F_NET_BYTEORDER)
+		if l < syscall.NLA_HDRLEN {
+			break
+		}
+		if AttributeType(typ) == AttrLineNo && l == syscall.NLA_HDRLEN+4 {
+			binary.BigEndian.PutUint32(data[i+syscall.NLA_HDRLEN:], lineNo)
+		}
+		i += nlaAlign(l)
+	}
+
+	echo := netlink.Message{Header: nlm.Header, Data: data}
+	echo.Header.Length = uint32(syscall.NLMSG_HDRLEN + len(data))
+	return echo.MarshalBinary()
+}
+
+func (k *FakeKernel) add(s *fakeSet, e *Entry, excl bool) syscall.Errno {
+	if s.typ.list() {
+		return k.addMember(s, e, excl)
+	}
+	if errno := s.checkExtensions(e); errno != 0 {
+		return errno
+	}
+	elems, errno := s.elements(e)
+	if errno != 0 {
+		return errno
+	}
+
+	for _, elem := range elems {
+		key := s.key(elem)
+		old, ok := s.entries[key]
+		if ok {
+			if excl {
+				return errExist
+			}
+		} else if !s.typ.bitmap() && len(s.entries) >= int(s.data.MaxElem.Get()) {
+			if !s.flag(WithForceDdd) {
+				return errHashFull
+			}
+			for victim := range s.entries {
+				delete(s.entries, victim)
+				break
+			}
+		}
+
+		fe := k.newEntry(s, elem, e, old)
+		if s.typ.bitmap() {
+			// Bitmaps are listed in the order of their elements.
+			fe.seq = uint64(bitmapOffset(elem))
+		}
+		s.entries[key] = fe
+	}
+	return 0
+}
+
+// newEntry returns the entry storing elem with the extensions of e. If the
+// element is already in the set as old, it is updated in place.
+func (k *FakeKernel) newEntry(s *fakeSet, elem, e *Entry, old *fakeEntry) *fakeEntry {
+	fe := &fakeEntry{Entry: s.extensions(elem, e)}
+	if old != nil {
+		// Like the kernel, keep the counters not given anew.
+		fe.seq = old.seq
+		if s.flag(WithCounters) && !e.Packets.IsSet() {
+			fe.Packets = old.Packets
+		}
+		if s.flag(WithCounters) && !e.Bytes.IsSet() {
+			fe.Bytes = old.Bytes
+		}
+	} else {
+		k.seq++
+		fe.seq = k.seq
+	}
+
+	timeout := s.data.Timeout.Get()
+	if e.Timeout.IsSet() {
+		timeout = e.Timeout.Get()
+	}
+	if timeout > 0 {
+		fe.expires = k.now().Add(timeout)
+	}
+	return fe
+}
+
+func (k *FakeKernel) del(s *fakeSet, e *Entry, excl bool) syscall.Errno {
+	if s.typ.list() {
+		return k.delMember(s, e, excl)
+	}
+	elems, errno := s.elements(e)
+	if errno != 0 {
+		return errno
+	}
+
+	for _, elem := range elems {
+		key := s.key(elem)
+		if _, ok := s.entries[key]; !ok {
+			if excl {
+				return errExist
+			}
+			continue
+		}
+		delete(s.entries, key)
+	}
+	return 0
+}
+
+func (k *FakeKernel) test(s *fakeSet, e *Entry) syscall.Errno {
+	k.expire(s)
+	if s.typ.list() {
+		return k.testMember(s, e)
+	}
+
+	elems, errno := s.elements(e)
+	if errno != 0 {
+		if s.typ.bitmap() {
+			// Like for list:set members, the kernel reports
+			// elements out of range as missing.
+			return errExist
+		}
+		return errno
+	}
+	for _, elem := range elems {
+		fe, ok := s.entries[s.key(elem)]
+		if s.typ.hash() && s.typ.has("net") {
+			fe = s.lookupNet(elem)
+			ok = fe != nil
+		}
+		if !ok || CadtFlags(fe.CadtFlags.Get())&NoMatch != 0 {
+			return errExist
+		}
+		if elem.Ether.IsSet() && fe.Ether.IsSet() && elem.Ether.Get().String() != fe.Ether.Get().String() {
+			return errExist
+		}
+	}
+	return 0
+}
+
+// lookupNet finds the element of a set of networks matching elem like the
+// kernel does. Networks of elem with the full prefix length are masked with
+// the prefix lengths stored in s, from the most to the least specific one,
+// and the first element found decides.
+func (s *fakeSet) lookupNet(elem *Entry) *fakeEntry {
+	cidrs := func(cidr *UInt8Box, stored func(*fakeEntry) *UInt8Box) []int {
+		if !cidr.IsSet() || int(cidr.Get()) != s.bits() {
+			return []int{int(cidr.Get())}
+		}
+		seen := make(map[int]bool)
+		var res []int
+		for _, fe := range s.entries {
+			if c := int(stored(fe).Get()); !seen[c] {
+				seen[c] = true
+				res = append(res, c)
+			}
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(res)))
+		return res
+	}
+
+	first := cidrs(elem.Cidr, func(fe *fakeEntry) *UInt8Box { return fe.Cidr })
+	second := cidrs(elem.Cidr2, func(fe *fakeEntry) *UInt8Box { return fe.Cidr2 })
+	for _, c := range first {
+		for _, c2 := range second {
+			r := *elem
+			if r.Cidr.IsSet() {
+				r.IP = NewIPAddrBox(r.IP.Get().Mask(net.CIDRMask(c, s.bits())))
+				r.Cidr = NewUInt8Box(uint8(c))
+			}
+			if r.Cidr2.IsSet() {
+				r.IP2 = NewIPAddrBox(r.IP2.Get().Mask(net.CIDRMask(c2, s.bits())))
+				r.Cidr2 = NewUInt8Box(uint8(c2))
+			}
+			if fe, ok := s.entries[s.key(&r)]; ok {
+				return fe
+			}
+		}
+	}
+	return nil
+}
+
+// checkExtensions rejects entries using extensions the set was not created
+// with, and comments failing the attribute policy of the kernel.
+func (s *fakeSet) checkExtensions(e *Entry) syscall.Errno {
+	switch {
+	case len(e.Comment.Get()) > MaxCommentSize:
+		return errProtocol
+	case e.Timeout.IsSet() && !s.data.Timeout.IsSet():
+		return errTimeout
+	case (e.Packets.IsSet() || e.Bytes.IsSet()) && !s.flag(WithCounters):
+		return errCounter
+	case e.Comment.IsSet() && !s.flag(WithComment):
+		return errComment
+	case (e.Skbmark.IsSet() || e.Skbprio.IsSet() || e.Skbqueue.IsSet()) && !s.flag(WithSkbInfo):
+		return errSkbInfo
+	}
+	return 0
+}
+
+// extensions returns elem with the extensions of e the set supports.
+func (s *fakeSet) extensions(elem, e *Entry) *Entry {
+	r := *elem
+	if flags := CadtFlags(e.CadtFlags.Get()) & NoMatch; flags != 0 {
+		r.CadtFlags = NewUInt32Box(r.CadtFlags.Get() | uint32(flags))
+	}
+	if s.flag(WithCounters) {
+		r.Packets, r.Bytes = e.Packets, e.Bytes
+	}
+	if s.flag(WithComment) && e.Comment.IsSet() && e.Comment.Get() != "" {
+		r.Comment = e.Comment
+	}
+	if s.flag(WithSkbInfo) {
+		r.Skbmark, r.Skbprio, r.Skbqueue = e.Skbmark, e.Skbprio, e.Skbqueue
+	}
+	return &r
+}
+
+// elements returns the elements stored for e, expanding ranges.
+func (s *fakeSet) elements(e *Entry) ([]*Entry, syscall.Errno) {
+	elems := []*Entry{{}}
+	second := false
+	for _, dim := range s.typ.dims {
+		var (
+			expanded []*Entry
+			errno    syscall.Errno
+		)
+		switch {
+		case s.typ.bitmap():
+			expanded, errno = s.expandBitmap(elems, dim, e)
+		case dim == "ip", dim == "net":
+			ip, to, cidr := e.IP, e.IPTo, e.Cidr
+			if second {
+				ip, to, cidr = e.IP2, e.IP2To, e.Cidr2
+			}
+			expanded, errno = s.expandIP(elems, dim, second, ip, to, cidr)
+			second = true
+		case dim == "port":
+			expanded, errno = s.expandPort(elems, e)
+		case dim == "mac":
+			if !e.Ether.IsSet() || len(e.Ether.Get()) != 6 {
+				return nil, errProtocol
+			}
+			expanded = with(elems, func(r *Entry) { r.Ether = e.Ether })
+		case dim == "iface":
+			if !e.Iface.IsSet() {
+				return nil, errProtocol
+			}
+			flags := CadtFlags(e.CadtFlags.Get()) & PhysDev
+			expanded = with(elems, func(r *Entry) {
+				r.Iface = e.Iface
+				if flags != 0 {
+					r.CadtFlags = NewUInt32Box(uint32(flags))
+				}
+			})
+		case dim == "mark":
+			if !e.Mark.IsSet() {
+				return nil, errProtocol
+			}
+			mark := NewUInt32Box(e.Mark.Get() & s.data.MarkMask.Get())
+			expanded = with(elems, func(r *Entry) { r.Mark = mark })
+		}
+		if errno != 0 {
+			return nil, errno
+		}
+		elems = expanded
+	}
+	return elems, 0
+}
+
+// with returns copies of elems modified by fn.
+func with(elems []*Entry, fn func(*Entry)) []*Entry {
+	res := make([]*Entry, len(elems))
+	for i, elem := range elems {
+		r := *elem
+		fn(&r)
+		res[i] = &r
+	}
+	return res
+}
+
+func (s *fakeSet) expandIP(elems []*Entry, dim string, second bool, ip, to *IPAddrBox, cidr *UInt8Box) ([]*Entry, syscall.Errno) {
+	if !ip.IsSet() {
+		return nil, errProtocol
+	}
+	addr := ip.Get()
+	if v4 := addr.To4(); v4 != nil {
+		addr = v4
+	}
+	// The kernel expects the address attribute matching the family.
+	if (s.family == netfilter.ProtoIPv4) != (len(addr) == net.IPv4len) {
+		return nil, errProtocol
+	}
+
+	set := func(r *Entry, ip net.IP, bits int) {
+		if second {
+			r.IP2 = NewIPAddrBox(ip)
+			if dim == "net" {
+				r.Cidr2 = NewUInt8Box(uint8(bits))
+			}
+		} else {
+			r.IP = NewIPAddrBox(ip)
+			if dim == "net" {
+				r.Cidr = NewUInt8Box(uint8(bits))
+			}
+		}
+	}
+
+	if dim == "net" {
+		if to.IsSet() {
+			return s.expandNetRange(elems, second, addr, to, set)
+		}
+		bits := s.bits()
+		if cidr.IsSet() {
+			bits = int(cidr.Get())
+		}
+		if bits == 0 || bits > s.bits() {
+			return nil, errInvalidCidr
+		}
+		masked := addr.Mask(net.CIDRMask(bits, s.bits()))
+		return with(elems, func(r *Entry) { set(r, masked, bits) }), 0
+	}
+
+	mask := s.bits()
+	if s.data.NetMask.IsSet() {
+		mask = int(s.data.NetMask.Get())
+	}
+	if !to.IsSet() && !cidr.IsSet() {
+		masked := addr.Mask(net.CIDRMask(mask, s.bits()))
+		return with(elems, func(r *Entry) { set(r, masked, mask) }), 0
+	}
+
+	// Ranges are only supported for the first IPv4 address.
+	if second || s.family != netfilter.ProtoIPv4 {
+		return nil, errHashRangeUnsupported
+	}
+	first := binary.BigEndian.Uint32(addr)
+	last := first
+	if to.IsSet() {
+		v4 := to.Get().To4()
+		if v4 == nil {
+			return nil, errIPAddrIPv4
+		}
+		last = binary.BigEndian.Uint32(v4)
+	} else {
+		bits := int(cidr.Get())
+		if bits == 0 || bits > 32 {
+			return nil, errInvalidCidr
+		}
+		first &^= 1<<uint(32-bits) - 1
+		last = first | (1<<uint(32-bits) - 1)
+	}
+	if last < first {
+		return nil, errHashRange
+	}
+	step := uint64(1) << uint(32-mask)
+	if (uint64(last)-uint64(first))/step >= uint64(s.data.MaxElem.Get()) {
+		return nil, errHashRange
+	}
+
+	var res []*Entry
+	for a := uint64(first) &^ (step - 1); a <= uint64(last); a += step {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, uint32(a))
+		res = append(res, with(elems, func(r *Entry) { set(r, ip, mask) })...)
+	}
+	return res, 0
+}
+
+// expandNetRange splits an IPv4 address range into the networks covering it.
+func (s *fakeSet) expandNetRange(elems []*Entry, second bool, addr net.IP, to *IPAddrBox, set func(*Entry, net.IP, int)) ([]*Entry, syscall.Errno) {
+	if second || s.family != netfilter.ProtoIPv4 {
+		return nil, errHashRangeUnsupported
+	}
+	v4 := to.Get().To4()
+	if v4 == nil {
+		return nil, errProtocol
+	}
+
+	// The kernel swaps reversed ranges, but refuses the whole address space.
+	first, last := uint64(binary.BigEndian.Uint32(addr)), uint64(binary.BigEndian.Uint32(v4))
+	if last < first {
+		first, last = last, first
+	}
+	if first == 0 && last == math.MaxUint32 {
+		return nil, errHashRange
+	}
+
+	var res []*Entry
+	for first <= last {
+		// Use the largest network starting at first which does not exceed last.
+		bits := 32
+		for bits > 0 {
+			size := uint64(1) << uint(33-bits)
+			if first&(size-1) != 0 || first+size-1 > last {
+				break
+			}
+			bits--
+		}
+
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, uint32(first))
+		res = append(res, with(elems, func(r *Entry) { set(r, ip, bits) })...)
+		first += uint64(1) << uint(32-bits)
+	}
+	return res, 0
+}
+
+func (s *fakeSet) expandPort(elems []*Entry, e *Entry) ([]*Entry, syscall.Errno) {
+	if !e.Port.IsSet() {
+		return nil, errProtocol
+	}
+	if !e.Proto.IsSet() {
+		return nil, errMissingProto
+	}
+	proto := e.Proto.Get()
+	if proto == 0 {
+		return nil, errInvalidProto
+	}
+
+	switch proto {
+	case syscall.IPPROTO_TCP, syscall.IPPROTO_UDP, syscall.IPPROTO_UDPLITE, syscall.IPPROTO_SCTP:
+	case syscall.IPPROTO_ICMP, syscall.IPPROTO_ICMPV6:
+		// The port holds the ICMP type and code.
+		return with(elems, func(r *Entry) { r.Proto, r.Port = e.Proto, e.Port }), 0
+	default:
+		// Other protocols have no ports.
+		port := NewUInt16Box(0)
+		return with(elems, func(r *Entry) { r.Proto, r.Port = e.Proto, port }), 0
+	}
+
+	first, last := e.Port.Get(), e.Port.Get()
+	if e.PortTo.IsSet() {
+		last = e.PortTo.Get()
+		if last < first {
+			first, last = last, first
+		}
+	}
+
+	var res []*Entry
+	for p := int(first); p <= int(last); p++ {
+		port := NewUInt16Box(uint16(p))
+		res = append(res, with(elems, func(r *Entry) { r.Proto, r.Port = e.Proto, port })...)
+	}
+	return res, 0
+}
+
+// key identifies an element of s. Bitmaps store a single
+// element per address or port.
+func (s *fakeSet) key(e *Entry) string {
+	if s.typ.bitmap() {
+		return fmt.Sprint(bitmapOffset(e))
+	}
+	return fakeKey(e)
+}
+
+// fakeKey identifies an element.
+func fakeKey(e *Entry) string {
+	var b strings.Builder
+	if e.IP.IsSet() {
+		fmt.Fprintf(&b, "%s/%d|", e.IP.Get(), e.Cidr.Get())
+	}
+	if e.IP2.IsSet() {
+		fmt.Fprintf(&b, "%s/%d|", e.IP2.Get(), e.Cidr2.Get())
+	}
+	if e.Proto.IsSet() {
+		fmt.Fprintf(&b, "%d:%d|", e.Proto.Get(), e.Port.Get())
+	}
+	if e.Ether.IsSet() {
+		fmt.Fprintf(&b, "%s|", e.Ether.Get())
+	}
+	if e.Iface.IsSet() {
+		fmt.Fprintf(&b, "%s/%d|", e.Iface.Get(), e.CadtFlags.Get()&uint32(PhysDev))
+	}
+	if e.Mark.IsSet() {
+		fmt.Fprintf(&b, "%d|", e.Mark.Get())
+	}
+	if e.Name.IsSet() {
+		fmt.Fprintf(&b, "%s|", e.Name.Get())
+	}
+	return b.String()
+}
+
+// Number of members of a list:set by default and at least.
+const (
+	fakeListSize    = 8
+	fakeListMinSize = 4
+)
+
+// references returns the number of list:set members referring to the set name.
+func (k *FakeKernel) references(name string) int {
+	n := 0
+	for _, s := range k.sets {
+		if !s.typ.list() {
+			continue
+		}
+		k.expire(s)
+		for _, e := range s.entries {
+			if e.Name.Get() == name {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// position resolves the member set and the reference set of the list:set
+// entry e like the kernel does. It returns a positive value if the member
+// is placed before the reference set, a negative one if it is placed after
+// it, and zero without reference set.
+func (k *FakeKernel) position(e *Entry) (int, syscall.Errno) {
+	if !e.Name.IsSet() {
+		return 0, errProtocol
+	}
+	member := k.find(e.Name.Get())
+	if member == nil {
+		return 0, errListName
+	}
+	if member.typ.list() {
+		return 0, errListLoop
+	}
+
+	before := 0
+	if CadtFlags(e.CadtFlags.Get())&Before != 0 {
+		if !e.NameRef.IsSet() {
+			return 0, errListBefore
+		}
+		before = 1
+	}
+	if e.NameRef.IsSet() {
+		if k.find(e.NameRef.Get()) == nil {
+			return 0, errListNameRef
+		}
+		if before == 0 {
+			before = -1
+		}
+	}
+	return before, 0
+}
+
+// positioned reports whether the member at i of list is placed
+// before or after the set ref as required by before.
+func positioned(list []*fakeEntry, i, before int, ref string) bool {
+	switch {
+	case before > 0:
+		return i+1 < len(list) && list[i+1].Name.Get() == ref
+	case before < 0:
+		return i > 0 && list[i-1].Name.Get() == ref
+	}
+	return true
+}
+
+func (k *FakeKernel) addMember(s *fakeSet, e *Entry, excl bool) syscall.Errno {
+	before, errno := k.position(e)
+	if errno != 0 {
+		return errno
+	}
+	if errno := s.checkExtensions(e); errno != 0 {
+		return errno
+	}
+
+	list := s.sorted()
+	var old *fakeEntry
+	at, found := len(list), before == 0
+	for i, fe := range list {
+		switch {
+		case fe.Name.Get() == e.Name.Get():
+			old = fe
+		case before != 0 && fe.Name.Get() == e.NameRef.Get():
+			at, found = i, true
+			if before < 0 {
+				at++
+			}
+		}
+	}
+	if !found {
+		return errListRefExist
+	}
+
+	elem := &Entry{Name: e.Name}
+	key := fakeKey(elem)
+	if old != nil {
+		// Existing members keep their position.
+		if excl {
+			return errExist
+		}
+		s.entries[key] = k.newEntry(s, elem, e, old)
+		return 0
+	}
+	fe := k.newEntry(s, elem, e, nil)
+	s.entries[key] = fe
+	list = append(list[:at], append([]*fakeEntry{fe}, list[at:]...)...)
+	for _, fe := range list {
+		k.seq++
+		fe.seq = k.seq
+	}
+	return 0
+}
+
+func (k *FakeKernel) delMember(s *fakeSet, e *Entry, excl bool) syscall.Errno {
+	before, errno := k.position(e)
+	if errno != 0 {
+		return errno
+	}
+
+	list := s.sorted()
+	for i, fe := range list {
+		if fe.Name.Get() != e.Name.Get() {
+			continue
+		}
+		if !positioned(list, i, before, e.NameRef.Get()) {
+			return errListRefExist
+		}
+		delete(s.entries, fakeKey(fe.Entry))
+		return 0
+	}
+
+	if before != 0 {
+		return errListRefExist
+	}
+	if excl {
+		return errExist
+	}
+	return 0
+}
+
+func (k *FakeKernel) testMember(s *fakeSet, e *Entry) syscall.Errno {
+	// The kernel reports any error testing a member as missing member.
+	before, errno := k.position(e)
+	if errno != 0 {
+		return errExist
+	}
+
+	list := s.sorted()
+	for i, fe := range list {
+		if fe.Name.Get() == e.Name.Get() && positioned(list, i, before, e.NameRef.Get()) {
+			return 0
+		}
+	}
+	return errExist
+}
+
+// Bitmaps store at most this many elements.
+const fakeBitmapMaxElements = 1 << 16
+
+// setRange validates the range of a bitmap set and stores it
+// as first and last value, like reported by the kernel.
+func (s *fakeSet) setRange() syscall.Errno {
+	d := &s.data
+	if s.typ.has("port") {
+		if !d.Port.IsSet() || !d.PortTo.IsSet() {
+			return errProtocol
+		}
+		if d.Port.Get() > d.PortTo.Get() {
+			d.Port, d.PortTo = d.PortTo, d.Port
+		}
+		return 0
+	}
+
+	if !d.IP.IsSet() || (!d.IPTo.IsSet() && !d.Cidr.IsSet()) {
+		return errProtocol
+	}
+	if d.Cidr.IsSet() && d.Cidr.Get() >= 32 {
+		return errInvalidCidr
+	}
+	first, last, ok := ipv4Range(d.IP, d.IPTo, d.Cidr)
+	if !ok {
+		return errIPAddrIPv4
+	}
+	if first > last {
+		first, last = last, first
+	}
+
+	elements := uint64(last) - uint64(first) + 1
+	if d.NetMask.IsSet() {
+		// The range must be a network larger than the netmask.
+		n := d.NetMask.Get()
+		first, last = first&prefixMask(n), last|^prefixMask(n)
+		size, prefix := uint64(last)-uint64(first)+1, uint8(32)
+		for v := size; v > 1 && v%2 == 0; v /= 2 {
+			prefix--
+		}
+		if size != 1<<(32-prefix) || uint64(first)%size != 0 || n <= prefix {
+			return errBitmapRange
+		}
+		elements = 1 << (n - prefix)
+	}
+	if elements > fakeBitmapMaxElements {
+		return errBitmapRangeSize
+	}
+
+	d.IP, d.IPTo, d.Cidr = NewIPAddrBox(uint32ToIP(first)), NewIPAddrBox(uint32ToIP(last)), nil
+	return 0
+}
+
+// expandBitmap returns elems with the component dim of e, which must be
+// within the range of the bitmap s. Ranges are expanded.
+func (s *fakeSet) expandBitmap(elems []*Entry, dim string, e *Entry) ([]*Entry, syscall.Errno) {
+	switch dim {
+	case "mac":
+		// The MAC address is optional, it is learned from packets.
+		if !e.Ether.IsSet() {
+			return elems, 0
+		}
+		if len(e.Ether.Get()) != 6 {
+			return nil, errProtocol
+		}
+		return with(elems, func(r *Entry) { r.Ether = e.Ether }), 0
+
+	case "port":
+		if !e.Port.IsSet() || e.Proto.IsSet() {
+			return nil, errProtocol
+		}
+		if err := s.typ.ValidateRange(&s.data, e); err != nil {
+			return nil, errBitmapRange
+		}
+		first, last := e.Port.Get(), e.Port.Get()
+		if e.PortTo.IsSet() {
+			last = e.PortTo.Get()
+			if last < first {
+				first, last = last, first
+			}
+		}
+		var res []*Entry
+		for p := int(first); p <= int(last); p++ {
+			port := NewUInt16Box(uint16(p))
+			res = append(res, with(elems, func(r *Entry) { r.Port = port })...)
+		}
+		return res, 0
+	}
+
+	if !e.IP.IsSet() {
+		return nil, errProtocol
+	}
+	if e.IP.Get().To4() == nil {
+		return nil, errProtocol
+	}
+	if s.typ.has("mac") && (e.IPTo.IsSet() || e.Cidr.IsSet()) {
+		return nil, errProtocol
+	}
+	if e.Cidr.IsSet() && (e.Cidr.Get() == 0 || e.Cidr.Get() > 32) {
+		return nil, errInvalidCidr
+	}
+	if err := s.typ.ValidateRange(&s.data, e); err != nil {
+		return nil, errBitmapRange
+	}
+
+	first, last, _ := ipv4Range(e.IP, e.IPTo, e.Cidr)
+	if first > last {
+		first, last = last, first
+	}
+	step := uint64(1)
+	if s.data.NetMask.IsSet() {
+		mask := prefixMask(s.data.NetMask.Get())
+		first &= mask
+		step = uint64(^mask) + 1
+	}
+
+	var res []*Entry
+	for a := uint64(first); a <= uint64(last); a += step {
+		ip := NewIPAddrBox(uint32ToIP(uint32(a)))
+		res = append(res, with(elems, func(r *Entry) { r.IP = ip })...)
+	}
+	return res, 0
+}
+
+// bitmapOffset returns the address or port of a bitmap element.
+func bitmapOffset(e *Entry) uint32 {
+	if v4 := e.IP.Get().To4(); v4 != nil {
+		return binary.BigEndian.Uint32(v4)
+	}
+	return uint32(e.Port.Get())
+}
+
+func uint32ToIP(v uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
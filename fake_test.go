@@ -0,0 +1,295 @@
+package ipset
+
+import (
+	stderrors "errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+func newFakeConn() (*Conn, *FakeKernel) {
+	k := NewFakeKernel()
+	return &Conn{Family: netfilter.ProtoIPv4, Conn: k}, k
+}
+
+func listIPs(t *testing.T, c *Conn, name string) []string {
+	p, err := c.List(name)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	ips := make([]string, 0, len(p.Entries))
+	for _, e := range p.Entries {
+		s := e.IP.Get().String()
+		if e.Cidr.IsSet() {
+			s += fmt.Sprintf("/%d", e.Cidr.Get())
+		}
+		ips = append(ips, s)
+	}
+	return ips
+}
+
+func TestFakeKernel_Sets(t *testing.T) {
+	assert2 := assert.New(t)
+	c, _ := newFakeConn()
+
+	p, err := c.Protocol()
+	assert2.NoError(err)
+	assert2.Equal(uint8(Protocol), p.Protocol.Get())
+
+	typ, err := c.Type("hash:ip", netfilter.ProtoIPv4)
+	if assert2.NoError(err) {
+		assert2.Equal(uint8(6), typ.Revision.Get())
+	}
+	_, err = c.Type("hash:foo", netfilter.ProtoIPv4)
+	assert2.True(stderrors.Is(err, ErrTypeNotFound))
+
+	assert2.NoError(c.Create("foo", "hash:ip", 6, netfilter.ProtoIPv4))
+	assert2.True(stderrors.Is(c.Create("foo", "hash:ip", 6, netfilter.ProtoIPv4), ErrSetExists))
+	assert2.NoError(c.Replace("foo", "hash:ip", 6, netfilter.ProtoIPv4))
+	assert2.True(stderrors.Is(c.Replace("foo", "hash:net", 7, netfilter.ProtoIPv4), ErrSetExists))
+	assert2.NoError(c.Create("bar", "hash:ip", 6, netfilter.ProtoIPv4))
+	assert2.NoError(c.Create("baz", "hash:net", 7, netfilter.ProtoIPv6))
+
+	h, err := c.Header("baz")
+	if assert2.NoError(err) {
+		assert2.Equal("hash:net", h.TypeName.Get())
+		assert2.Equal(uint8(netfilter.ProtoIPv6), h.Family.Get())
+		assert2.Equal(uint32(1024), h.Data.HashSize.Get())
+		assert2.Equal(uint32(0), h.Elements.Get())
+		assert2.True(h.References.IsSet())
+		assert2.True(h.MemSize.IsSet())
+	}
+
+	assert2.NoError(c.Add("foo", NewEntry(EntryIP(net.ParseIP("10.0.0.1")))))
+	assert2.NoError(c.Swap("foo", "bar"))
+	assert2.Equal([]string{}, listIPs(t, c, "foo"))
+	assert2.Equal([]string{"10.0.0.1"}, listIPs(t, c, "bar"))
+	assert2.True(stderrors.Is(c.Swap("foo", "baz"), ErrTypeMismatch))
+	assert2.True(stderrors.Is(c.Swap("foo", "qux"), ErrSetNotFound))
+
+	assert2.True(stderrors.Is(c.Rename("foo", "bar"), ErrSetExists))
+	assert2.NoError(c.Rename("foo", "qux"))
+
+	sets, err := c.ListAll()
+	if assert2.NoError(err) {
+		var names []string
+		for _, s := range sets {
+			names = append(names, s.Name.Get())
+		}
+		assert2.Equal([]string{"qux", "bar", "baz"}, names)
+		assert2.Equal(uint32(1), sets[1].Elements.Get())
+	}
+
+	assert2.NoError(c.Flush("bar"))
+	assert2.Equal([]string{}, listIPs(t, c, "bar"))
+	assert2.NoError(c.Destroy("bar"))
+	assert2.NoError(c.Destroy("bar"))
+	assert2.True(stderrors.Is(c.Flush("bar"), ErrSetNotFound))
+	assert2.NoError(c.DestroyAll())
+
+	_, err = c.List("qux")
+	assert2.True(stderrors.Is(err, ErrSetNotFound))
+}
+
+func TestFakeKernel_Entries(t *testing.T) {
+	assert2 := assert.New(t)
+	c, _ := newFakeConn()
+
+	assert2.NoError(c.Create("nets", "hash:net", 7, netfilter.ProtoIPv4))
+	assert2.NoError(c.Add("nets",
+		NewEntry(EntryIP(net.ParseIP("10.1.2.3")), EntryCidr(16)),
+		NewEntry(EntryIP(net.ParseIP("192.168.0.1"))),
+	))
+	assert2.Equal([]string{"10.1.0.0/16", "192.168.0.1/32"}, listIPs(t, c, "nets"))
+
+	// Adding an existing entry and deleting a missing one are no errors,
+	// unless exclusive.
+	assert2.NoError(c.Add("nets", NewEntry(EntryIP(net.ParseIP("10.1.0.0")), EntryCidr(16))))
+	assert2.NoError(c.Delete("nets", NewEntry(EntryIP(net.ParseIP("10.2.0.0")), EntryCidr(16))))
+	err := c.AddExclusive("nets", NewEntry(EntryIP(net.ParseIP("10.1.0.0")), EntryCidr(16)))
+	assert2.True(stderrors.Is(err, ErrElementExists))
+	err = c.DeleteExclusive("nets", NewEntry(EntryIP(net.ParseIP("10.2.0.0")), EntryCidr(16)))
+	assert2.True(stderrors.Is(err, ErrElementNotFound))
+	assert2.NoError(c.AddExclusive("nets", NewEntry(EntryIP(net.ParseIP("10.2.0.0")), EntryCidr(16))))
+	assert2.NoError(c.DeleteExclusive("nets", NewEntry(EntryIP(net.ParseIP("10.2.0.0")), EntryCidr(16))))
+
+	assert2.NoError(c.Test("nets", EntryIP(net.ParseIP("192.168.0.1"))))
+	assert2.True(stderrors.Is(c.Test("nets", EntryIP(net.ParseIP("192.168.0.2"))), ErrElementNotFound))
+
+	assert2.NoError(c.Delete("nets", NewEntry(EntryIP(net.ParseIP("192.168.0.1")))))
+	assert2.Equal([]string{"10.1.0.0/16"}, listIPs(t, c, "nets"))
+
+	// Address ranges of network types are split into networks.
+	assert2.NoError(c.Add("nets", NewEntry(EntryIP(net.ParseIP("10.0.0.1")), EntryIPTo(net.ParseIP("10.0.0.7")))))
+	assert2.Equal([]string{"10.1.0.0/16", "10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/30"}, listIPs(t, c, "nets"))
+
+	// Reversed ranges are swapped, the whole address space is refused.
+	assert2.NoError(c.Add("nets", NewEntry(EntryIP(net.ParseIP("10.0.0.9")), EntryIPTo(net.ParseIP("10.0.0.8")))))
+	assert2.Equal([]string{"10.1.0.0/16", "10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/30", "10.0.0.8/31"}, listIPs(t, c, "nets"))
+	err = c.Add("nets", NewEntry(EntryIP(net.ParseIP("0.0.0.0")), EntryIPTo(net.ParseIP("255.255.255.255"))))
+	assert2.True(stderrors.Is(err, ErrInvalidRange))
+	err = c.Add("nets", NewEntry(EntryIP(net.ParseIP("255.255.255.255")), EntryIPTo(net.ParseIP("0.0.0.0"))))
+	assert2.True(stderrors.Is(err, ErrInvalidRange))
+	assert2.Len(listIPs(t, c, "nets"), 5)
+
+	// Address ranges are expanded.
+	assert2.NoError(c.Create("ips", "hash:ip", 6, netfilter.ProtoIPv4))
+	assert2.NoError(c.Add("ips", NewEntry(EntryIP(net.ParseIP("10.0.0.254")), EntryIPTo(net.ParseIP("10.0.1.1")))))
+	assert2.Equal([]string{"10.0.0.254", "10.0.0.255", "10.0.1.0", "10.0.1.1"}, listIPs(t, c, "ips"))
+
+	err = c.Add("ips", NewEntry(EntryIP(net.ParseIP("2001:db8::1"))))
+	assert2.True(stderrors.Is(err, ErrProtocol))
+
+	// Port ranges are expanded, protocols are mandatory.
+	assert2.NoError(c.Create("ports", "hash:ip,port", 7, netfilter.ProtoIPv4))
+	assert2.NoError(c.Add("ports", NewEntry(EntryIP(net.ParseIP("10.0.0.1")),
+		EntryProto(syscall.IPPROTO_TCP), EntryPort(80), EntryPortTo(82))))
+	p, err := c.List("ports")
+	if assert2.NoError(err) {
+		assert2.Len(p.Entries, 3)
+	}
+	err = c.Add("ports", NewEntry(EntryIP(net.ParseIP("10.0.0.1")), EntryPort(80)))
+	assert2.True(stderrors.Is(err, ErrMissingProto))
+	err = c.Add("ports", NewEntry(EntryIP(net.ParseIP("10.0.0.1")), EntryProto(syscall.IPPROTO_TCP)))
+	assert2.True(stderrors.Is(err, ErrProtocol))
+}
+
+func TestFakeKernel_TestNets(t *testing.T) {
+	assert2 := assert.New(t)
+	c, _ := newFakeConn()
+	addr := func(s string) EntryOption { return EntryIP(net.ParseIP(s)) }
+	nomatch := EntryCadtFlags(uint32(NoMatch))
+
+	// Addresses match the networks containing them.
+	assert2.NoError(c.Create("nets", "hash:net", 7, netfilter.ProtoIPv4))
+	assert2.NoError(c.Add("nets", NewEntry(addr("10.1.0.0"), EntryCidr(16))))
+	assert2.NoError(c.Test("nets", addr("10.1.2.3")))
+	assert2.NoError(c.Test("nets", addr("10.1.2.3"), EntryCidr(32)))
+	assert2.True(stderrors.Is(c.Test("nets", addr("10.2.0.1")), ErrElementNotFound))
+
+	// Networks are tested as they are.
+	assert2.NoError(c.Test("nets", addr("10.1.0.0"), EntryCidr(16)))
+	assert2.True(stderrors.Is(c.Test("nets", addr("10.1.2.0"), EntryCidr(24)), ErrElementNotFound))
+
+	// The most specific network decides, nomatch networks count as a miss.
+	assert2.NoError(c.Add("nets", NewEntry(addr("10.1.2.0"), EntryCidr(24), nomatch)))
+	assert2.NoError(c.Add("nets", NewEntry(addr("10.1.2.128"), EntryCidr(25))))
+	assert2.True(stderrors.Is(c.Test("nets", addr("10.1.2.3")), ErrElementNotFound))
+	assert2.NoError(c.Test("nets", addr("10.1.2.129")))
+	assert2.NoError(c.Test("nets", addr("10.1.3.1")))
+	assert2.True(stderrors.Is(c.Test("nets", addr("10.1.2.0"), EntryCidr(24)), ErrElementNotFound))
+
+	// Both networks of hash:net,net are looked up.
+	assert2.NoError(c.Create("pairs", "hash:net,net", 4, netfilter.ProtoIPv4))
+	assert2.NoError(c.Add("pairs", NewEntry(addr("10.0.0.0"), EntryCidr(8),
+		EntryIP2(net.ParseIP("192.168.0.0")), EntryCidr2(16))))
+	assert2.NoError(c.Test("pairs", addr("10.1.1.1"), EntryIP2(net.ParseIP("192.168.1.1"))))
+	assert2.True(stderrors.Is(c.Test("pairs", addr("10.1.1.1"), EntryIP2(net.ParseIP("192.169.1.1"))), ErrElementNotFound))
+
+	// Other dimensions have to match exactly.
+	assert2.NoError(c.Create("ifaces", "hash:net,iface", 8, netfilter.ProtoIPv4))
+	assert2.NoError(c.Add("ifaces", NewEntry(addr("10.0.0.0"), EntryCidr(8), EntryIface("eth0"))))
+	assert2.NoError(c.Test("ifaces", addr("10.1.1.1"), EntryIface("eth0")))
+	assert2.True(stderrors.Is(c.Test("ifaces", addr("10.1.1.1"), EntryIface("eth1")), ErrElementNotFound))
+}
+
+func TestFakeKernel_Extensions(t *testing.T) {
+	assert2 := assert.New(t)
+	c, k := newFakeConn()
+
+	now := time.Unix(1000, 0)
+	k.Now = func() time.Time { return now }
+
+	assert2.NoError(c.Create("plain", "hash:ip", 6, netfilter.ProtoIPv4))
+	err := c.Add("plain", NewEntry(EntryIP(net.ParseIP("10.0.0.1")), EntryTimeout(time.Minute)))
+	assert2.True(stderrors.Is(err, ErrNoTimeout))
+	err = c.Add("plain", NewEntry(EntryIP(net.ParseIP("10.0.0.1")), EntryComment("x")))
+	assert2.True(stderrors.Is(err, ErrNoComment))
+
+	assert2.NoError(c.Create("ext", "hash:ip", 6, netfilter.ProtoIPv4,
+		CreateDataTimeout(time.Hour),
+		CreateDataCadtFlags(uint32(WithCounters|WithComment))))
+	assert2.NoError(c.Add("ext",
+		NewEntry(EntryIP(net.ParseIP("10.0.0.1")), EntryComment("one")),
+		NewEntry(EntryIP(net.ParseIP("10.0.0.2")), EntryTimeout(time.Minute), EntryPackets(3)),
+		NewEntry(EntryIP(net.ParseIP("10.0.0.3")), EntryTimeout(0)),
+	))
+
+	now = now.Add(30 * time.Second)
+	p, err := c.List("ext")
+	if assert2.NoError(err) && assert2.Len(p.Entries, 3) {
+		assert2.Equal("one", p.Entries[0].Comment.Get())
+		assert2.Equal(time.Hour-30*time.Second, p.Entries[0].Timeout.Get())
+		assert2.Equal(30*time.Second, p.Entries[1].Timeout.Get())
+		assert2.Equal(uint64(3), p.Entries[1].Packets.Get())
+		assert2.Equal(uint64(0), p.Entries[1].Bytes.Get())
+		assert2.Equal(time.Duration(0), p.Entries[2].Timeout.Get())
+	}
+
+	now = now.Add(time.Minute)
+	assert2.Equal([]string{"10.0.0.1", "10.0.0.3"}, listIPs(t, c, "ext"))
+	assert2.True(stderrors.Is(c.Test("ext", EntryIP(net.ParseIP("10.0.0.2"))), ErrElementNotFound))
+}
+
+func TestFakeKernel_Errors(t *testing.T) {
+	assert2 := assert.New(t)
+	c, _ := newFakeConn()
+
+	assert2.NoError(c.Create("small", "hash:ip", 6, netfilter.ProtoIPv4, CreateDataMaxElem(2)))
+
+	entries := []*Entry{
+		NewEntry(EntryIP(net.ParseIP("10.0.0.1"))),
+		NewEntry(EntryIP(net.ParseIP("10.0.0.2"))),
+		NewEntry(EntryIP(net.ParseIP("10.0.0.3"))),
+	}
+	err := c.Add("small", entries...)
+	assert2.True(stderrors.Is(err, ErrHashFull))
+
+	var e *Error
+	if assert2.True(stderrors.As(err, &e)) {
+		assert2.Equal(uint32(3), e.Line)
+		assert2.Equal(entries[2], e.Entry)
+	}
+	assert2.Equal([]string{"10.0.0.1", "10.0.0.2"}, listIPs(t, c, "small"))
+
+	assert2.True(stderrors.Is(c.Create("foo", "hash:ip", 6, netfilter.ProtoUnspec), ErrInvalidFamily))
+	assert2.True(stderrors.Is(c.Create("foo", "hash:ip", 99, netfilter.ProtoIPv4), ErrTypeNotFound))
+	assert2.True(stderrors.Is(c.Create("foo", "hash:ip,port", 6, netfilter.ProtoIPv4, CreateDataNetMask(24)), ErrProtocol))
+	assert2.NoError(c.Create("foo", "hash:ip,port", 6, netfilter.ProtoIPv4, CreateDataBucketSize(12)))
+	assert2.NoError(c.Create("bar", "hash:ip,port", 7, netfilter.ProtoIPv4, CreateDataNetMask(24)))
+	assert2.True(stderrors.Is(c.Create("nn", "hash:net,net", 3, netfilter.ProtoIPv4, CreateDataNetMask(24)), ErrProtocol))
+	assert2.NoError(c.Create("nn", "hash:net,net", 4, netfilter.ProtoIPv4, CreateDataNetMask(24)))
+	assert2.True(stderrors.Is(c.Add("baz", entries[0]), ErrSetNotFound))
+}
+
+func TestFakeKernel_ListMultipart(t *testing.T) {
+	assert2 := assert.New(t)
+	c, _ := newFakeConn()
+
+	var entries []*Entry
+	for i := 0; i < 2500; i++ {
+		entries = append(entries, NewEntry(EntryIP(net.IPv4(10, 0, byte(i>>8), byte(i)))))
+	}
+	assert2.NoError(c.Create("foo", "hash:ip", 6, netfilter.ProtoIPv4))
+	assert2.NoError(c.Add("foo", entries...))
+	assert2.NoError(c.Create("bar", "hash:ip", 6, netfilter.ProtoIPv4))
+
+	sets, err := c.ListAll()
+	if assert2.NoError(err) && assert2.Len(sets, 2) {
+		assert2.Len(sets[0].Entries, len(entries))
+		assert2.Equal("bar", sets[1].Name.Get())
+	}
+
+	assert2.NoError(c.ReplaceContents("foo", entries[:1]...))
+	assert2.Equal([]string{"10.0.0.0"}, listIPs(t, c, "foo"))
+
+	sets, err = c.ListAll()
+	if assert2.NoError(err) {
+		assert2.Len(sets, 2)
+	}
+}
@@ -1,9 +1,28 @@
 module github.com/digineo/go-ipset/v2
 
-go 1.12
+go 1.18
 
 require (
 	github.com/mdlayher/netlink v0.0.0-20190313131330-258ea9dff42c
-	github.com/stretchr/testify v1.3.0
+	github.com/prometheus/client_golang v1.11.1
+	github.com/stretchr/testify v1.4.0
 	github.com/ti-mo/netfilter v0.2.0
+	golang.org/x/sys v0.0.0-20210603081109-ebe580a85c40
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.26.0 // indirect
+	github.com/prometheus/procfs v0.6.0 // indirect
+	github.com/stretchr/objx v0.1.1 // indirect
+	golang.org/x/net v0.0.0-20200625001655-4c5254603344 // indirect
+	google.golang.org/protobuf v1.26.0-rc.1 // indirect
+	gopkg.in/yaml.v2 v2.3.0 // indirect
 )
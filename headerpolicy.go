@@ -10,6 +10,17 @@ type HeaderPolicy struct {
 	TypeName *NullStringBox
 	Revision *UInt8Box
 	Family   *UInt8Box
+
+	// Data holds the create options of the set, including the
+	// defaults the kernel filled in.
+	Data *CreateData
+	// Elements is the number of entries in the set.
+	Elements *UInt32Box
+	// References is the number of kernel components, e.g. iptables
+	// rules or list:set sets, referencing the set.
+	References *UInt32Box
+	// MemSize is the memory used by the set in bytes.
+	MemSize *UInt32Box
 }
 
 func newHeaderPolicy(p NamePolicy, typeName string, revision uint8, family netfilter.ProtoFamily) HeaderPolicy {
@@ -29,6 +40,13 @@ func (p HeaderPolicy) marshalAttributes() Attributes {
 	return attrs
 }
 
+func (p HeaderPolicy) typeName() string {
+	if !p.TypeName.IsSet() {
+		return ""
+	}
+	return p.TypeName.Get()
+}
+
 func (p *HeaderPolicy) unmarshalAttribute(nfa netfilter.Attribute) {
 	switch at := AttributeType(nfa.Type); at {
 	case AttrTypeName:
@@ -37,7 +55,26 @@ func (p *HeaderPolicy) unmarshalAttribute(nfa netfilter.Attribute) {
 		p.Revision = unmarshalUInt8Box(nfa)
 	case AttrFamily:
 		p.Family = unmarshalUInt8Box(nfa)
+	case AttrData:
+		p.Data = unmarshalCreateData(nfa)
+		unmarshalAttributes(nfa.Children, (*headerData)(p))
 	default:
 		p.NamePolicy.unmarshalAttribute(nfa)
 	}
 }
+
+// headerData is the nested AttrData of a header. Besides the create options,
+// the kernel reports the size and the references of the set in it. These are
+// only decoded, requests never carry them.
+type headerData HeaderPolicy
+
+func (d *headerData) unmarshalAttribute(nfa netfilter.Attribute) {
+	switch at := AttributeType(nfa.Type); at {
+	case AttrElements:
+		d.Elements = unmarshalUInt32Box(nfa)
+	case AttrReferences:
+		d.References = unmarshalUInt32Box(nfa)
+	case AttrMemSize:
+		d.MemSize = unmarshalUInt32Box(nfa)
+	}
+}
@@ -0,0 +1,48 @@
+package ipset
+
+import "context"
+
+// EntryBefore places a member of a list:set before the member ref, which
+// must already be in the list. Deleting and testing the member with the
+// option only succeed if it is positioned right before ref.
+func EntryBefore(ref string) EntryOption {
+	return func(e *Entry) {
+		e.NameRef = NewNullStringBox(ref)
+		e.CadtFlags = NewUInt32Box(e.CadtFlags.Get() | uint32(Before))
+	}
+}
+
+// EntryAfter places a member of a list:set after the member ref,
+// like EntryBefore does before it.
+func EntryAfter(ref string) EntryOption {
+	return func(e *Entry) {
+		e.NameRef = NewNullStringBox(ref)
+		if flags := e.CadtFlags.Get() &^ uint32(Before); flags != 0 {
+			e.CadtFlags = NewUInt32Box(flags)
+		} else {
+			e.CadtFlags = nil
+		}
+	}
+}
+
+// Members returns the names of the member sets of the list:set name,
+// in the order they are matched.
+func (c *Conn) Members(name string) ([]string, error) {
+	return c.MembersContext(context.Background(), name)
+}
+
+// MembersContext is like Members but aborts once ctx is done.
+func (c *Conn) MembersContext(ctx context.Context, name string) ([]string, error) {
+	s, err := c.ListContext(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]string, 0, len(s.Entries))
+	for _, e := range s.Entries {
+		if e.Name.IsSet() {
+			members = append(members, e.Name.Get())
+		}
+	}
+	return members, nil
+}
@@ -0,0 +1,74 @@
+package ipset
+
+import (
+	stderrors "errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+func TestEntry_BeforeAfter(t *testing.T) {
+	assert2 := assert.New(t)
+
+	e := NewEntry(EntryName("foo"), EntryBefore("bar"))
+	assert2.Equal("bar", e.NameRef.Get())
+	assert2.Equal(uint32(Before), e.CadtFlags.Get())
+
+	e.set(EntryAfter("baz"))
+	assert2.Equal("baz", e.NameRef.Get())
+	assert2.False(e.CadtFlags.IsSet())
+
+	// The position is an option of the member, not part of the element.
+	assert2.Equal(NewEntry(EntryName("foo")).ElementKey(), e.ElementKey())
+	assert2.NotEqual(NewEntry(EntryName("bar")).ElementKey(), e.ElementKey())
+}
+
+func TestConn_ListSet(t *testing.T) {
+	assert2 := assert.New(t)
+	c, _ := newFakeConn()
+
+	for _, name := range []string{"a", "b", "c"} {
+		assert2.NoError(c.Create(name, "hash:ip", 6, netfilter.ProtoIPv4))
+	}
+	s := c.Set("chain", ListSet)
+	assert2.NoError(s.Create(netfilter.ProtoUnspec))
+	assert2.NoError(s.Add(NewEntry(EntryName("a")), NewEntry(EntryName("c"))))
+	assert2.NoError(s.Add(NewEntry(EntryName("b"), EntryBefore("c"))))
+
+	members, err := c.Members("chain")
+	if assert2.NoError(err) {
+		assert2.Equal([]string{"a", "b", "c"}, members)
+	}
+	assert2.NoError(s.Test(EntryName("b"), EntryAfter("a")))
+	assert2.True(stderrors.Is(s.Test(EntryName("b"), EntryBefore("a")), ErrElementNotFound))
+
+	// Members are referenced by the list.
+	h, err := c.List("a")
+	if assert2.NoError(err) {
+		assert2.Equal(uint32(1), h.References.Get())
+	}
+	assert2.True(stderrors.Is(c.Destroy("a"), ErrBusy))
+	assert2.True(stderrors.Is(c.Rename("a", "d"), ErrReferenced))
+
+	for _, tt := range []struct {
+		entry *Entry
+		err   error
+	}{
+		{NewEntry(EntryName("missing")), ErrMemberSetNotFound},
+		{NewEntry(EntryName("chain")), ErrListLoop},
+		{NewEntry(EntryName("a"), EntryBefore("missing")), ErrRefSetNotFound},
+		{NewEntry(EntryName("a"), EntryCadtFlags(uint32(Before))), ErrRefSetMissing},
+	} {
+		err := c.Add("chain", tt.entry)
+		assert2.True(stderrors.Is(err, tt.err), "%v", err)
+	}
+
+	assert2.NoError(c.Create("d", "hash:ip", 6, netfilter.ProtoIPv4))
+	assert2.True(stderrors.Is(s.Delete(NewEntry(EntryName("b"), EntryBefore("a"))), ErrRefSetNotMember))
+	assert2.True(stderrors.Is(s.Add(NewEntry(EntryName("b"), EntryAfter("d"))), ErrRefSetNotMember))
+	assert2.NoError(s.Delete(NewEntry(EntryName("b"), EntryAfter("a"))))
+
+	assert2.NoError(c.Flush("chain"))
+	assert2.NoError(c.Destroy("a"))
+}
@@ -0,0 +1,32 @@
+package ipset
+
+import (
+	"github.com/ti-mo/netfilter"
+)
+
+type listPolicy struct {
+	NamePolicy
+
+	Flags *UInt32Box
+}
+
+func newListPolicy(name string, flags CmdFlags) listPolicy {
+	return listPolicy{
+		NamePolicy: newNamePolicy(name),
+		Flags:      NewUInt32Box(uint32(flags)),
+	}
+}
+
+func (p listPolicy) marshalAttributes() Attributes {
+	attrs := p.NamePolicy.marshalAttributes()
+	attrs.append(AttrFlags, p.Flags)
+	return attrs
+}
+
+func (p *listPolicy) unmarshalAttribute(nfa netfilter.Attribute) {
+	if at := AttributeType(nfa.Type); at == AttrFlags {
+		p.Flags = unmarshalUInt32Box(nfa)
+	} else {
+		p.NamePolicy.unmarshalAttribute(nfa)
+	}
+}
@@ -1,5 +1,9 @@
 package ipset
 
+import (
+	"github.com/ti-mo/netfilter"
+)
+
 type MovePolicy struct {
 	NamePolicy
 
@@ -18,3 +22,11 @@ func (p MovePolicy) marshalAttributes() Attributes {
 	attrs.append(AttrSetName2, p.To)
 	return attrs
 }
+
+func (p *MovePolicy) unmarshalAttribute(nfa netfilter.Attribute) {
+	if at := AttributeType(nfa.Type); at == AttrSetName2 {
+		p.To = unmarshalNullStringBox(nfa)
+	} else {
+		p.NamePolicy.unmarshalAttribute(nfa)
+	}
+}
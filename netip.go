@@ -0,0 +1,143 @@
+package ipset
+
+import (
+	"context"
+	"net/netip"
+)
+
+// EntryAddr sets the IP of an entry to a.
+func EntryAddr(a netip.Addr) EntryOption { return EntryIP(a.AsSlice()) }
+
+// EntryAddr2 sets the second IP of an entry to a, for types
+// with two address dimensions like hash:net,net.
+func EntryAddr2(a netip.Addr) EntryOption { return EntryIP2(a.AsSlice()) }
+
+// EntryAddrRange sets the IP and IPTo of an entry to the
+// range of addresses from first to last.
+func EntryAddrRange(first, last netip.Addr) EntryOption {
+	return func(e *Entry) {
+		e.IP, e.IPTo = NewIPAddrBox(first.AsSlice()), NewIPAddrBox(last.AsSlice())
+	}
+}
+
+// EntryPrefix sets the IP and Cidr of an entry to the network p.
+// Host bits of p are cleared.
+func EntryPrefix(p netip.Prefix) EntryOption {
+	return func(e *Entry) {
+		e.IP, e.Cidr = NewIPAddrBox(p.Masked().Addr().AsSlice()), NewUInt8Box(uint8(p.Bits()))
+	}
+}
+
+// EntryPrefix2 sets the IP2 and Cidr2 of an entry to the network p,
+// like EntryPrefix does for the first dimension.
+func EntryPrefix2(p netip.Prefix) EntryOption {
+	return func(e *Entry) {
+		e.IP2, e.Cidr2 = NewIPAddrBox(p.Masked().Addr().AsSlice()), NewUInt8Box(uint8(p.Bits()))
+	}
+}
+
+// EntryAddrPort sets the IP and Port of an entry to ap. The protocol
+// is left to EntryProto.
+func EntryAddrPort(ap netip.AddrPort) EntryOption {
+	return func(e *Entry) {
+		e.IP, e.Port = NewIPAddrBox(ap.Addr().AsSlice()), NewUInt16Box(ap.Port())
+	}
+}
+
+// Addr returns the address of b. IPv4 addresses are returned as such,
+// whether b holds them in 4 or 16 byte form like net.ParseIP returns
+// them, the same way they are sent to the kernel. The zero Addr is
+// returned if b is unset or holds no valid address.
+func (b *IPAddrBox) Addr() netip.Addr {
+	a, _ := netip.AddrFromSlice(b.Get())
+	return a.Unmap()
+}
+
+// Addr returns the IP of e and whether it is set.
+func (e *Entry) Addr() (netip.Addr, bool) {
+	a := e.IP.Addr()
+	return a, a.IsValid()
+}
+
+// AddrTo returns the IPTo of e and whether it is set.
+func (e *Entry) AddrTo() (netip.Addr, bool) {
+	a := e.IPTo.Addr()
+	return a, a.IsValid()
+}
+
+// Addr2 returns the IP2 of e and whether it is set.
+func (e *Entry) Addr2() (netip.Addr, bool) {
+	a := e.IP2.Addr()
+	return a, a.IsValid()
+}
+
+// Prefix returns the IP and Cidr of e as network and whether the IP is
+// set. An IP without Cidr is returned as single address prefix. IPv4
+// addresses are returned as such, unless a Cidr above 32 makes the
+// IPv4-mapped network of an IPv6 set out of them.
+func (e *Entry) Prefix() (netip.Prefix, bool) {
+	return boxPrefix(e.IP, e.Cidr)
+}
+
+// Prefix2 returns the IP2 and Cidr2 of e like Prefix does.
+func (e *Entry) Prefix2() (netip.Prefix, bool) {
+	return boxPrefix(e.IP2, e.Cidr2)
+}
+
+// AddrPort returns the IP and Port of e and whether both are set.
+func (e *Entry) AddrPort() (netip.AddrPort, bool) {
+	a := e.IP.Addr()
+	return netip.AddrPortFrom(a, e.Port.Get()), a.IsValid() && e.Port.IsSet()
+}
+
+// Prefixes returns the IP and Cidr of the entries of the set name as
+// networks, in the order they are listed. Entries of types without an
+// address dimension are skipped.
+func (c *Conn) Prefixes(name string) ([]netip.Prefix, error) {
+	return c.PrefixesContext(context.Background(), name)
+}
+
+// PrefixesContext is like Prefixes but aborts once ctx is done.
+func (c *Conn) PrefixesContext(ctx context.Context, name string) ([]netip.Prefix, error) {
+	s, err := c.ListContext(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(s.Entries))
+	for _, e := range s.Entries {
+		if p, ok := e.Prefix(); ok {
+			prefixes = append(prefixes, p)
+		}
+	}
+	return prefixes, nil
+}
+
+func boxPrefix(ip *IPAddrBox, cidr *UInt8Box) (netip.Prefix, bool) {
+	a, ok := netip.AddrFromSlice(ip.Get())
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	if a.Is4In6() && (!cidr.IsSet() || cidr.Get() <= 32) {
+		a = a.Unmap()
+	}
+	bits := a.BitLen()
+	if cidr.IsSet() {
+		bits = int(cidr.Get())
+	}
+	p := netip.PrefixFrom(a, bits)
+	return p, p.IsValid()
+}
+
+// CreateDataPrefix sets the range of addresses a bitmap:ip or
+// bitmap:ip,mac set stores to the network p. Host bits of p are cleared.
+func CreateDataPrefix(p netip.Prefix) CreateDataOption {
+	return func(d *CreateData) {
+		d.IP, d.IPTo, d.Cidr = NewIPAddrBox(p.Masked().Addr().AsSlice()), nil, NewUInt8Box(uint8(p.Bits()))
+	}
+}
+
+// CreateDataAddrRange is like CreateDataIPRange for netip addresses.
+func CreateDataAddrRange(first, last netip.Addr) CreateDataOption {
+	return CreateDataIPRange(first.AsSlice(), last.AsSlice())
+}
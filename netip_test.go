@@ -0,0 +1,105 @@
+package ipset
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+func TestEntry_Netip(t *testing.T) {
+	assert2 := assert.New(t)
+
+	e := NewEntry(
+		EntryPrefix(netip.MustParsePrefix("10.1.2.3/24")),
+		EntryPrefix2(netip.MustParsePrefix("2001:db8::/64")),
+	)
+	assert2.Equal(net.IP{10, 1, 2, 0}, e.IP.Get())
+	assert2.Equal(uint8(24), e.Cidr.Get())
+	p, ok := e.Prefix()
+	assert2.True(ok)
+	assert2.Equal(netip.MustParsePrefix("10.1.2.0/24"), p)
+	p, ok = e.Prefix2()
+	assert2.True(ok)
+	assert2.Equal(netip.MustParsePrefix("2001:db8::/64"), p)
+
+	e = NewEntry(EntryIP(net.ParseIP("10.0.0.1").To4()), EntryPort(80))
+	a, ok := e.Addr()
+	assert2.True(ok)
+	assert2.Equal(netip.MustParseAddr("10.0.0.1"), a)
+	p, ok = e.Prefix()
+	assert2.True(ok)
+	assert2.Equal(netip.MustParsePrefix("10.0.0.1/32"), p)
+	ap, ok := e.AddrPort()
+	assert2.True(ok)
+	assert2.Equal(netip.MustParseAddrPort("10.0.0.1:80"), ap)
+
+	// IPv4 addresses in 16 byte form are IPv4 addresses, unless the Cidr
+	// is that of an IPv4-mapped network of an IPv6 set.
+	e = NewEntry(EntryIP(net.ParseIP("10.1.2.3")), EntryCidr(24))
+	p, ok = e.Prefix()
+	assert2.True(ok)
+	assert2.Equal(netip.MustParsePrefix("10.1.2.3/24"), p)
+	assert2.Equal(netip.MustParsePrefix("10.1.2.0/24"), p.Masked())
+	p, ok = NewEntry(EntryIP(net.ParseIP("10.1.2.3"))).Prefix()
+	assert2.True(ok)
+	assert2.Equal(netip.MustParsePrefix("10.1.2.3/32"), p)
+	attr := netfilter.Attribute{Type: uint16(AttrIP), Nested: true, Children: []netfilter.Attribute{
+		{Type: SetAttrIPAddrIPV6, Data: netip.MustParseAddr("::ffff:10.0.0.0").AsSlice()},
+	}}
+	e = NewEntry(EntryCidr(120))
+	e.IP = unmarshalIPAddrBox(attr)
+	p, ok = e.Prefix()
+	assert2.True(ok)
+	assert2.Equal(netip.MustParsePrefix("::ffff:10.0.0.0/120"), p)
+	a, _ = NewEntry(EntryIP(net.ParseIP("10.0.0.1"))).Addr()
+	assert2.Equal(netip.MustParseAddr("10.0.0.1"), a)
+
+	e = NewEntry(EntryAddrPort(netip.MustParseAddrPort("[2001:db8::1]:443")))
+	assert2.Equal(net.ParseIP("2001:db8::1"), e.IP.Get())
+	assert2.Equal(uint16(443), e.Port.Get())
+
+	e = NewEntry(EntryAddrRange(netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.9")))
+	a, _ = e.AddrTo()
+	assert2.Equal(netip.MustParseAddr("10.0.0.9"), a)
+
+	e = NewEntry(EntryPort(80))
+	_, ok = e.Addr()
+	assert2.False(ok)
+	_, ok = e.Prefix()
+	assert2.False(ok)
+	_, ok = e.AddrPort()
+	assert2.False(ok)
+	_, ok = NewEntry(EntryIP(net.ParseIP("10.0.0.1").To4()), EntryCidr(33)).Prefix()
+	assert2.False(ok)
+}
+
+func TestConn_Prefixes(t *testing.T) {
+	assert2 := assert.New(t)
+	c, _ := newFakeConn()
+
+	assert2.NoError(c.Create("foo", "hash:net", 7, netfilter.ProtoIPv4))
+	assert2.NoError(c.Add("foo",
+		NewEntry(EntryPrefix(netip.MustParsePrefix("10.0.0.0/8"))),
+		NewEntry(EntryAddr(netip.MustParseAddr("192.168.1.1"))),
+	))
+
+	prefixes, err := c.Prefixes("foo")
+	if assert2.NoError(err) {
+		assert2.ElementsMatch([]netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("192.168.1.1/32"),
+		}, prefixes)
+	}
+
+	assert2.NoError(c.Create("net", BitmapIP.Name, BitmapIP.Revision, netfilter.ProtoIPv4,
+		CreateDataPrefix(netip.MustParsePrefix("10.0.0.5/24"))))
+	assert2.Equal(netip.MustParseAddr("10.0.0.0"), newCreateData(CreateDataPrefix(netip.MustParsePrefix("10.0.0.5/24"))).IP.Addr())
+	h, err := c.Header("net")
+	if assert2.NoError(err) {
+		assert2.Equal(netip.MustParseAddr("10.0.0.0"), h.Data.IP.Addr())
+		assert2.Equal(netip.MustParseAddr("10.0.0.255"), h.Data.IPTo.Addr())
+	}
+}
@@ -0,0 +1,242 @@
+package ipset
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+// netlinkConn implements the connector interface on top of a plain Netlink
+// socket. In addition to Query, it is able to stream dump responses message
+// by message instead of buffering them all.
+type netlinkConn struct {
+	*netlink.Conn
+
+	// unread is a request whose response was not read completely,
+	// because reading from the socket failed, e.g. on a deadline.
+	unread *netlink.Message
+}
+
+func dialNetlink(config *netlink.Config) (*netlinkConn, error) {
+	c, err := netlink.Dial(unix.NETLINK_NETFILTER, config)
+	if err != nil {
+		return nil, err
+	}
+	return &netlinkConn{Conn: c}, nil
+}
+
+// Query sends nlm and returns the response. In contrast to netlink.Conn.Execute,
+// errors keep the request echoed by the kernel, which carries the line number
+// of rejected entries.
+func (c *netlinkConn) Query(nlm netlink.Message) ([]netlink.Message, error) {
+	var msgs []netlink.Message
+	err := c.Stream(nlm, func(m netlink.Message) bool {
+		msgs = append(msgs, m)
+		return true
+	})
+	return msgs, err
+}
+
+// Stream sends nlm and calls fn for every message of the response as it is
+// read from the socket. Once fn returns false, the remaining messages are
+// drained from the socket without being passed to fn.
+func (c *netlinkConn) Stream(nlm netlink.Message, fn func(netlink.Message) bool) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		// The socket does not support raw access, fall back to buffering.
+		msgs, err := c.Execute(nlm)
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if !fn(m) {
+				break
+			}
+		}
+		return nil
+	}
+
+	if c.unread != nil {
+		// Skip the rest of the response to an interrupted request, the kernel
+		// does not start another dump before the previous one is read.
+		err := c.readResponse(rc, *c.unread, func(netlink.Message) bool { return false })
+		if c.unread != nil {
+			return err
+		}
+	}
+
+	req, err := c.Send(nlm)
+	if err != nil {
+		return err
+	}
+	return c.readResponse(rc, req, fn)
+}
+
+// readResponse reads the response to req and calls fn for every message
+// until it returns false. If reading from the socket fails, req is kept
+// in unread to skip the rest of the response on the next request.
+func (c *netlinkConn) readResponse(rc syscall.RawConn, req netlink.Message, fn func(netlink.Message) bool) error {
+	c.unread = &req
+
+	more := true
+	for {
+		msgs, err := receive(rc)
+		if err != nil {
+			return err
+		}
+		if err := netlink.Validate(req, msgs); err != nil {
+			c.unread = nil
+			return err
+		}
+
+		for _, m := range msgs {
+			switch {
+			case m.Header.Type == netlink.Error:
+				c.unread = nil
+				return checkErrorMessage(m)
+			case m.Header.Type == netlink.Done:
+				c.unread = nil
+				return checkDoneMessage(m)
+			case more:
+				more = fn(m)
+			}
+
+			if m.Header.Flags&netlink.Multi == 0 {
+				c.unread = nil
+				return nil
+			}
+		}
+	}
+}
+
+// receive reads the next batch of messages from the socket.
+func receive(rc syscall.RawConn) ([]netlink.Message, error) {
+	b := make([]byte, os.Getpagesize())
+	for {
+		// Peek at the buffer to see how many bytes are available.
+		n, err := recvmsg(rc, b, unix.MSG_PEEK)
+		if err != nil {
+			return nil, err
+		}
+		if n < len(b) {
+			break
+		}
+		b = make([]byte, len(b)*2)
+	}
+
+	n, err := recvmsg(rc, b, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := syscall.ParseNetlinkMessage(b[:nlmsgAlign(n)])
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]netlink.Message, 0, len(raw))
+	for _, r := range raw {
+		msgs = append(msgs, netlink.Message{
+			Header: netlink.Header{
+				Length:   r.Header.Len,
+				Type:     netlink.HeaderType(r.Header.Type),
+				Flags:    netlink.HeaderFlags(r.Header.Flags),
+				Sequence: r.Header.Seq,
+				PID:      r.Header.Pid,
+			},
+			Data: r.Data,
+		})
+	}
+	return msgs, nil
+}
+
+func recvmsg(rc syscall.RawConn, b []byte, flags int) (int, error) {
+	var (
+		n    int
+		serr error
+	)
+	err := rc.Read(func(fd uintptr) bool {
+		n, _, _, _, serr = unix.Recvmsg(int(fd), b, nil, flags)
+		return serr != unix.EAGAIN
+	})
+	if err != nil {
+		return 0, &netlink.OpError{Op: "receive", Err: err}
+	}
+	if serr != nil {
+		return 0, &netlink.OpError{Op: "receive", Err: os.NewSyscallError("recvmsg", serr)}
+	}
+	return n, nil
+}
+
+// checkErrorMessage returns the error carried by a Netlink error message,
+// or nil if it is an acknowledgement.
+func checkErrorMessage(m netlink.Message) error {
+	if len(m.Data) < 4 {
+		return &netlink.OpError{Op: "receive", Err: syscall.EINVAL}
+	}
+
+	code := nlenc.Int32(m.Data[0:4])
+	if code == 0 {
+		return nil
+	}
+	return &netlink.OpError{Op: "receive", Err: &errorMessage{
+		errno:   syscall.Errno(-code),
+		request: m.Data[4:],
+	}}
+}
+
+// checkDoneMessage returns the error of a dump the kernel aborted, which it
+// reports in the payload of the final message instead of an error message.
+func checkDoneMessage(m netlink.Message) error {
+	if len(m.Data) < 4 {
+		return nil
+	}
+
+	code := nlenc.Int32(m.Data[0:4])
+	if code == 0 {
+		return nil
+	}
+	return &netlink.OpError{Op: "receive", Err: syscall.Errno(-code)}
+}
+
+// errorMessage is an error returned by the kernel along with the request it refers to.
+type errorMessage struct {
+	errno   syscall.Errno
+	request []byte
+}
+
+func (e *errorMessage) Error() string {
+	return e.errno.Error()
+}
+
+func (e *errorMessage) Unwrap() error {
+	return e.errno
+}
+
+// lineNo returns the line number the kernel stored in the echoed request
+// if it rejected an entry of a batch.
+func (e *errorMessage) lineNo() uint32 {
+	var nlm netlink.Message
+	if err := nlm.UnmarshalBinary(e.request); err != nil {
+		return 0
+	}
+
+	_, attrs, err := netfilter.UnmarshalNetlink(nlm)
+	if err != nil {
+		return 0
+	}
+	for _, nfa := range attrs {
+		if AttributeType(nfa.Type) == AttrLineNo && len(nfa.Data) == 4 {
+			return nfa.Uint32()
+		}
+	}
+	return 0
+}
+
+func nlmsgAlign(n int) int {
+	return (n + syscall.NLMSG_ALIGNTO - 1) & ^(syscall.NLMSG_ALIGNTO - 1)
+}
@@ -0,0 +1,266 @@
+package ipset
+
+import (
+	stderrors "errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+	"golang.org/x/sys/unix"
+)
+
+// testSocket is a netlink.Socket backed by one end of a datagram socket
+// pair. The test plays the kernel on the other end, writing a datagram of
+// response messages per slice returned by respond.
+type testSocket struct {
+	t       *testing.T
+	f       *os.File
+	peer    int
+	sent    []netlink.Message
+	respond func(req netlink.Message) [][]netlink.Message
+}
+
+func newTestNetlinkConn(t *testing.T) (*netlinkConn, *testSocket) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.SetNonblock(fds[0], true); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testSocket{t: t, f: os.NewFile(uintptr(fds[0]), "netlink"), peer: fds[1]}
+	return &netlinkConn{Conn: netlink.NewConn(s, 1)}, s
+}
+
+func (s *testSocket) Close() error {
+	unix.Close(s.peer)
+	return s.f.Close()
+}
+
+func (s *testSocket) File() *os.File {
+	return s.f
+}
+
+func (s *testSocket) Send(m netlink.Message) error {
+	s.sent = append(s.sent, m)
+	if s.respond != nil {
+		for _, msgs := range s.respond(m) {
+			s.write(msgs...)
+		}
+	}
+	return nil
+}
+
+func (s *testSocket) SendMessages(m []netlink.Message) error {
+	return syscall.ENOTSUP
+}
+
+func (s *testSocket) Receive() ([]netlink.Message, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// write sends msgs to the conn as a single datagram.
+func (s *testSocket) write(msgs ...netlink.Message) {
+	var b []byte
+	for _, m := range msgs {
+		m.Header.Length = uint32(nlmsgAlign(syscall.NLMSG_HDRLEN + len(m.Data)))
+		m.Data = append(m.Data, make([]byte, int(m.Header.Length)-syscall.NLMSG_HDRLEN-len(m.Data))...)
+		mb, err := m.MarshalBinary()
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		b = append(b, mb...)
+	}
+	if _, err := unix.Write(s.peer, b); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// reply returns a response message to req.
+func reply(req netlink.Message, typ netlink.HeaderType, flags netlink.HeaderFlags, data []byte) netlink.Message {
+	return netlink.Message{
+		Header: netlink.Header{Type: typ, Flags: flags, Sequence: req.Header.Sequence, PID: req.Header.PID},
+		Data:   data,
+	}
+}
+
+// codePayload returns the payload of a done message with code.
+func codePayload(code int32) []byte {
+	b := make([]byte, 4)
+	nlenc.PutInt32(b, code)
+	return b
+}
+
+// errorPayload returns the payload of an error message with code,
+// echoing the request req.
+func errorPayload(t *testing.T, code int32, req netlink.Message) []byte {
+	b := codePayload(code)
+	req.Header.Length = uint32(nlmsgAlign(syscall.NLMSG_HDRLEN + len(req.Data)))
+	req.Data = append(req.Data, make([]byte, int(req.Header.Length)-syscall.NLMSG_HDRLEN-len(req.Data))...)
+	rb, err := req.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(b, rb...)
+}
+
+func TestNetlinkConn_Multipart(t *testing.T) {
+	assert2 := assert.New(t)
+	c, s := newTestNetlinkConn(t)
+	defer c.Close()
+
+	// The first datagram exceeds the initial receive buffer.
+	large := make([]byte, 3*os.Getpagesize())
+	large[len(large)-1] = 0xff
+	s.respond = func(req netlink.Message) [][]netlink.Message {
+		return [][]netlink.Message{
+			{reply(req, 0x0607, netlink.Multi, large), reply(req, 0x0607, netlink.Multi, []byte{1, 0, 0, 0})},
+			{reply(req, 0x0607, netlink.Multi, []byte{2, 0, 0, 0})},
+			{reply(req, netlink.Done, netlink.Multi, codePayload(0))},
+		}
+	}
+
+	msgs, err := c.Query(netlink.Message{Header: netlink.Header{Type: 0x0607}})
+	if assert2.NoError(err) && assert2.Len(msgs, 3) {
+		assert2.Equal(large, msgs[0].Data)
+		assert2.Equal([]byte{1, 0, 0, 0}, msgs[1].Data)
+		assert2.Equal([]byte{2, 0, 0, 0}, msgs[2].Data)
+	}
+
+	// Messages left once fn stops are read from the socket all the same.
+	var n int
+	assert2.NoError(c.Stream(netlink.Message{Header: netlink.Header{Type: 0x0607}}, func(netlink.Message) bool {
+		n++
+		return false
+	}))
+	assert2.Equal(1, n)
+	assert2.Nil(c.unread)
+
+	// A single message ends the response unless flagged multipart.
+	s.respond = func(req netlink.Message) [][]netlink.Message {
+		return [][]netlink.Message{{reply(req, 0x0601, 0, []byte{6, 0, 0, 0})}}
+	}
+	msgs, err = c.Query(netlink.Message{Header: netlink.Header{Type: 0x0601}})
+	if assert2.NoError(err) && assert2.Len(msgs, 1) {
+		assert2.Equal([]byte{6, 0, 0, 0}, msgs[0].Data)
+	}
+}
+
+func TestNetlinkConn_Errors(t *testing.T) {
+	assert2 := assert.New(t)
+	c, s := newTestNetlinkConn(t)
+	defer c.Close()
+
+	// An aborted dump reports its error in the final message.
+	s.respond = func(req netlink.Message) [][]netlink.Message {
+		return [][]netlink.Message{{
+			reply(req, 0x0607, netlink.Multi, []byte{1, 0, 0, 0}),
+			reply(req, netlink.Done, netlink.Multi, codePayload(-int32(syscall.EMSGSIZE))),
+		}}
+	}
+	msgs, err := c.Query(netlink.Message{Header: netlink.Header{Type: 0x0607}})
+	var oe *netlink.OpError
+	if assert2.True(stderrors.As(err, &oe)) {
+		assert2.Equal(syscall.EMSGSIZE, oe.Err)
+	}
+	assert2.Len(msgs, 1)
+	assert2.Nil(c.unread)
+
+	// Acknowledgements are no errors.
+	s.respond = func(req netlink.Message) [][]netlink.Message {
+		return [][]netlink.Message{{reply(req, netlink.Error, 0, errorPayload(t, 0, req))}}
+	}
+	msgs, err = c.Query(netlink.Message{Header: netlink.Header{Type: 0x0609, Flags: netlink.Acknowledge}})
+	assert2.NoError(err)
+	assert2.Empty(msgs)
+
+	// Responses to other requests are rejected.
+	s.respond = func(req netlink.Message) [][]netlink.Message {
+		req.Header.Sequence++
+		return [][]netlink.Message{{reply(req, netlink.Error, 0, errorPayload(t, 0, req))}}
+	}
+	_, err = c.Query(netlink.Message{Header: netlink.Header{Type: 0x0609}})
+	assert2.Error(err)
+	assert2.Nil(c.unread)
+}
+
+func TestNetlinkConn_LineNo(t *testing.T) {
+	assert2 := assert.New(t)
+	nc, s := newTestNetlinkConn(t)
+	defer nc.Close()
+
+	// The kernel stores the line number of the rejected entry
+	// in the request it echoes.
+	s.respond = func(req netlink.Message) [][]netlink.Message {
+		lineNo := make([]byte, 4)
+		lineNo[3] = 2
+		echo, err := netfilter.MarshalNetlink(netfilter.Header{}, []netfilter.Attribute{
+			{Type: uint16(AttrLineNo), Data: lineNo},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo.Header = req.Header
+		return [][]netlink.Message{{reply(req, netlink.Error, 0, errorPayload(t, -4103, echo))}}
+	}
+
+	c := Conn{Family: netfilter.ProtoIPv4, Conn: nc}
+	entries := []*Entry{
+		NewEntry(EntryIP(net.ParseIP("10.0.0.1"))),
+		NewEntry(EntryIP(net.ParseIP("10.0.0.2"))),
+	}
+	err := c.Add("foo", entries...)
+	assert2.True(stderrors.Is(err, ErrElementExists), "%v", err)
+	var e *Error
+	if assert2.True(stderrors.As(err, &e)) {
+		assert2.Equal(uint32(2), e.Line)
+		assert2.Equal(entries[1], e.Entry)
+	}
+}
+
+func TestNetlinkConn_Drain(t *testing.T) {
+	assert2 := assert.New(t)
+	c, s := newTestNetlinkConn(t)
+	defer c.Close()
+
+	// The first request times out after a part of its response.
+	s.respond = func(req netlink.Message) [][]netlink.Message {
+		return [][]netlink.Message{{reply(req, 0x0607, netlink.Multi, []byte{1, 0, 0, 0})}}
+	}
+	var n int
+	assert2.NoError(s.f.SetReadDeadline(time.Now().Add(50 * time.Millisecond)))
+	err := c.Stream(netlink.Message{Header: netlink.Header{Type: 0x0607}}, func(netlink.Message) bool {
+		n++
+		return true
+	})
+	var oe *netlink.OpError
+	if assert2.True(stderrors.As(err, &oe)) {
+		assert2.True(os.IsTimeout(oe.Err), "%v", err)
+	}
+	assert2.Equal(1, n)
+	if !assert2.NotNil(c.unread) {
+		return
+	}
+	assert2.NoError(s.f.SetReadDeadline(time.Time{}))
+
+	// The rest of its response is skipped before the next request is sent.
+	first := s.sent[0]
+	s.write(reply(first, 0x0607, netlink.Multi, []byte{2, 0, 0, 0}))
+	s.write(reply(first, netlink.Done, netlink.Multi, codePayload(0)))
+	s.respond = func(req netlink.Message) [][]netlink.Message {
+		assert2.Nil(c.unread)
+		return [][]netlink.Message{{reply(req, 0x0601, 0, []byte{6, 0, 0, 0})}}
+	}
+	msgs, err := c.Query(netlink.Message{Header: netlink.Header{Type: 0x0601}})
+	if assert2.NoError(err) && assert2.Len(msgs, 1) {
+		assert2.Equal([]byte{6, 0, 0, 0}, msgs[0].Data)
+	}
+	assert2.Len(s.sent, 2)
+}
@@ -0,0 +1,131 @@
+package ipset
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/netfilter"
+)
+
+// NetNS identifies a network namespace by the path of its file,
+// an open file descriptor or a process living in it.
+type NetNS struct {
+	path string
+	fd   int
+}
+
+// NetNSPath returns the network namespace bound to path,
+// e.g. /var/run/netns/foo as created by `ip netns add foo`.
+func NetNSPath(path string) NetNS {
+	return NetNS{path: path}
+}
+
+// NetNSFD returns the network namespace referred to by the open
+// file descriptor fd. The descriptor is not closed. Dial fails for
+// descriptors below 1, which netlink takes for the current namespace.
+func NetNSFD(fd int) NetNS {
+	return NetNS{fd: fd}
+}
+
+// NetNSPID returns the network namespace of the process pid.
+func NetNSPID(pid int) NetNS {
+	return NetNS{path: "/proc/" + strconv.Itoa(pid) + "/ns/net"}
+}
+
+func (ns NetNS) String() string {
+	if ns.path != "" {
+		return ns.path
+	}
+	return "fd " + strconv.Itoa(ns.fd)
+}
+
+// open returns a file descriptor of the namespace and a function
+// releasing it once the socket was created.
+func (ns NetNS) open() (int, func(), error) {
+	if ns.path == "" {
+		if ns.fd <= 0 {
+			return 0, nil, fmt.Errorf("invalid network namespace file descriptor %d", ns.fd)
+		}
+		return ns.fd, func() {}, nil
+	}
+
+	f, err := os.Open(ns.path)
+	if err != nil {
+		return 0, nil, err
+	}
+	return int(f.Fd()), func() { f.Close() }, nil
+}
+
+type dialConfig struct {
+	netns *NetNS
+}
+
+// DialOption configures Dial.
+type DialOption func(*dialConfig)
+
+// DialNetNS opens the socket in the network namespace ns, so that the Conn
+// manages the sets of that namespace. It overrides the NetNS of the
+// netlink.Config passed to Dial.
+func DialNetNS(ns NetNS) DialOption {
+	return func(c *dialConfig) { c.netns = &ns }
+}
+
+// dialConnector opens the netlink socket of a Conn, tests replace it.
+var dialConnector = func(config *netlink.Config) (connector, error) {
+	return dialNetlink(config)
+}
+
+// NetNSError is the error of a network namespace visited by ForEachNetNS.
+type NetNSError struct {
+	NetNS NetNS
+	Err   error
+}
+
+func (e *NetNSError) Error() string {
+	return "netns " + e.NetNS.String() + ": " + e.Err.Error()
+}
+
+func (e *NetNSError) Unwrap() error {
+	return e.Err
+}
+
+// NetNSErrors is returned by ForEachNetNS if it failed in any namespace.
+type NetNSErrors []*NetNSError
+
+func (e NetNSErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ForEachNetNS dials a Conn in each of the namespaces and calls fn with it.
+// The Conn is closed once fn returns. Namespaces are visited in order; a
+// failure in one namespace does not keep the others from being visited.
+// The failures are returned as NetNSErrors.
+func ForEachNetNS(family netfilter.ProtoFamily, config *netlink.Config, namespaces []NetNS, fn func(ns NetNS, c *Conn) error) error {
+	var errs NetNSErrors
+	for _, ns := range namespaces {
+		if err := withNetNS(family, config, ns, fn); err != nil {
+			errs = append(errs, &NetNSError{NetNS: ns, Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func withNetNS(family netfilter.ProtoFamily, config *netlink.Config, ns NetNS, fn func(ns NetNS, c *Conn) error) error {
+	c, err := Dial(family, config, DialNetNS(ns))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return fn(ns, c)
+}
@@ -0,0 +1,157 @@
+package ipset
+
+import (
+	stderrors "errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+// fakeNetNS replaces the netlink sockets opened by Dial with a FakeKernel
+// per namespace. Namespaces are plain files, told apart by their path.
+type fakeNetNS struct {
+	dir     string
+	kernels map[string]*FakeKernel
+	configs []netlink.Config
+}
+
+func newFakeNetNS(t *testing.T) (*fakeNetNS, func()) {
+	dir, err := ioutil.TempDir("", "netns")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeNetNS{dir: dir, kernels: make(map[string]*FakeKernel)}
+	orig := dialConnector
+	dialConnector = f.dial
+
+	return f, func() {
+		dialConnector = orig
+		os.RemoveAll(dir)
+	}
+}
+
+// add creates a namespace and returns its path.
+func (f *fakeNetNS) add(t *testing.T, name string) string {
+	path := filepath.Join(f.dir, name)
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f.kernels[path] = NewFakeKernel()
+	return path
+}
+
+func (f *fakeNetNS) dial(config *netlink.Config) (connector, error) {
+	var cfg netlink.Config
+	if config != nil {
+		cfg = *config
+	}
+	f.configs = append(f.configs, cfg)
+
+	path, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(cfg.NetNS))
+	if err != nil {
+		return nil, err
+	}
+	return f.kernels[path], nil
+}
+
+func TestDial_NetNS(t *testing.T) {
+	assert2 := assert.New(t)
+	f, cleanup := newFakeNetNS(t)
+	defer cleanup()
+
+	foo, bar := f.add(t, "foo"), f.add(t, "bar")
+
+	config := &netlink.Config{Groups: 1}
+	c, err := Dial(netfilter.ProtoIPv4, config, DialNetNS(NetNSPath(foo)))
+	if !assert2.NoError(err) {
+		return
+	}
+	assert2.NoError(c.Create("a", "hash:ip", 6, netfilter.ProtoIPv4))
+	assert2.Len(f.kernels[foo].sets, 1)
+	assert2.Len(f.kernels[bar].sets, 0)
+
+	// The config is passed on without being modified.
+	assert2.Equal(uint32(1), f.configs[0].Groups)
+	assert2.Equal(0, config.NetNS)
+
+	file, err := os.Open(bar)
+	if !assert2.NoError(err) {
+		return
+	}
+	defer file.Close()
+
+	c, err = Dial(netfilter.ProtoIPv4, nil, DialNetNS(NetNSFD(int(file.Fd()))))
+	if assert2.NoError(err) {
+		assert2.NoError(c.Create("b", "hash:ip", 6, netfilter.ProtoIPv4))
+		assert2.Len(f.kernels[bar].sets, 1)
+	}
+	assert2.Equal(int(file.Fd()), f.configs[1].NetNS)
+
+	// Descriptors passed in are left open.
+	_, err = file.Stat()
+	assert2.NoError(err)
+
+	_, err = Dial(netfilter.ProtoIPv4, nil, DialNetNS(NetNSPath(filepath.Join(f.dir, "baz"))))
+	assert2.True(os.IsNotExist(err))
+
+	// Descriptors below 1 would select the current namespace.
+	for _, ns := range []NetNS{NetNSFD(0), NetNSFD(-1), {}} {
+		_, err = Dial(netfilter.ProtoIPv4, nil, DialNetNS(ns))
+		assert2.EqualError(err, "invalid network namespace file descriptor "+strconv.Itoa(ns.fd))
+	}
+	assert2.Len(f.configs, 2)
+}
+
+func TestForEachNetNS(t *testing.T) {
+	assert2 := assert.New(t)
+	f, cleanup := newFakeNetNS(t)
+	defer cleanup()
+
+	namespaces := []NetNS{
+		NetNSPath(f.add(t, "foo")),
+		NetNSPath(filepath.Join(f.dir, "bar")),
+		NetNSPath(f.add(t, "baz")),
+	}
+	failed := stderrors.New("failed")
+
+	var visited []string
+	err := ForEachNetNS(netfilter.ProtoIPv4, nil, namespaces, func(ns NetNS, c *Conn) error {
+		visited = append(visited, filepath.Base(ns.String()))
+		if err := c.Create("a", "hash:ip", 6, netfilter.ProtoIPv4); err != nil {
+			return err
+		}
+		if filepath.Base(ns.String()) == "baz" {
+			return failed
+		}
+		return nil
+	})
+
+	assert2.Equal([]string{"foo", "baz"}, visited)
+	for _, k := range f.kernels {
+		assert2.Len(k.sets, 1)
+	}
+
+	var errs NetNSErrors
+	if assert2.True(stderrors.As(err, &errs)) && assert2.Len(errs, 2) {
+		assert2.Equal(namespaces[1], errs[0].NetNS)
+		assert2.True(os.IsNotExist(stderrors.Unwrap(errs[0])))
+		assert2.Equal(namespaces[2], errs[1].NetNS)
+		assert2.True(stderrors.Is(errs[1], failed))
+		assert2.Contains(err.Error(), "netns "+namespaces[2].String()+": failed")
+	}
+}
+
+func TestNetNS_String(t *testing.T) {
+	assert2 := assert.New(t)
+
+	assert2.Equal("/proc/42/ns/net", NetNSPID(42).String())
+	assert2.Equal("/var/run/netns/foo", NetNSPath("/var/run/netns/foo").String())
+	assert2.Equal("fd 7", NetNSFD(7).String())
+}
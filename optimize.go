@@ -0,0 +1,235 @@
+package ipset
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// OptimizeReport tells how many entries Entries.Optimize eliminated.
+type OptimizeReport struct {
+	// Covered is the number of networks dropped because an equal or
+	// broader network already decides whether their addresses match.
+	Covered int
+	// Merged is the number of networks saved by joining adjacent
+	// networks into their parent network.
+	Merged int
+}
+
+// Eliminated returns the number of networks eliminated in total.
+func (r OptimizeReport) Eliminated() int {
+	return r.Covered + r.Merged
+}
+
+// optNode is a network of the entries being optimized.
+type optNode struct {
+	entry   *Entry
+	nomatch bool
+	options string
+}
+
+// sameAs reports whether o and n can stand in for each other.
+func (o *optNode) sameAs(n *optNode) bool {
+	return o.nomatch == n.nomatch && o.options == n.options
+}
+
+// Optimize returns the entries of a hash:net set with the least networks
+// matching the same addresses, like the kernel matches them: the most
+// specific network containing an address decides, and addresses of
+// NoMatch networks do not match.
+//
+// Networks within a broader network deciding the same way are dropped,
+// as are NoMatch networks outside of any other network. Adjacent networks
+// are joined into their parent network. Only networks with equal options,
+// e.g. the same timeout and comment, stand in for each other. Duplicates
+// are dropped in favor of the last one, like Add replaces them. Ranges are
+// split by RangePrefixes first, which the counts of the report refer to.
+//
+// The networks are returned ordered by address, followed by the entries
+// with other elements, e.g. a port, in their original order. The entries
+// passed in are not modified.
+func (e Entries) Optimize() (Entries, OptimizeReport) {
+	var report OptimizeReport
+	var others Entries
+	nodes := make(map[netip.Prefix]*optNode)
+
+	for _, entry := range e {
+		prefixes, ok := optPrefixes(entry)
+		if !ok {
+			others = append(others, entry)
+			continue
+		}
+		for _, p := range prefixes {
+			node := &optNode{
+				entry:   entry,
+				nomatch: CadtFlags(entry.CadtFlags.Get())&NoMatch != 0,
+				options: optionsKey(entry),
+			}
+			if len(prefixes) > 1 || entry.IPTo.IsSet() {
+				node.entry = optEntry(entry, p)
+			}
+			if _, ok := nodes[p]; ok {
+				report.Covered++
+			}
+			nodes[p] = node
+		}
+	}
+
+	// Merged networks may end up covered, and dropping covered
+	// networks may allow merging their siblings.
+	for {
+		covered := removeCovered(nodes)
+		merged := mergeSiblings(nodes)
+		report.Covered += covered
+		report.Merged += merged
+		if covered+merged == 0 {
+			break
+		}
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(nodes))
+	for p := range nodes {
+		prefixes = append(prefixes, p)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		a, b := prefixes[i], prefixes[j]
+		if a.Addr() != b.Addr() {
+			return a.Addr().Less(b.Addr())
+		}
+		return a.Bits() < b.Bits()
+	})
+
+	res := make(Entries, 0, len(prefixes)+len(others))
+	for _, p := range prefixes {
+		res = append(res, nodes[p].entry)
+	}
+	return append(res, others...), report
+}
+
+// optPrefixes returns the networks of entries holding only an address,
+// network or range, and false for other entries.
+func optPrefixes(e *Entry) ([]netip.Prefix, bool) {
+	if e.IP2.IsSet() || e.IP2To.IsSet() || e.Proto.IsSet() || e.Port.IsSet() || e.PortTo.IsSet() ||
+		e.Ether.IsSet() || e.Iface.IsSet() || e.Mark.IsSet() || e.Name.IsSet() {
+		return nil, false
+	}
+	if e.IPTo.IsSet() {
+		prefixes := RangePrefixes(e.IP.Addr(), e.IPTo.Addr())
+		return prefixes, prefixes != nil
+	}
+	p, ok := e.Prefix()
+	if !ok {
+		return nil, false
+	}
+	// IPv4-mapped networks are IPv4 networks, like RangePrefixes unmaps
+	// the addresses of ranges.
+	if a := p.Addr(); a.Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(a.Unmap(), p.Bits()-96)
+	}
+	return []netip.Prefix{p.Masked()}, true
+}
+
+// optEntry returns a copy of e for the network p.
+func optEntry(e *Entry, p netip.Prefix) *Entry {
+	c := *e
+	c.IPTo, c.Lineno = nil, nil
+	c.set(EntryPrefix(p))
+	return &c
+}
+
+// optionsKey identifies the options of e, apart from NoMatch.
+func optionsKey(e *Entry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%#x|", CadtFlags(e.CadtFlags.Get())&^NoMatch)
+	if e.Timeout.IsSet() {
+		fmt.Fprintf(&b, "timeout %d|", e.Timeout.Get())
+	}
+	if e.Comment.IsSet() {
+		fmt.Fprintf(&b, "comment %q|", e.Comment.Get())
+	}
+	if e.Packets.IsSet() || e.Bytes.IsSet() {
+		fmt.Fprintf(&b, "counters %d %d|", e.Packets.Get(), e.Bytes.Get())
+	}
+	if e.Skbmark.IsSet() {
+		fmt.Fprintf(&b, "skbmark %#x|", e.Skbmark.Get())
+	}
+	if e.Skbprio.IsSet() {
+		fmt.Fprintf(&b, "skbprio %#x|", e.Skbprio.Get())
+	}
+	if e.Skbqueue.IsSet() {
+		fmt.Fprintf(&b, "skbqueue %d|", e.Skbqueue.Get())
+	}
+	return b.String()
+}
+
+// parentOf returns the most specific network strictly containing p
+// in nodes, and nil if there is none.
+func parentOf(nodes map[netip.Prefix]*optNode, p netip.Prefix) *optNode {
+	for bits := p.Bits() - 1; bits >= 0; bits-- {
+		if node, ok := nodes[netip.PrefixFrom(p.Addr(), bits).Masked()]; ok {
+			return node
+		}
+	}
+	return nil
+}
+
+// removeCovered drops the networks whose parent decides the same way,
+// and NoMatch networks without parent. Dropping a network does not
+// change the decision for its children, as its parent decides like
+// it did. It returns the number of networks dropped.
+func removeCovered(nodes map[netip.Prefix]*optNode) int {
+	var covered []netip.Prefix
+	for p, node := range nodes {
+		parent := parentOf(nodes, p)
+		if parent == nil && node.nomatch || parent != nil && parent.sameAs(node) {
+			covered = append(covered, p)
+		}
+	}
+	for _, p := range covered {
+		delete(nodes, p)
+	}
+	return len(covered)
+}
+
+// mergeSiblings joins adjacent networks deciding the same way into their
+// parent network, if that is not in nodes yet. Networks are joined from
+// the most specific up, so that joined networks are joined further. The
+// halves of the address space are kept, hash:net rejects a prefix length
+// of 0. It returns the number of networks saved.
+func mergeSiblings(nodes map[netip.Prefix]*optNode) int {
+	var levels [129][]netip.Prefix
+	for p := range nodes {
+		levels[p.Bits()] = append(levels[p.Bits()], p)
+	}
+
+	merged := 0
+	for bits := len(levels) - 1; bits > 1; bits-- {
+		for _, p := range levels[bits] {
+			node, ok := nodes[p]
+			if !ok {
+				continue
+			}
+			parent := netip.PrefixFrom(p.Addr(), bits-1).Masked()
+			if _, ok := nodes[parent]; ok {
+				continue
+			}
+			addrBits := p.Addr().BitLen()
+			sibling := netip.PrefixFrom(toUint128(parent.Addr()).setBit(addrBits-bits).addr(addrBits), bits)
+			if sibling == p {
+				sibling = netip.PrefixFrom(parent.Addr(), bits)
+			}
+			other, ok := nodes[sibling]
+			if !ok || !other.sameAs(node) {
+				continue
+			}
+
+			delete(nodes, p)
+			delete(nodes, sibling)
+			nodes[parent] = &optNode{entry: optEntry(node.entry, parent), nomatch: node.nomatch, options: node.options}
+			levels[bits-1] = append(levels[bits-1], parent)
+			merged++
+		}
+	}
+	return merged
+}
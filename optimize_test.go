@@ -0,0 +1,170 @@
+package ipset
+
+import (
+	"math/rand"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// matches reports whether a matches the networks of entries, with the
+// most specific network deciding like in hash:net sets.
+func matches(entries Entries, a netip.Addr) bool {
+	best, match := -1, false
+	for _, e := range entries {
+		p, _ := e.Prefix()
+		if p.Masked().Contains(a) && p.Bits() > best {
+			best, match = p.Bits(), CadtFlags(e.CadtFlags.Get())&NoMatch == 0
+		}
+	}
+	return match
+}
+
+func prefixStrings(entries Entries) []string {
+	s := make([]string, len(entries))
+	for i, e := range entries {
+		p, _ := e.Prefix()
+		s[i] = p.String()
+		if CadtFlags(e.CadtFlags.Get())&NoMatch != 0 {
+			s[i] += " nomatch"
+		}
+	}
+	return s
+}
+
+func TestEntries_Optimize(t *testing.T) {
+	prefix := func(s string, options ...EntryOption) *Entry {
+		return NewEntry(append([]EntryOption{EntryPrefix(netip.MustParsePrefix(s))}, options...)...)
+	}
+	nomatch := EntryCadtFlags(uint32(NoMatch))
+
+	for _, tt := range []struct {
+		name    string
+		entries Entries
+		want    []string
+		report  OptimizeReport
+	}{
+		{
+			name:    "adjacent",
+			entries: Entries{prefix("10.0.0.0/25"), prefix("10.0.0.128/26"), prefix("10.0.0.192/26"), prefix("10.0.1.0/24")},
+			want:    []string{"10.0.0.0/23"},
+			report:  OptimizeReport{Merged: 3},
+		},
+		{
+			name:    "covered",
+			entries: Entries{prefix("10.0.0.1/32"), prefix("10.0.0.0/8"), prefix("10.0.0.0/8"), prefix("2001:db8::1/128"), prefix("2001:db8::/32")},
+			want:    []string{"10.0.0.0/8", "2001:db8::/32"},
+			report:  OptimizeReport{Covered: 3},
+		},
+		{
+			name:    "nomatch",
+			entries: Entries{prefix("10.0.0.0/24"), prefix("10.0.0.0/25", nomatch), prefix("10.0.0.0/26"), prefix("10.0.0.128/25"), prefix("10.1.0.0/16", nomatch)},
+			want:    []string{"10.0.0.0/24", "10.0.0.0/25 nomatch", "10.0.0.0/26"},
+			report:  OptimizeReport{Covered: 2},
+		},
+		{
+			name:    "nomatch siblings",
+			entries: Entries{prefix("10.0.0.0/24"), prefix("10.0.0.0/26", nomatch), prefix("10.0.0.64/26", nomatch)},
+			want:    []string{"10.0.0.0/24", "10.0.0.0/25 nomatch"},
+			report:  OptimizeReport{Merged: 1},
+		},
+		{
+			name:    "options",
+			entries: Entries{prefix("10.0.0.0/25"), prefix("10.0.0.128/25", EntryComment("x")), prefix("10.0.0.0/26", EntryTimeout(time.Minute))},
+			want:    []string{"10.0.0.0/25", "10.0.0.0/26", "10.0.0.128/25"},
+		},
+		{
+			name:    "halves",
+			entries: Entries{prefix("0.0.0.0/1"), prefix("128.0.0.0/2"), prefix("192.0.0.0/2"), prefix("::/1"), prefix("8000::/1")},
+			want:    []string{"0.0.0.0/1", "128.0.0.0/1", "::/1", "8000::/1"},
+			report:  OptimizeReport{Merged: 1},
+		},
+		{
+			name: "16 byte IPv4",
+			entries: Entries{
+				NewEntry(EntryIP(net.ParseIP("10.0.0.0")), EntryCidr(8)),
+				NewEntry(EntryIP(net.ParseIP("192.168.0.0")), EntryCidr(16)),
+				NewEntry(EntryIP(net.ParseIP("172.16.0.1"))),
+			},
+			want: []string{"10.0.0.0/8", "172.16.0.1/32", "192.168.0.0/16"},
+		},
+		{
+			name: "IPv4-mapped",
+			entries: Entries{
+				NewEntry(EntryIP(net.ParseIP("::ffff:10.0.0.0")), EntryCidr(104)),
+				NewEntry(EntryIP(net.ParseIP("10.1.0.0")), EntryCidr(16)),
+				NewEntry(EntryIP(net.ParseIP("192.168.0.0")), EntryCidr(16)),
+			},
+			want:   []string{"::ffff:10.0.0.0/104", "192.168.0.0/16"},
+			report: OptimizeReport{Covered: 1},
+		},
+		{
+			name: "range",
+			entries: Entries{
+				NewEntry(EntryAddrRange(netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.6"))),
+				NewEntry(EntryAddr(netip.MustParseAddr("10.0.0.0"))),
+				NewEntry(EntryAddr(netip.MustParseAddr("10.0.0.7"))),
+			},
+			want:   []string{"10.0.0.0/29"},
+			report: OptimizeReport{Merged: 5},
+		},
+	} {
+		got, report := tt.entries.Optimize()
+		assert.Equal(t, tt.want, prefixStrings(got), tt.name)
+		assert.Equal(t, tt.report, report, tt.name)
+	}
+}
+
+func TestEntries_OptimizeKeeps(t *testing.T) {
+	assert2 := assert.New(t)
+
+	kept := NewEntry(EntryPrefix(netip.MustParsePrefix("10.0.0.0/24")), EntryLineno(3))
+	port := NewEntry(EntryPrefix(netip.MustParsePrefix("10.0.0.0/25")), EntryPort(80))
+	entries := Entries{port, kept, NewEntry(EntryPrefix(netip.MustParsePrefix("10.0.0.0/25")))}
+
+	got, report := entries.Optimize()
+	assert2.Equal(Entries{kept, port}, got)
+	assert2.Equal(1, report.Eliminated())
+	assert2.Len(entries, 3)
+}
+
+func TestEntries_OptimizeRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		var entries Entries
+		for j := r.Intn(40); j >= 0; j-- {
+			bits := 24 + r.Intn(9)
+			p := netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(r.Intn(256))}), bits).Masked()
+			e := NewEntry(EntryPrefix(p))
+			if r.Intn(4) == 0 {
+				e.set(EntryCadtFlags(uint32(NoMatch)))
+			}
+			entries = append(entries, e)
+		}
+
+		// Later duplicates replace earlier ones.
+		seen := make(map[netip.Prefix]int)
+		var unique Entries
+		for _, e := range entries {
+			p, _ := e.Prefix()
+			if k, ok := seen[p]; ok {
+				unique[k] = e
+				continue
+			}
+			seen[p] = len(unique)
+			unique = append(unique, e)
+		}
+
+		got, report := entries.Optimize()
+		assert.Equal(t, len(entries)-len(got), report.Eliminated())
+		for a := 0; a < 256; a++ {
+			addr := netip.AddrFrom4([4]byte{10, 0, 0, byte(a)})
+			if !assert.Equal(t, matches(unique, addr), matches(got, addr), "%s in %v", addr, prefixStrings(entries)) {
+				return
+			}
+		}
+	}
+}
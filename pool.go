@@ -0,0 +1,174 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/netfilter"
+)
+
+// ErrPoolClosed is returned by Pool methods after the Pool was closed.
+var ErrPoolClosed = errors.New("ipset: pool closed")
+
+// Pool is a pool of Conns which is safe for concurrent use. Every call
+// borrows a Conn for its duration, so that concurrent calls use separate
+// netlink sockets and each socket matches responses to the sequence
+// numbers of its own requests. Calls wait for a Conn to become available
+// once all Conns are in use.
+type Pool struct {
+	dial  func() (*Conn, error)
+	slots chan struct{}
+
+	mu     sync.Mutex
+	idle   []*Conn
+	closed bool
+}
+
+// NewPool returns a Pool of up to size Conns, which are created by dial
+// as needed. A size below one is treated as one.
+func NewPool(size int, dial func() (*Conn, error)) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	return &Pool{
+		dial:  dial,
+		slots: make(chan struct{}, size),
+	}
+}
+
+// DialPool returns a Pool of up to size Conns opened by Dial. The first
+// Conn is opened right away, so that errors are reported early.
+func DialPool(family netfilter.ProtoFamily, config *netlink.Config, size int, options ...DialOption) (*Pool, error) {
+	p := NewPool(size, func() (*Conn, error) {
+		return Dial(family, config, options...)
+	})
+
+	c, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	p.idle = append(p.idle, c)
+	return p, nil
+}
+
+// Close closes the idle Conns of the pool. Conns in use are closed once
+// their call returns, further calls fail with ErrPoolClosed.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle, p.closed = nil, true
+	p.mu.Unlock()
+
+	var err error
+	for _, c := range idle {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Do calls fn with a Conn of the pool, waiting for one to become available
+// until ctx is done. fn must not use the Conn after it returns. A Conn for
+// which fn fails with an error other than one reported by the kernel or ctx
+// is closed instead of being reused.
+func (p *Pool) Do(ctx context.Context, fn func(c *Conn) error) error {
+	c, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = fn(c)
+	p.put(c, err)
+	return err
+}
+
+// Add is like Conn.Add, using a Conn of the pool.
+func (p *Pool) Add(name string, entries ...*Entry) error {
+	return p.AddContext(context.Background(), name, entries...)
+}
+
+// AddContext is like Conn.AddContext, using a Conn of the pool.
+func (p *Pool) AddContext(ctx context.Context, name string, entries ...*Entry) error {
+	return p.Do(ctx, func(c *Conn) error {
+		return c.AddContext(ctx, name, entries...)
+	})
+}
+
+// Delete is like Conn.Delete, using a Conn of the pool.
+func (p *Pool) Delete(name string, entries ...*Entry) error {
+	return p.DeleteContext(context.Background(), name, entries...)
+}
+
+// DeleteContext is like Conn.DeleteContext, using a Conn of the pool.
+func (p *Pool) DeleteContext(ctx context.Context, name string, entries ...*Entry) error {
+	return p.Do(ctx, func(c *Conn) error {
+		return c.DeleteContext(ctx, name, entries...)
+	})
+}
+
+// Test is like Conn.Test, using a Conn of the pool.
+func (p *Pool) Test(name string, options ...EntryOption) error {
+	return p.TestContext(context.Background(), name, options...)
+}
+
+// TestContext is like Conn.TestContext, using a Conn of the pool.
+func (p *Pool) TestContext(ctx context.Context, name string, options ...EntryOption) error {
+	return p.Do(ctx, func(c *Conn) error {
+		return c.TestContext(ctx, name, options...)
+	})
+}
+
+// get takes an idle Conn or dials a new one if the pool is not exhausted.
+func (p *Pool) get(ctx context.Context) (*Conn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.slots
+		return nil, ErrPoolClosed
+	}
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+	p.mu.Unlock()
+
+	c, err := p.dial()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return c, nil
+}
+
+// put returns c to the pool after a call which returned err.
+func (p *Pool) put(c *Conn, err error) {
+	p.mu.Lock()
+	if p.closed || !reusable(err) {
+		p.mu.Unlock()
+		c.Close()
+	} else {
+		p.idle = append(p.idle, c)
+		p.mu.Unlock()
+	}
+	<-p.slots
+}
+
+// reusable reports whether a Conn can be used further after a call
+// returned err. Errors not reported by the kernel may have left the
+// socket in an unknown state.
+func reusable(err error) bool {
+	var e *Error
+	return err == nil || errors.As(err, &e) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
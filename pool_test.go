@@ -0,0 +1,134 @@
+package ipset
+
+import (
+	"context"
+	stderrors "errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+// poolConn is a connector to a shared FakeKernel which counts
+// the connections in use and fails queries on request.
+type poolConn struct {
+	*FakeKernel
+
+	stats *poolStats
+	fail  bool
+}
+
+type poolStats struct {
+	dialed, closed, busy, maxBusy int32
+}
+
+func (c *poolConn) Close() error {
+	atomic.AddInt32(&c.stats.closed, 1)
+	return nil
+}
+
+func (c *poolConn) Query(nlm netlink.Message) ([]netlink.Message, error) {
+	busy := atomic.AddInt32(&c.stats.busy, 1)
+	defer atomic.AddInt32(&c.stats.busy, -1)
+	for {
+		max := atomic.LoadInt32(&c.stats.maxBusy)
+		if busy <= max || atomic.CompareAndSwapInt32(&c.stats.maxBusy, max, busy) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+
+	if c.fail {
+		return nil, stderrors.New("broken socket")
+	}
+	return c.FakeKernel.Query(nlm)
+}
+
+func newTestPool(size int) (*Pool, *poolStats, *[]*poolConn) {
+	k := NewFakeKernel()
+	stats := &poolStats{}
+	var (
+		mu    sync.Mutex
+		conns []*poolConn
+	)
+	p := NewPool(size, func() (*Conn, error) {
+		atomic.AddInt32(&stats.dialed, 1)
+		pc := &poolConn{FakeKernel: k, stats: stats}
+		mu.Lock()
+		conns = append(conns, pc)
+		mu.Unlock()
+		return &Conn{Family: netfilter.ProtoIPv4, Conn: pc}, nil
+	})
+	return p, stats, &conns
+}
+
+func TestPool_Concurrent(t *testing.T) {
+	assert2 := assert.New(t)
+	p, stats, _ := newTestPool(4)
+
+	assert2.NoError(p.Do(context.Background(), func(c *Conn) error {
+		return c.Create("foo", "hash:ip", 6, netfilter.ProtoIPv4)
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip := net.IPv4(10, 0, 0, byte(i))
+			assert2.NoError(p.Add("foo", NewEntry(EntryIP(ip))))
+			assert2.NoError(p.Test("foo", EntryIP(ip)))
+			if i%2 == 0 {
+				assert2.NoError(p.Delete("foo", NewEntry(EntryIP(ip))))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert2.NoError(p.Do(context.Background(), func(c *Conn) error {
+		s, err := c.List("foo")
+		if err == nil {
+			assert2.Len(s.Entries, 25)
+		}
+		return err
+	}))
+
+	// No more than four Conns are dialed and used at once.
+	dialed := atomic.LoadInt32(&stats.dialed)
+	assert2.True(dialed <= 4)
+	assert2.True(atomic.LoadInt32(&stats.maxBusy) <= 4)
+
+	assert2.NoError(p.Close())
+	assert2.Equal(dialed, atomic.LoadInt32(&stats.closed))
+	assert2.Equal(ErrPoolClosed, p.Add("foo"))
+}
+
+func TestPool_Errors(t *testing.T) {
+	assert2 := assert.New(t)
+	p, stats, conns := newTestPool(1)
+
+	// Errors reported by the kernel keep the Conn.
+	err := p.Test("foo", EntryIP(net.ParseIP("10.0.0.1")))
+	assert2.True(stderrors.Is(err, ErrSetNotFound))
+	assert2.Equal(int32(0), atomic.LoadInt32(&stats.closed))
+
+	// Other errors discard it.
+	(*conns)[0].fail = true
+	assert2.EqualError(p.Test("foo", EntryIP(net.ParseIP("10.0.0.1"))), "broken socket")
+	assert2.Equal(int32(1), atomic.LoadInt32(&stats.closed))
+	assert2.True(stderrors.Is(p.Test("foo", EntryIP(net.ParseIP("10.0.0.1"))), ErrSetNotFound))
+	assert2.Equal(int32(2), atomic.LoadInt32(&stats.dialed))
+
+	// Waiting for a Conn is aborted with the context.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = p.Do(context.Background(), func(*Conn) error {
+		return p.TestContext(ctx, "foo", EntryIP(net.ParseIP("10.0.0.1")))
+	})
+	assert2.Equal(context.DeadlineExceeded, err)
+}
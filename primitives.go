@@ -43,6 +43,9 @@ func (b *UInt8Box) String() string {
 }
 
 // Uint16
+//
+// The kernel expects integers wider than a byte in network byte order,
+// which is how all integer boxes below are marshalled.
 type UInt16Box struct{ Value uint16 }
 
 func NewUInt16Box(v uint16) *UInt16Box {
@@ -54,7 +57,10 @@ func unmarshalUInt16Box(nfa netfilter.Attribute) *UInt16Box {
 }
 
 func (b *UInt16Box) marshal(t AttributeType) (nfa netfilter.Attribute) {
-	nfa.Type = uint16(t)
+	nfa = netfilter.Attribute{
+		Type:         uint16(t),
+		NetByteOrder: true,
+	}
 	nfa.PutUint16(b.Value)
 	return
 }
@@ -89,7 +95,10 @@ func unmarshalUInt32Box(nfa netfilter.Attribute) *UInt32Box {
 }
 
 func (b *UInt32Box) marshal(t AttributeType) (nfa netfilter.Attribute) {
-	nfa.Type = uint16(t)
+	nfa = netfilter.Attribute{
+		Type:         uint16(t),
+		NetByteOrder: true,
+	}
 	nfa.PutUint32(b.Value)
 	return
 }
@@ -128,7 +137,10 @@ func (b *UInt64Box) unmarshal(nfa netfilter.Attribute) {
 }
 
 func (b *UInt64Box) marshal(t AttributeType) (nfa netfilter.Attribute) {
-	nfa.Type = uint16(t)
+	nfa = netfilter.Attribute{
+		Type:         uint16(t),
+		NetByteOrder: true,
+	}
 	nfa.PutUint64(b.Value)
 	return
 }
@@ -0,0 +1,37 @@
+package ipset
+
+import (
+	"encoding/binary"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+func TestIntegerBoxes_NetByteOrder(t *testing.T) {
+	assert2 := assert.New(t)
+
+	for _, tt := range []struct {
+		box  marshaller
+		want []byte
+	}{
+		{NewUInt16Box(0x0102), []byte{0x01, 0x02}},
+		{NewUInt32Box(0x01020304), []byte{0x01, 0x02, 0x03, 0x04}},
+		{NewUInt64Box(0x0102030405060708), []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}},
+	} {
+		nfa := tt.box.marshal(AttrMaxElem)
+		assert2.True(nfa.NetByteOrder, "%T", tt.box)
+
+		// The kernel rejects integers without the flag.
+		nlm, err := netfilter.MarshalNetlink(netfilter.Header{}, []netfilter.Attribute{nfa})
+		if !assert2.NoError(err) {
+			continue
+		}
+		data := nlm.Data[4:]
+		typ := binary.LittleEndian.Uint16(data[2:])
+		assert2.Equal(uint16(syscall.NLA_F_NET_BYTEORDER), typ&syscall.NLA_F_NET_BYTEORDER, "%T", tt.box)
+		assert2.Equal(uint16(AttrMaxElem), typ&^syscall.NLA_F_NET_BYTEORDER, "%T", tt.box)
+		assert2.Equal(tt.want, data[syscall.NLA_HDRLEN:syscall.NLA_HDRLEN+len(tt.want)], "%T", tt.box)
+	}
+}
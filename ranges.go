@@ -0,0 +1,198 @@
+package ipset
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+)
+
+// RangePrefixes returns the shortest list of networks covering the
+// addresses from first to last, in ascending order. This is how the
+// kernel stores ranges added to hash:net types. Networks with a prefix
+// length of 0, which hash:net types reject, are never returned: the whole
+// address space is covered by its two halves, even though the kernel
+// rejects that range with ErrInvalidRange. Reversed ranges are swapped,
+// nil is returned if the addresses are of different families.
+func RangePrefixes(first, last netip.Addr) []netip.Prefix {
+	first, last = first.Unmap(), last.Unmap()
+	if !first.IsValid() || first.BitLen() != last.BitLen() {
+		return nil
+	}
+	if last.Less(first) {
+		first, last = last, first
+	}
+
+	addrBits := first.BitLen()
+	from, to := toUint128(first), toUint128(last)
+
+	var prefixes []netip.Prefix
+	for {
+		// The network is limited by the alignment of from
+		// and the number of addresses left.
+		host := from.trailingZeros()
+		if n := to.sub(from).add(uint128{lo: 1}).log2(); n < host {
+			host = n
+		}
+		if host > addrBits-1 {
+			host = addrBits - 1
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(from.addr(addrBits), addrBits-host))
+
+		next := from.add(uint128{}.setBit(host))
+		if to.less(next) || next.less(from) {
+			return prefixes
+		}
+		from = next
+	}
+}
+
+// ExpandRanges returns the entries with the address ranges of network
+// dimensions split into networks by RangePrefixes, the way the kernel
+// splits them on add and delete. Entries without ranges are returned
+// as they are. Other options, like NoMatch or a timeout, are kept for
+// each network.
+//
+// Like the kernel, ExpandRanges rejects a range covering the whole address
+// space. The returned *Error holds the entry, its line number or position
+// starting at 1, and ErrInvalidRange.
+func (t *SetType) ExpandRanges(entries []*Entry) ([]*Entry, error) {
+	var first, second bool
+	ipDims := 0
+	for _, dim := range t.dims {
+		if dim != "ip" && dim != "net" {
+			continue
+		}
+		if dim == "net" {
+			if ipDims == 0 {
+				first = true
+			} else {
+				second = true
+			}
+		}
+		ipDims++
+	}
+	if !first && !second {
+		return entries, nil
+	}
+
+	expanded := make([]*Entry, 0, len(entries))
+	for i, e := range entries {
+		res, ok := []*Entry{e}, true
+		if first && e.IPTo.IsSet() {
+			res, ok = expandRange(res, e.IP, e.IPTo, func(c *Entry, p netip.Prefix) {
+				c.IPTo = nil
+				c.set(EntryPrefix(p))
+			})
+		}
+		if ok && second && e.IP2To.IsSet() {
+			res, ok = expandRange(res, e.IP2, e.IP2To, func(c *Entry, p netip.Prefix) {
+				c.IP2To = nil
+				c.set(EntryPrefix2(p))
+			})
+		}
+		if !ok {
+			line := uint32(i + 1)
+			if e.Lineno.IsSet() {
+				line = e.Lineno.Get()
+			}
+			return nil, &Error{Entry: e, Line: line, Err: ErrInvalidRange}
+		}
+		expanded = append(expanded, res...)
+	}
+	return expanded, nil
+}
+
+// expandRange returns a copy of each entry for each network of the
+// range ip to, set by apply. It returns false if the range covers the
+// whole address space.
+func expandRange(entries []*Entry, ip, to *IPAddrBox, apply func(*Entry, netip.Prefix)) ([]*Entry, bool) {
+	prefixes := RangePrefixes(ip.Addr(), to.Addr())
+	if prefixes == nil {
+		// Leave invalid ranges to the kernel to reject.
+		return entries, true
+	}
+	if len(prefixes) == 2 && prefixes[0].Bits() == 1 && prefixes[1].Bits() == 1 {
+		return nil, false
+	}
+
+	res := make([]*Entry, 0, len(entries)*len(prefixes))
+	for _, e := range entries {
+		for _, p := range prefixes {
+			c := *e
+			apply(&c, p)
+			res = append(res, &c)
+		}
+	}
+	return res, true
+}
+
+// uint128 is an IPv4 or IPv6 address as number.
+type uint128 struct{ hi, lo uint64 }
+
+func toUint128(a netip.Addr) uint128 {
+	if a.Is4() {
+		b := a.As4()
+		return uint128{lo: uint64(binary.BigEndian.Uint32(b[:]))}
+	}
+	b := a.As16()
+	return uint128{hi: binary.BigEndian.Uint64(b[:8]), lo: binary.BigEndian.Uint64(b[8:])}
+}
+
+func (u uint128) addr(addrBits int) netip.Addr {
+	if addrBits == 32 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(u.lo))
+		return netip.AddrFrom4(b)
+	}
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], u.hi)
+	binary.BigEndian.PutUint64(b[8:], u.lo)
+	return netip.AddrFrom16(b)
+}
+
+func (u uint128) less(v uint128) bool {
+	return u.hi < v.hi || u.hi == v.hi && u.lo < v.lo
+}
+
+func (u uint128) add(v uint128) uint128 {
+	lo, carry := bits.Add64(u.lo, v.lo, 0)
+	hi, _ := bits.Add64(u.hi, v.hi, carry)
+	return uint128{hi, lo}
+}
+
+func (u uint128) sub(v uint128) uint128 {
+	lo, borrow := bits.Sub64(u.lo, v.lo, 0)
+	hi, _ := bits.Sub64(u.hi, v.hi, borrow)
+	return uint128{hi, lo}
+}
+
+// setBit returns u with bit n set, or u for n >= 128.
+func (u uint128) setBit(n int) uint128 {
+	switch {
+	case n < 64:
+		u.lo |= 1 << uint(n)
+	case n < 128:
+		u.hi |= 1 << uint(n-64)
+	}
+	return u
+}
+
+func (u uint128) trailingZeros() int {
+	if u.lo != 0 {
+		return bits.TrailingZeros64(u.lo)
+	}
+	return 64 + bits.TrailingZeros64(u.hi)
+}
+
+// log2 returns the integer binary logarithm of u, the number of host
+// bits of the largest network with at most u addresses. Zero stands
+// for 1<<128 and returns 128.
+func (u uint128) log2() int {
+	if u.hi != 0 {
+		return 63 + bits.Len64(u.hi)
+	}
+	if u.lo != 0 {
+		return bits.Len64(u.lo) - 1
+	}
+	return 128
+}
@@ -0,0 +1,162 @@
+package ipset
+
+import (
+	stderrors "errors"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+func parsePrefixes(s ...string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, len(s))
+	for i := range s {
+		prefixes[i] = netip.MustParsePrefix(s[i])
+	}
+	return prefixes
+}
+
+func TestRangePrefixes(t *testing.T) {
+	for _, tt := range []struct {
+		first, last string
+		want        []netip.Prefix
+	}{
+		{"10.0.0.1", "10.0.0.1", parsePrefixes("10.0.0.1/32")},
+		{"10.0.0.0", "10.0.0.255", parsePrefixes("10.0.0.0/24")},
+		{"10.0.0.1", "10.0.0.10", parsePrefixes("10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/30", "10.0.0.8/31", "10.0.0.10/32")},
+		{"10.0.0.10", "10.0.0.1", parsePrefixes("10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/30", "10.0.0.8/31", "10.0.0.10/32")},
+		{"9.255.255.255", "10.0.0.0", parsePrefixes("9.255.255.255/32", "10.0.0.0/32")},
+		{"0.0.0.0", "255.255.255.255", parsePrefixes("0.0.0.0/1", "128.0.0.0/1")},
+		{"255.255.255.254", "255.255.255.255", parsePrefixes("255.255.255.254/31")},
+		{"::ffff:10.0.0.0", "10.0.0.1", parsePrefixes("10.0.0.0/31")},
+		{"2001:db8::", "2001:db8::1:0", parsePrefixes("2001:db8::/112", "2001:db8::1:0/128")},
+		{"::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", parsePrefixes("::/1", "8000::/1")},
+		{"10.0.0.1", "2001:db8::", nil},
+	} {
+		got := RangePrefixes(netip.MustParseAddr(tt.first), netip.MustParseAddr(tt.last))
+		assert.Equal(t, tt.want, got, "%s-%s", tt.first, tt.last)
+	}
+
+	// All but the first address take one network per bit.
+	got := RangePrefixes(netip.MustParseAddr("::1"), netip.MustParseAddr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"))
+	if assert.Len(t, got, 128) {
+		assert.Equal(t, netip.MustParsePrefix("::1/128"), got[0])
+		assert.Equal(t, netip.MustParsePrefix("8000::/1"), got[127])
+	}
+}
+
+func TestSetType_ExpandRanges(t *testing.T) {
+	assert2 := assert.New(t)
+	addr := netip.MustParseAddr
+
+	entries := []*Entry{
+		NewEntry(EntryAddrRange(addr("10.0.0.0"), addr("10.0.0.2")), EntryCadtFlags(uint32(NoMatch))),
+		NewEntry(EntryPrefix(netip.MustParsePrefix("10.1.0.0/16"))),
+	}
+	expanded, err := HashNet.ExpandRanges(entries)
+	assert2.NoError(err)
+	if assert2.Len(expanded, 3) {
+		for i, want := range []string{"10.0.0.0/31", "10.0.0.2/32", "10.1.0.0/16"} {
+			p, _ := expanded[i].Prefix()
+			assert2.Equal(netip.MustParsePrefix(want), p)
+			assert2.False(expanded[i].IPTo.IsSet())
+		}
+		assert2.Equal(uint32(NoMatch), expanded[1].CadtFlags.Get())
+		assert2.True(entries[1] == expanded[2])
+	}
+	// The entries passed in are left alone.
+	assert2.True(entries[0].IPTo.IsSet())
+
+	// Both dimensions are expanded.
+	expanded, err = HashNetNet.ExpandRanges([]*Entry{NewEntry(
+		EntryAddrRange(addr("10.0.0.0"), addr("10.0.0.2")),
+		EntryIP2(addr("10.2.0.0").AsSlice()), EntryIP2To(addr("10.2.0.1").AsSlice()),
+	)})
+	assert2.NoError(err)
+	if assert2.Len(expanded, 2) {
+		p, _ := expanded[1].Prefix2()
+		assert2.Equal(netip.MustParsePrefix("10.2.0.0/31"), p)
+	}
+
+	// The kernel rejects the whole address space.
+	entries = []*Entry{
+		NewEntry(EntryPrefix(netip.MustParsePrefix("10.1.0.0/16"))),
+		NewEntry(EntryAddrRange(addr("255.255.255.255"), addr("0.0.0.0"))),
+	}
+	expanded, err = HashNet.ExpandRanges(entries)
+	assert2.Nil(expanded)
+	assert2.True(stderrors.Is(err, ErrInvalidRange))
+	var e *Error
+	if assert2.True(stderrors.As(err, &e)) {
+		assert2.Equal(uint32(2), e.Line)
+		assert2.True(entries[1] == e.Entry)
+	}
+	_, err = HashNet.ExpandRanges([]*Entry{NewEntry(EntryAddrRange(addr("::"), addr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")))})
+	assert2.True(stderrors.Is(err, ErrInvalidRange))
+
+	// Addresses of ip dimensions are expanded by the kernel.
+	entries = []*Entry{NewEntry(EntryAddrRange(addr("10.0.0.0"), addr("10.0.0.2")))}
+	expanded, err = HashIP.ExpandRanges(entries)
+	assert2.NoError(err)
+	assert2.Equal(entries, expanded)
+	entries = []*Entry{NewEntry(
+		EntryAddrRange(addr("10.0.0.0"), addr("10.0.0.2")),
+		EntryIP2(addr("10.2.0.0").AsSlice()), EntryIP2To(addr("10.2.0.1").AsSlice()),
+	)}
+	expanded, err = HashIPPortNet.ExpandRanges(entries)
+	assert2.NoError(err)
+	assert2.Len(expanded, 1)
+}
+
+func TestSet_ExpandRanges(t *testing.T) {
+	assert2 := assert.New(t)
+	c, _ := newFakeConn()
+	addr := netip.MustParseAddr
+
+	s := c.Set("foo", HashNet)
+	s.ExpandRanges = true
+	assert2.NoError(s.Create(netfilter.ProtoIPv4, CreateDataMaxElem(3)))
+
+	assert2.NoError(s.Add(NewEntry(EntryAddrRange(addr("10.0.0.1"), addr("10.0.0.2")))))
+	prefixes, err := c.Prefixes("foo")
+	if assert2.NoError(err) {
+		assert2.ElementsMatch(parsePrefixes("10.0.0.1/32", "10.0.0.2/32"), prefixes)
+	}
+
+	// Errors refer to the entry passed in.
+	entries := []*Entry{
+		NewEntry(EntryAddr(addr("10.1.0.0"))),
+		NewEntry(EntryAddrRange(addr("10.2.0.1"), addr("10.2.0.2"))),
+	}
+	err = s.Add(entries...)
+	assert2.True(stderrors.Is(err, ErrHashFull))
+	var e *Error
+	if assert2.True(stderrors.As(err, &e)) {
+		assert2.Equal(uint32(2), e.Line)
+		assert2.True(entries[1] == e.Entry)
+		assert2.Equal(1, e.Applied)
+	}
+
+	assert2.NoError(s.DeleteExclusive(NewEntry(EntryAddrRange(addr("10.0.0.1"), addr("10.0.0.2")))))
+	prefixes, err = c.Prefixes("foo")
+	if assert2.NoError(err) {
+		assert2.ElementsMatch(parsePrefixes("10.1.0.0/32"), prefixes)
+	}
+
+	// The whole address space is refused before anything is sent.
+	full := NewEntry(EntryAddrRange(addr("0.0.0.0"), addr("255.255.255.255")))
+	err = s.Add(NewEntry(EntryAddr(addr("10.3.0.0"))), full)
+	assert2.True(stderrors.Is(err, ErrInvalidRange))
+	if assert2.True(stderrors.As(err, &e)) {
+		assert2.Equal(CmdAdd, e.Cmd)
+		assert2.Equal("foo", e.Set)
+		assert2.Equal(uint32(2), e.Line)
+		assert2.True(full == e.Entry)
+		assert2.Equal(0, e.Applied)
+	}
+	prefixes, err = c.Prefixes("foo")
+	if assert2.NoError(err) {
+		assert2.ElementsMatch(parsePrefixes("10.1.0.0/32"), prefixes)
+	}
+}
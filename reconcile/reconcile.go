@@ -0,0 +1,344 @@
+// Package reconcile converges the sets of the kernel to a desired state.
+//
+// Reconcile compares the desired sets with the sets listed by the kernel
+// and computes a Plan of the create, add, del and destroy commands
+// required. The plan is either applied or, in a dry run, only returned
+// for inspection.
+package reconcile
+
+import (
+	"errors"
+	"io"
+	"net/netip"
+	"strings"
+
+	ipset "github.com/digineo/go-ipset/v2"
+	"github.com/digineo/go-ipset/v2/restore"
+	"github.com/ti-mo/netfilter"
+)
+
+// Set is the desired state of a single set.
+type Set struct {
+	// CreatePolicy holds the name, type and create options of the set.
+	// If the revision is not set, the latest revision supported by the
+	// kernel is used.
+	ipset.CreatePolicy
+
+	Entries ipset.Entries
+}
+
+// NewSet returns a Set of the given type holding the given entries.
+// If family is netfilter.ProtoUnspec, the family of existing sets is
+// not compared.
+func NewSet(name, typeName string, family netfilter.ProtoFamily, entries ipset.Entries, options ...ipset.CreateDataOption) Set {
+	data := &ipset.CreateData{}
+	for _, option := range options {
+		option(data)
+	}
+
+	s := Set{
+		CreatePolicy: ipset.CreatePolicy{
+			HeaderPolicy: ipset.HeaderPolicy{
+				NamePolicy: ipset.NamePolicy{
+					BasePolicy: ipset.BasePolicy{Protocol: ipset.NewUInt8Box(ipset.Protocol)},
+					Name:       ipset.NewNullStringBox(name),
+				},
+				TypeName: ipset.NewNullStringBox(typeName),
+				Data:     data,
+			},
+		},
+		Entries: entries,
+	}
+	if family != netfilter.ProtoUnspec {
+		s.Family = ipset.NewUInt8Box(uint8(family))
+	}
+	return s
+}
+
+// Plan holds the commands converging the kernel to the desired state.
+type Plan struct {
+	Commands []restore.Command
+
+	// types holds the types of the modified sets, as required
+	// to print their elements.
+	types map[string]string
+}
+
+func (p *Plan) append(cmds ...restore.Command) {
+	p.Commands = append(p.Commands, cmds...)
+}
+
+// WriteTo writes the plan in the format of a restore file.
+func (p Plan) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	enc := restore.NewEncoder(cw)
+	for name, typeName := range p.types {
+		enc.SetType(name, typeName)
+	}
+	for i := range p.Commands {
+		if err := enc.Encode(&p.Commands[i]); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+func (p Plan) String() string {
+	var b strings.Builder
+	if _, err := p.WriteTo(&b); err != nil {
+		return err.Error()
+	}
+	return b.String()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+type options struct {
+	dryRun bool
+	prune  func(name string) bool
+}
+
+// Option configures Reconcile.
+type Option func(o *options)
+
+// DryRun computes the plan without applying it.
+func DryRun() Option {
+	return func(o *options) { o.dryRun = true }
+}
+
+// Prune destroys the existing sets missing in the desired state for which
+// fn returns true. Without it, sets are never destroyed unless they have to
+// be recreated with another type.
+func Prune(fn func(name string) bool) Option {
+	return func(o *options) { o.prune = fn }
+}
+
+// Reconcile converges the sets of c to desired and returns the plan it
+// applied. If applying the plan fails, the commands preceding the failing
+// one have been applied.
+func Reconcile(c *ipset.Conn, desired []Set, opts ...Option) (Plan, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	current, err := c.ListAll()
+	if err != nil {
+		return Plan{}, err
+	}
+
+	plan, err := Compute(current, desired, o.prune)
+	if err != nil || o.dryRun {
+		return plan, nil
+	}
+	return plan, restore.Apply(c, plan.Commands)
+}
+
+// Compute returns the plan converging the current sets to the desired ones.
+// Existing sets missing in desired are destroyed if prune is not nil and
+// returns true for their name.
+//
+// Entries are compared by their element only, so entries differing in
+// options like timeout or comment are left unchanged. Address ranges of
+// network types are split into networks first, the way the kernel stores
+// them. Other ranges, like those of addresses in hash:ip sets or of ports,
+// are rejected with ErrRange, as the kernel stores each of their elements.
+//
+// Sets are recreated if their type or family differs, or if the create
+// options set in desired differ from the listed ones. The hash size and
+// bucket size are not compared, as the kernel adjusts them.
+func Compute(current []ipset.SetPolicy, desired []Set, prune func(name string) bool) (Plan, error) {
+	existing := make(map[string]*ipset.SetPolicy, len(current))
+	for i := range current {
+		existing[current[i].Name.Get()] = &current[i]
+	}
+
+	plan := Plan{types: make(map[string]string)}
+	wanted := make(map[string]bool, len(desired))
+	for i := range desired {
+		d := &desired[i]
+		name := d.Name.Get()
+		wanted[name] = true
+
+		entries, err := desiredEntries(d)
+		if err != nil {
+			return Plan{}, err
+		}
+
+		cur := existing[name]
+		if cur != nil && (!sameType(cur, d) || !sameData(cur.Data, d.Data)) {
+			plan.append(restore.Command{Op: restore.OpDestroy, Set: name})
+			cur = nil
+		}
+
+		if cur == nil {
+			create := d.CreatePolicy
+			plan.append(restore.Command{Op: restore.OpCreate, Set: name, Create: &create})
+			for _, e := range entries {
+				plan.append(restore.Command{Op: restore.OpAdd, Set: name, Entry: e})
+			}
+			continue
+		}
+
+		plan.types[name] = cur.TypeName.Get()
+		plan.append(diffEntries(name, cur.Entries, entries)...)
+	}
+
+	if prune != nil {
+		for i := range current {
+			name := current[i].Name.Get()
+			if !wanted[name] && prune(name) {
+				plan.append(restore.Command{Op: restore.OpDestroy, Set: name})
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+func sameType(cur *ipset.SetPolicy, d *Set) bool {
+	if cur.TypeName.Get() != d.TypeName.Get() {
+		return false
+	}
+	return !d.Family.IsSet() || cur.Family.Get() == d.Family.Get()
+}
+
+// extensions are the create flags enabling extensions of the entries.
+const extensions = ipset.WithCounters | ipset.WithComment | ipset.WithForceDdd | ipset.WithSkbInfo
+
+// sameData reports whether the create options set in want match the
+// listed options cur. The extensions enabled have to match exactly.
+func sameData(cur, want *ipset.CreateData) bool {
+	if want == nil {
+		want = &ipset.CreateData{}
+	}
+	if cur == nil {
+		cur = &ipset.CreateData{}
+	}
+
+	if ipset.CadtFlags(cur.CadtFlags.Get())&extensions != ipset.CadtFlags(want.CadtFlags.Get())&extensions {
+		return false
+	}
+	switch {
+	case want.MaxElem.IsSet() && want.MaxElem.Get() != cur.MaxElem.Get(),
+		want.Timeout.IsSet() && want.Timeout.Get() != cur.Timeout.Get(),
+		want.NetMask.IsSet() && want.NetMask.Get() != cur.NetMask.Get(),
+		want.MarkMask.IsSet() && want.MarkMask.Get() != cur.MarkMask.Get(),
+		want.InitVal.IsSet() && want.InitVal.Get() != cur.InitVal.Get(),
+		want.Size.IsSet() && want.Size.Get() != cur.Size.Get(),
+		want.Port.IsSet() && want.Port.Get() != cur.Port.Get(),
+		want.PortTo.IsSet() && want.PortTo.Get() != cur.PortTo.Get():
+		return false
+	}
+	return !want.IP.IsSet() || sameRange(cur, want)
+}
+
+// sameRange reports whether the address range of a bitmap set matches.
+// The kernel lists a range given as network by its first and last address.
+func sameRange(cur, want *ipset.CreateData) bool {
+	first, last := cur.IP.Addr(), cur.IPTo.Addr()
+	if !want.Cidr.IsSet() {
+		return first == want.IP.Addr() && last == want.IPTo.Addr()
+	}
+	p := netip.PrefixFrom(want.IP.Addr(), int(want.Cidr.Get())).Masked()
+	return first == p.Addr() && p.Contains(last) && !p.Contains(last.Next())
+}
+
+// ErrRange is returned by Compute for desired entries the kernel would
+// store as several elements, other than ranges of networks.
+var ErrRange = errors.New("ranges are only supported for networks")
+
+// desiredEntries returns the entries of d with the address ranges of its
+// network dimensions split into networks. The returned *ipset.Error holds
+// the offending entry and its line number or position starting at 1.
+func desiredEntries(d *Set) (ipset.Entries, error) {
+	name, typeName := d.Name.Get(), d.TypeName.Get()
+
+	firstIP, secondIP := addressDims(typeName)
+	for i, e := range d.Entries {
+		if e.PortTo.IsSet() && e.PortTo.Get() != e.Port.Get() ||
+			firstIP && (e.IPTo.IsSet() || isNetwork(e.IP, e.Cidr)) ||
+			secondIP && (e.IP2To.IsSet() || isNetwork(e.IP2, e.Cidr2)) {
+			line := uint32(i + 1)
+			if e.Lineno.IsSet() {
+				line = e.Lineno.Get()
+			}
+			return nil, &ipset.Error{Cmd: ipset.CmdAdd, Set: name, Entry: e, Line: line, Err: ErrRange}
+		}
+	}
+
+	t := ipset.LookupSetType(typeName)
+	if t == nil {
+		return d.Entries, nil
+	}
+	entries, err := t.ExpandRanges(d.Entries)
+	if err != nil {
+		var e *ipset.Error
+		if errors.As(err, &e) {
+			e.Cmd, e.Set = ipset.CmdAdd, name
+		}
+		return nil, err
+	}
+	return entries, nil
+}
+
+// addressDims reports which of the address dimensions of a set type
+// hold single addresses rather than networks.
+func addressDims(typeName string) (first, second bool) {
+	i := strings.IndexByte(typeName, ':')
+	n := 0
+	for _, dim := range strings.Split(typeName[i+1:], ",") {
+		if dim != "ip" && dim != "net" {
+			continue
+		}
+		if n == 0 {
+			first = dim == "ip"
+		} else {
+			second = dim == "ip"
+		}
+		n++
+	}
+	return first, second
+}
+
+// isNetwork reports whether ip and cidr denote more than a single address.
+func isNetwork(ip *ipset.IPAddrBox, cidr *ipset.UInt8Box) bool {
+	return cidr.IsSet() && ip.IsSet() && int(cidr.Get()) < ip.Addr().BitLen()
+}
+
+// diffEntries returns the del commands for the current entries missing
+// in desired, followed by the add commands for the missing desired ones.
+func diffEntries(name string, current, desired ipset.Entries) []restore.Command {
+	have := make(map[string]bool, len(current))
+	for _, e := range current {
+		have[e.ElementKey()] = true
+	}
+	want := make(map[string]bool, len(desired))
+	for _, e := range desired {
+		want[e.ElementKey()] = true
+	}
+
+	var cmds []restore.Command
+	for _, e := range current {
+		if !want[e.ElementKey()] {
+			cmds = append(cmds, restore.Command{Op: restore.OpDel, Set: name, Entry: e.Element()})
+		}
+	}
+	for _, e := range desired {
+		k := e.ElementKey()
+		if !have[k] {
+			cmds = append(cmds, restore.Command{Op: restore.OpAdd, Set: name, Entry: e})
+			have[k] = true
+		}
+	}
+	return cmds
+}
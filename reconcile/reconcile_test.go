@@ -0,0 +1,262 @@
+package reconcile
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	ipset "github.com/digineo/go-ipset/v2"
+	"github.com/digineo/go-ipset/v2/restore"
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+func current(name, typeName string, family netfilter.ProtoFamily, entries ...*ipset.Entry) ipset.SetPolicy {
+	return ipset.SetPolicy{
+		HeaderPolicy: ipset.HeaderPolicy{
+			NamePolicy: ipset.NamePolicy{Name: ipset.NewNullStringBox(name)},
+			TypeName:   ipset.NewNullStringBox(typeName),
+			Revision:   ipset.NewUInt8Box(4),
+			Family:     ipset.NewUInt8Box(uint8(family)),
+		},
+		Entries: entries,
+	}
+}
+
+func ip(s string, options ...ipset.EntryOption) *ipset.Entry {
+	return ipset.NewEntry(append([]ipset.EntryOption{ipset.EntryIP(net.ParseIP(s))}, options...)...)
+}
+
+func TestCompute(t *testing.T) {
+	assert2 := assert.New(t)
+
+	cur := []ipset.SetPolicy{
+		current("keep", "hash:ip", netfilter.ProtoIPv4,
+			ip("10.0.0.1", ipset.EntryTimeout(time.Minute)),
+			ip("10.0.0.2"),
+		),
+		current("nets", "hash:net", netfilter.ProtoIPv4,
+			ip("10.1.0.0", ipset.EntryCidr(16)),
+			ip("10.2.0.1", ipset.EntryCidr(32)),
+		),
+		current("retype", "hash:ip", netfilter.ProtoIPv4),
+		current("managed-old", "hash:ip", netfilter.ProtoIPv4),
+		current("foreign", "hash:ip", netfilter.ProtoIPv4),
+	}
+	desired := []Set{
+		NewSet("keep", "hash:ip", netfilter.ProtoIPv4, ipset.Entries{
+			ip("10.0.0.1"),
+			ip("10.0.0.3"),
+		}),
+		NewSet("nets", "hash:net", netfilter.ProtoIPv4, ipset.Entries{
+			ip("10.1.0.0", ipset.EntryCidr(16)),
+			ip("10.2.0.1"),
+		}),
+		NewSet("retype", "hash:net", netfilter.ProtoUnspec, nil),
+		NewSet("new", "hash:ip", netfilter.ProtoIPv6, ipset.Entries{ip("2001:db8::1")},
+			ipset.CreateDataHashSize(64)),
+	}
+
+	plan, err := Compute(cur, desired, func(name string) bool {
+		return len(name) > 8 && name[:8] == "managed-"
+	})
+	assert2.NoError(err)
+
+	var ops []string
+	for _, c := range plan.Commands {
+		ops = append(ops, c.Op.String()+" "+c.Set)
+	}
+	assert2.Equal([]string{
+		"del keep",
+		"add keep",
+		"destroy retype",
+		"create retype",
+		"create new",
+		"add new",
+		"destroy managed-old",
+	}, ops)
+
+	assert2.Equal(`del keep 10.0.0.2
+add keep 10.0.0.3
+destroy retype
+create retype hash:net
+create new hash:ip family inet6 hashsize 64
+add new 2001:db8::1
+destroy managed-old
+`, plan.String())
+}
+
+func TestCompute_Converged(t *testing.T) {
+	assert2 := assert.New(t)
+
+	cur := []ipset.SetPolicy{
+		current("foo", "hash:ip", netfilter.ProtoIPv4, ip("10.0.0.1"), ip("::ffff:10.0.0.2")),
+	}
+	desired := []Set{
+		NewSet("foo", "hash:ip", netfilter.ProtoUnspec, ipset.Entries{ip("10.0.0.2"), ip("10.0.0.1")}),
+	}
+
+	plan, err := Compute(cur, desired, func(string) bool { return true })
+	assert2.NoError(err)
+	assert2.Empty(plan.Commands)
+	assert2.Equal("", plan.String())
+}
+
+func TestCompute_ElementOnly(t *testing.T) {
+	assert2 := assert.New(t)
+
+	cur := []ipset.SetPolicy{
+		current("foo", "hash:ip", netfilter.ProtoIPv4,
+			ip("10.0.0.1", ipset.EntryPackets(3), ipset.EntryComment("x"))),
+	}
+	plan, err := Compute(cur, []Set{NewSet("foo", "hash:ip", netfilter.ProtoIPv4, nil)}, nil)
+	assert2.NoError(err)
+
+	if assert2.Len(plan.Commands, 1) {
+		c := plan.Commands[0]
+		assert2.Equal(restore.OpDel, c.Op)
+		assert2.Equal("10.0.0.1", c.Entry.IP.Get().String())
+		assert2.False(c.Entry.Packets.IsSet())
+		assert2.False(c.Entry.Comment.IsSet())
+	}
+}
+
+func TestCompute_Flags(t *testing.T) {
+	assert2 := assert.New(t)
+
+	prefix := func(s string, options ...ipset.EntryOption) *ipset.Entry {
+		_, n, _ := net.ParseCIDR(s)
+		ones, _ := n.Mask.Size()
+		return ip(n.IP.String(), append([]ipset.EntryOption{ipset.EntryCidr(uint8(ones))}, options...)...)
+	}
+	nomatch := ipset.EntryCadtFlags(uint32(ipset.NoMatch))
+	physdev := ipset.EntryCadtFlags(uint32(ipset.PhysDev))
+
+	cur := []ipset.SetPolicy{
+		current("nets", "hash:net", netfilter.ProtoIPv4, prefix("10.0.0.0/24"), prefix("10.1.0.0/16", nomatch)),
+		current("ifaces", "hash:net,iface", netfilter.ProtoIPv4, prefix("10.0.0.0/8", ipset.EntryIface("eth0"))),
+	}
+	desired := []Set{
+		NewSet("nets", "hash:net", netfilter.ProtoIPv4, ipset.Entries{prefix("10.0.0.0/24", nomatch), prefix("10.1.0.0/16", nomatch)}),
+		NewSet("ifaces", "hash:net,iface", netfilter.ProtoIPv4, ipset.Entries{prefix("10.0.0.0/8", ipset.EntryIface("eth0"), physdev)}),
+	}
+
+	// Flipping the flags replaces the elements.
+	plan, err := Compute(cur, desired, nil)
+	assert2.NoError(err)
+	assert2.Equal(`del nets 10.0.0.0/24
+add nets 10.0.0.0/24 nomatch
+del ifaces 10.0.0.0/8,eth0
+add ifaces 10.0.0.0/8,physdev:eth0
+`, plan.String())
+
+	// Other options are still ignored.
+	cur = []ipset.SetPolicy{
+		current("nets", "hash:net", netfilter.ProtoIPv4,
+			prefix("10.0.0.0/24", nomatch, ipset.EntryTimeout(time.Minute)), prefix("10.1.0.0/16", nomatch)),
+	}
+	plan, err = Compute(cur, desired[:1], nil)
+	assert2.NoError(err)
+	assert2.Equal("", plan.String())
+}
+
+func TestCompute_Ranges(t *testing.T) {
+	assert2 := assert.New(t)
+
+	ipTo := func(s string) ipset.EntryOption { return ipset.EntryIPTo(net.ParseIP(s)) }
+	cur := []ipset.SetPolicy{
+		current("nets", "hash:net", netfilter.ProtoIPv4,
+			ip("10.0.0.0", ipset.EntryCidr(23)),
+			ip("10.0.2.0", ipset.EntryCidr(32)),
+		),
+	}
+
+	// Ranges of networks are compared by the networks covering them.
+	plan, err := Compute(cur, []Set{
+		NewSet("nets", "hash:net", netfilter.ProtoIPv4, ipset.Entries{ip("10.0.0.0", ipTo("10.0.2.0"))}),
+	}, nil)
+	assert2.NoError(err)
+	assert2.Empty(plan.Commands)
+
+	plan, err = Compute(cur, []Set{
+		NewSet("nets", "hash:net", netfilter.ProtoIPv4, ipset.Entries{ip("10.0.0.0", ipTo("10.0.1.255"))}),
+	}, nil)
+	assert2.NoError(err)
+	assert2.Equal("del nets 10.0.2.0\n", plan.String())
+
+	// Ranges stored as single addresses or ports are rejected.
+	for _, d := range []Set{
+		NewSet("ips", "hash:ip", netfilter.ProtoIPv4, ipset.Entries{ip("10.0.0.1"), ip("10.0.0.0", ipset.EntryCidr(24))}),
+		NewSet("ips", "hash:ip", netfilter.ProtoIPv4, ipset.Entries{ip("10.0.0.1"), ip("10.0.0.0", ipTo("10.0.0.9"))}),
+		NewSet("ports", "hash:net,port", netfilter.ProtoIPv4, ipset.Entries{ip("10.0.0.1"),
+			ip("10.0.0.0", ipset.EntryProto(6), ipset.EntryPort(80), ipset.EntryPortTo(81))}),
+	} {
+		_, err = Compute(nil, []Set{d}, nil)
+		assert2.True(errors.Is(err, ErrRange), "%v", err)
+		var e *ipset.Error
+		if assert2.True(errors.As(err, &e)) {
+			assert2.Equal(d.Name.Get(), e.Set)
+			assert2.Equal(uint32(2), e.Line)
+		}
+	}
+
+	// Single addresses given with their full prefix length are accepted.
+	_, err = Compute(nil, []Set{
+		NewSet("ips", "hash:ip", netfilter.ProtoIPv4, ipset.Entries{ip("10.0.0.1", ipset.EntryCidr(32))}),
+	}, nil)
+	assert2.NoError(err)
+
+	// So is the kernel's rejection of the whole address space.
+	_, err = Compute(nil, []Set{
+		NewSet("nets", "hash:net", netfilter.ProtoIPv4, ipset.Entries{ip("0.0.0.0", ipTo("255.255.255.255"))}),
+	}, nil)
+	assert2.True(errors.Is(err, ipset.ErrInvalidRange), "%v", err)
+}
+
+func TestCompute_CreateData(t *testing.T) {
+	assert2 := assert.New(t)
+
+	listed := current("foo", "hash:ip", netfilter.ProtoIPv4, ip("10.0.0.1"))
+	listed.Data = &ipset.CreateData{
+		CadtFlags: ipset.NewUInt32Box(uint32(ipset.WithComment)),
+		HashSize:  ipset.NewUInt32Box(2048),
+		MaxElem:   ipset.NewUInt32Box(65536),
+		Timeout:   ipset.NewUInt32SecondsDurationBox(time.Hour),
+	}
+	bitmap := current("bits", "bitmap:ip", netfilter.ProtoIPv4)
+	bitmap.Data = &ipset.CreateData{
+		IP:   ipset.NewIPAddrBox(net.ParseIP("10.0.0.0")),
+		IPTo: ipset.NewIPAddrBox(net.ParseIP("10.0.0.255")),
+	}
+	cur := []ipset.SetPolicy{listed, bitmap}
+
+	compute := func(desired ...Set) string {
+		plan, err := Compute(cur, desired, nil)
+		assert2.NoError(err)
+		return plan.String()
+	}
+	entries := ipset.Entries{ip("10.0.0.1")}
+
+	// Options not set, the hash size and defaults filled in by the kernel are ignored.
+	assert2.Equal("", compute(
+		NewSet("foo", "hash:ip", netfilter.ProtoIPv4, entries,
+			ipset.CreateDataComment(), ipset.CreateDataTimeout(time.Hour), ipset.CreateDataHashSize(1024)),
+		NewSet("bits", "bitmap:ip", netfilter.ProtoIPv4, nil,
+			ipset.CreateDataIP(net.ParseIP("10.0.0.0")), ipset.CreateDataCidr(24)),
+	))
+
+	// Changed options and extensions recreate the set.
+	for _, options := range [][]ipset.CreateDataOption{
+		{ipset.CreateDataComment(), ipset.CreateDataTimeout(time.Minute)},
+		{ipset.CreateDataComment(), ipset.CreateDataMaxElem(1024)},
+		{ipset.CreateDataTimeout(time.Hour)},
+		{ipset.CreateDataComment(), ipset.CreateDataCounters()},
+	} {
+		assert2.Contains(compute(NewSet("foo", "hash:ip", netfilter.ProtoIPv4, entries, options...)),
+			"destroy foo\ncreate foo hash:ip")
+	}
+	assert2.Contains(compute(NewSet("bits", "bitmap:ip", netfilter.ProtoIPv4, nil,
+		ipset.CreateDataIP(net.ParseIP("10.0.0.0")), ipset.CreateDataCidr(23))),
+		"destroy bits\ncreate bits bitmap:ip")
+}
@@ -0,0 +1,66 @@
+package ipset
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/ti-mo/netfilter"
+)
+
+// maxNameLen is the maximum length of a set name, excluding the terminating NUL.
+const maxNameLen = 31
+
+// ReplaceContents atomically replaces the entries of the set name. It fills
+// a temporary set created alike to the live set, swaps both sets and destroys
+// the temporary set, which holds the previous entries at that point. Rules
+// matching the set never see partial contents.
+//
+// On failure, the temporary set is destroyed and the live set is left unchanged.
+func (c *Conn) ReplaceContents(name string, entries ...*Entry) error {
+	return c.ReplaceContentsContext(context.Background(), name, entries...)
+}
+
+// ReplaceContentsContext is like ReplaceContents but aborts once ctx is done.
+// The temporary set is destroyed regardless of ctx.
+func (c *Conn) ReplaceContentsContext(ctx context.Context, name string, entries ...*Entry) (err error) {
+	p, err := c.HeaderContext(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := shadowName(name)
+	if err != nil {
+		return err
+	}
+
+	err = c.CreateContext(ctx, tmp, p.TypeName.Get(), p.Revision.Get(),
+		netfilter.ProtoFamily(p.Family.Get()), CreateDataFrom(p.Data))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if derr := c.Destroy(tmp); err == nil {
+			err = derr
+		}
+	}()
+
+	if err = c.AddContext(ctx, tmp, entries...); err != nil {
+		return err
+	}
+	return c.SwapContext(ctx, tmp, name)
+}
+
+// shadowName returns a random name for a temporary copy of the set name.
+func shadowName(name string) (string, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+
+	suffix := "-" + hex.EncodeToString(b[:])
+	if len(name)+len(suffix) > maxNameLen {
+		name = name[:maxNameLen-len(suffix)]
+	}
+	return name + suffix, nil
+}
@@ -0,0 +1,253 @@
+package ipset
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/ti-mo/netfilter"
+)
+
+// RestoreOp is the operation of a RestoreCommand.
+type RestoreOp int
+
+const (
+	_ RestoreOp = iota
+	RestoreCreate
+	RestoreAdd
+	RestoreDel
+	RestoreFlush
+	RestoreDestroy
+	RestoreSwap
+	RestoreRename
+)
+
+var restoreOpNames = [...]string{
+	RestoreCreate:  "create",
+	RestoreAdd:     "add",
+	RestoreDel:     "del",
+	RestoreFlush:   "flush",
+	RestoreDestroy: "destroy",
+	RestoreSwap:    "swap",
+	RestoreRename:  "rename",
+}
+
+func (o RestoreOp) String() string {
+	if int(o) < len(restoreOpNames) && restoreOpNames[o] != "" {
+		return restoreOpNames[o]
+	}
+	return fmt.Sprintf("op(%d)", int(o))
+}
+
+// RestoreCommand is a single line of a restore file, as read by
+// the Decoder of the restore package.
+type RestoreCommand struct {
+	Op RestoreOp
+
+	// Line is the line number the command was read from, starting at 1.
+	Line int
+
+	// Set is the name of the set the command operates on. It is empty
+	// for flush and destroy commands operating on all sets.
+	Set string
+
+	// To is the second set name of swap and rename commands.
+	To string
+
+	// Create holds the header and options of create commands.
+	// Its Revision is left unset, as the text format does not carry it.
+	Create *CreatePolicy
+
+	// Entry is the element of add and del commands. Its Lineno is set
+	// to Line, so errors reported by the kernel refer to the input line.
+	Entry *Entry
+
+	// Exist is set if the command carries the -exist option.
+	Exist bool
+}
+
+// RestoreDecoder reads the commands of a restore file one at a time,
+// returning io.EOF after the last one. The Decoder of the restore
+// package implements it.
+type RestoreDecoder interface {
+	Decode() (*RestoreCommand, error)
+}
+
+// Restore applies the commands read from d the way `ipset restore` does.
+// Consecutive add and del commands for the same set are sent to the kernel
+// in batches, limited by BatchSize. At most maxPending commands are held
+// back for a batch. Create commands without a revision use the latest
+// revision of their type supported by the kernel.
+//
+// If the kernel rejects an entry, the returned *Error carries the input
+// line in its Line field. All commands preceding it have been applied.
+// Errors returned by d are returned once the pending commands are applied.
+func (c *Conn) Restore(d RestoreDecoder) error {
+	return c.RestoreContext(context.Background(), d)
+}
+
+// RestoreContext is like Restore but aborts once ctx is done.
+func (c *Conn) RestoreContext(ctx context.Context, d RestoreDecoder) error {
+	rs := newRestorer(ctx, c)
+	for {
+		cmd, err := d.Decode()
+		if err == io.EOF {
+			return rs.flush()
+		}
+		if err != nil {
+			if ferr := rs.flush(); ferr != nil {
+				return ferr
+			}
+			return err
+		}
+
+		if err := rs.apply(cmd); err != nil {
+			return err
+		}
+	}
+}
+
+// RestoreCommands applies cmds like Restore.
+func (c *Conn) RestoreCommands(cmds []RestoreCommand) error {
+	return c.RestoreCommandsContext(context.Background(), cmds)
+}
+
+// RestoreCommandsContext is like RestoreCommands but aborts once ctx is done.
+func (c *Conn) RestoreCommandsContext(ctx context.Context, cmds []RestoreCommand) error {
+	rs := newRestorer(ctx, c)
+	for i := range cmds {
+		if err := rs.apply(&cmds[i]); err != nil {
+			return err
+		}
+	}
+	return rs.flush()
+}
+
+// maxPending bounds the number of add or del commands held back for a
+// batch, so that large restore files are not read into memory as a whole.
+const maxPending = 10000
+
+type revisionKey struct {
+	typeName string
+	family   netfilter.ProtoFamily
+}
+
+type restorer struct {
+	ctx       context.Context
+	conn      *Conn
+	revisions map[revisionKey]uint8
+
+	// Pending add or del commands.
+	op      RestoreOp
+	set     string
+	exist   bool
+	entries Entries
+}
+
+func newRestorer(ctx context.Context, c *Conn) *restorer {
+	return &restorer{ctx: ctx, conn: c, revisions: make(map[revisionKey]uint8)}
+}
+
+func (r *restorer) apply(cmd *RestoreCommand) error {
+	if cmd.Op == RestoreAdd || cmd.Op == RestoreDel {
+		if cmd.Op != r.op || cmd.Set != r.set || cmd.Exist != r.exist {
+			if err := r.flush(); err != nil {
+				return err
+			}
+		}
+		r.op, r.set, r.exist = cmd.Op, cmd.Set, cmd.Exist
+		r.entries = append(r.entries, cmd.Entry)
+		if len(r.entries) >= maxPending {
+			return r.flush()
+		}
+		return nil
+	}
+
+	if err := r.flush(); err != nil {
+		return err
+	}
+
+	switch cmd.Op {
+	case RestoreCreate:
+		return r.create(cmd)
+	case RestoreFlush:
+		if cmd.Set == "" {
+			return r.conn.FlushAllContext(r.ctx)
+		}
+		return r.conn.FlushContext(r.ctx, cmd.Set)
+	case RestoreDestroy:
+		if cmd.Set == "" {
+			return r.conn.DestroyAllContext(r.ctx)
+		}
+		return r.conn.DestroyContext(r.ctx, cmd.Set)
+	case RestoreSwap:
+		return r.conn.SwapContext(r.ctx, cmd.Set, cmd.To)
+	case RestoreRename:
+		return r.conn.RenameContext(r.ctx, cmd.Set, cmd.To)
+	}
+	return nil
+}
+
+// flush sends the pending add or del commands.
+func (r *restorer) flush() error {
+	if len(r.entries) == 0 {
+		return nil
+	}
+
+	entries := r.entries
+	r.entries = nil
+
+	switch {
+	case r.op == RestoreAdd && r.exist:
+		return r.conn.AddContext(r.ctx, r.set, entries...)
+	case r.op == RestoreAdd:
+		return r.conn.AddExclusiveContext(r.ctx, r.set, entries...)
+	case r.exist:
+		return r.conn.DeleteContext(r.ctx, r.set, entries...)
+	default:
+		return r.conn.DeleteExclusiveContext(r.ctx, r.set, entries...)
+	}
+}
+
+func (r *restorer) create(cmd *RestoreCommand) error {
+	p := cmd.Create
+	typeName := p.TypeName.Get()
+
+	// Like ipset(8), default to IPv4 for types storing addresses.
+	family := netfilter.ProtoUnspec
+	if p.Family.IsSet() {
+		family = netfilter.ProtoFamily(p.Family.Get())
+	} else if t := LookupSetType(typeName); t != nil && (t.has("ip") || t.has("net")) {
+		family = netfilter.ProtoIPv4
+	}
+
+	revision, err := r.revision(p, family)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Exist {
+		return r.conn.ReplaceContext(r.ctx, cmd.Set, typeName, revision, family, CreateDataFrom(p.Data))
+	}
+	return r.conn.CreateContext(r.ctx, cmd.Set, typeName, revision, family, CreateDataFrom(p.Data))
+}
+
+// revision returns the revision of p if set, or the latest revision of its type
+// supported by the kernel otherwise.
+func (r *restorer) revision(p *CreatePolicy, family netfilter.ProtoFamily) (uint8, error) {
+	if p.Revision.IsSet() {
+		return p.Revision.Get(), nil
+	}
+
+	key := revisionKey{p.TypeName.Get(), family}
+	if rev, ok := r.revisions[key]; ok {
+		return rev, nil
+	}
+
+	t, err := r.conn.TypeContext(r.ctx, key.typeName, family)
+	if err != nil {
+		return 0, err
+	}
+	r.revisions[key] = t.Revision.Get()
+	return t.Revision.Get(), nil
+}
@@ -0,0 +1,60 @@
+// Package restore reads and writes the text format used by
+// `ipset save` and `ipset restore`.
+package restore
+
+import (
+	"fmt"
+
+	ipset "github.com/digineo/go-ipset/v2"
+)
+
+// Op is the operation of a single restore command.
+type Op = ipset.RestoreOp
+
+const (
+	OpCreate  = ipset.RestoreCreate
+	OpAdd     = ipset.RestoreAdd
+	OpDel     = ipset.RestoreDel
+	OpFlush   = ipset.RestoreFlush
+	OpDestroy = ipset.RestoreDestroy
+	OpSwap    = ipset.RestoreSwap
+	OpRename  = ipset.RestoreRename
+)
+
+// Aliases accepted for the command names, as understood by ipset(8).
+var opAliases = map[string]Op{
+	"create":  OpCreate,
+	"n":       OpCreate,
+	"-N":      OpCreate,
+	"add":     OpAdd,
+	"a":       OpAdd,
+	"-A":      OpAdd,
+	"del":     OpDel,
+	"d":       OpDel,
+	"-D":      OpDel,
+	"flush":   OpFlush,
+	"f":       OpFlush,
+	"-F":      OpFlush,
+	"destroy": OpDestroy,
+	"x":       OpDestroy,
+	"-X":      OpDestroy,
+	"swap":    OpSwap,
+	"w":       OpSwap,
+	"-W":      OpSwap,
+	"rename":  OpRename,
+	"e":       OpRename,
+	"-E":      OpRename,
+}
+
+// Command is a single line of a restore file.
+type Command = ipset.RestoreCommand
+
+// SyntaxError describes a malformed line of a restore file.
+type SyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("restore: line %d: %s", e.Line, e.Msg)
+}
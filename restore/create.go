@@ -0,0 +1,215 @@
+package restore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	ipset "github.com/digineo/go-ipset/v2"
+	"github.com/ti-mo/netfilter"
+)
+
+func newCreatePolicy(name, typeName string) *ipset.CreatePolicy {
+	return &ipset.CreatePolicy{
+		HeaderPolicy: ipset.HeaderPolicy{
+			NamePolicy: ipset.NamePolicy{
+				BasePolicy: ipset.BasePolicy{Protocol: ipset.NewUInt8Box(ipset.Protocol)},
+				Name:       ipset.NewNullStringBox(name),
+			},
+			TypeName: ipset.NewNullStringBox(typeName),
+			Data:     &ipset.CreateData{},
+		},
+	}
+}
+
+func addCreateFlag(d *ipset.CreateData, flag ipset.CadtFlags) {
+	d.CadtFlags = ipset.NewUInt32Box(d.CadtFlags.Get() | uint32(flag))
+}
+
+func hasCreateFlag(d *ipset.CreateData, flag ipset.CadtFlags) bool {
+	return ipset.CadtFlags(d.CadtFlags.Get())&flag != 0
+}
+
+// parseCreateOptions parses the options following the type of a create command.
+func parseCreateOptions(args []string, p *ipset.CreatePolicy) error {
+	d := p.Data
+	for len(args) > 0 {
+		opt := args[0]
+		args = args[1:]
+
+		switch opt {
+		case "counters":
+			addCreateFlag(d, ipset.WithCounters)
+			continue
+		case "comment":
+			addCreateFlag(d, ipset.WithComment)
+			continue
+		case "skbinfo":
+			addCreateFlag(d, ipset.WithSkbInfo)
+			continue
+		case "forceadd":
+			addCreateFlag(d, ipset.WithForceDdd)
+			continue
+		}
+
+		if len(args) < 1 {
+			return fmt.Errorf("missing value for option %q", opt)
+		}
+		val := args[0]
+		args = args[1:]
+
+		switch opt {
+		case "family":
+			switch val {
+			case "inet":
+				p.Family = ipset.NewUInt8Box(uint8(netfilter.ProtoIPv4))
+			case "inet6":
+				p.Family = ipset.NewUInt8Box(uint8(netfilter.ProtoIPv6))
+			default:
+				return fmt.Errorf("invalid family %q", val)
+			}
+		case "hashsize", "maxelem", "size", "markmask", "initval":
+			v, err := strconv.ParseUint(val, 0, 32)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", opt, val)
+			}
+			box := ipset.NewUInt32Box(uint32(v))
+			switch opt {
+			case "hashsize":
+				d.HashSize = box
+			case "maxelem":
+				d.MaxElem = box
+			case "size":
+				d.Size = box
+			case "markmask":
+				d.MarkMask = box
+			case "initval":
+				d.InitVal = box
+			}
+		case "netmask", "bucketsize", "probes", "resize":
+			v, err := strconv.ParseUint(val, 10, 8)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", opt, val)
+			}
+			box := ipset.NewUInt8Box(uint8(v))
+			switch opt {
+			case "netmask":
+				d.NetMask = box
+			case "bucketsize", "probes":
+				d.Probes = box
+			case "resize":
+				d.Resize = box
+			}
+		case "range":
+			if err := parseCreateRange(p.TypeName.Get(), val, d); err != nil {
+				return err
+			}
+		case "timeout":
+			v, err := strconv.ParseUint(val, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid timeout %q", val)
+			}
+			d.Timeout = ipset.NewUInt32SecondsDurationBox(time.Duration(v) * time.Second)
+		case "gc":
+			// Ignored by the kernel, accepted for backward compatibility.
+		default:
+			return fmt.Errorf("unknown option %q", opt)
+		}
+	}
+
+	return nil
+}
+
+// parseCreateRange parses the range of a bitmap type, which is an address
+// range or network for bitmap:ip and bitmap:ip,mac and a port range for
+// bitmap:port.
+func parseCreateRange(typeName, s string, d *ipset.CreateData) error {
+	switch typeName {
+	case "bitmap:ip", "bitmap:ip,mac":
+		ip, to, cidr, err := parseIP(s)
+		if err != nil {
+			return err
+		}
+		if !to.IsSet() && !cidr.IsSet() {
+			return fmt.Errorf("invalid range %q", s)
+		}
+		d.IP, d.IPTo, d.Cidr = ip, to, cidr
+	case "bitmap:port":
+		i := strings.IndexByte(s, '-')
+		if i < 0 {
+			return fmt.Errorf("invalid range %q", s)
+		}
+		first, err := strconv.ParseUint(s[:i], 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", s[:i])
+		}
+		last, err := strconv.ParseUint(s[i+1:], 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", s[i+1:])
+		}
+		d.Port, d.PortTo = ipset.NewUInt16Box(uint16(first)), ipset.NewUInt16Box(uint16(last))
+	default:
+		return fmt.Errorf("option range is not supported by %s", typeName)
+	}
+	return nil
+}
+
+// formatCreateOptions appends the options of p in the order ipset(8) prints them.
+func formatCreateOptions(b *strings.Builder, p *ipset.CreatePolicy) {
+	if isHash(p.TypeName.Get()) && p.Family.IsSet() {
+		switch netfilter.ProtoFamily(p.Family.Get()) {
+		case netfilter.ProtoIPv4:
+			b.WriteString(" family inet")
+		case netfilter.ProtoIPv6:
+			b.WriteString(" family inet6")
+		}
+	}
+
+	d := p.Data
+	if d == nil {
+		return
+	}
+	if d.MarkMask.IsSet() {
+		fmt.Fprintf(b, " markmask 0x%08x", d.MarkMask.Get())
+	}
+	if d.IP.IsSet() {
+		fmt.Fprintf(b, " range %s", formatIP(d.IP, d.IPTo, d.Cidr))
+	}
+	if d.Port.IsSet() && d.PortTo.IsSet() {
+		fmt.Fprintf(b, " range %d-%d", d.Port.Get(), d.PortTo.Get())
+	}
+	if d.HashSize.IsSet() {
+		fmt.Fprintf(b, " hashsize %d", d.HashSize.Get())
+	}
+	if d.MaxElem.IsSet() {
+		fmt.Fprintf(b, " maxelem %d", d.MaxElem.Get())
+	}
+	if d.NetMask.IsSet() {
+		fmt.Fprintf(b, " netmask %d", d.NetMask.Get())
+	}
+	if d.Size.IsSet() {
+		fmt.Fprintf(b, " size %d", d.Size.Get())
+	}
+	if d.Timeout.IsSet() {
+		fmt.Fprintf(b, " timeout %d", d.Timeout.Get()/time.Second)
+	}
+	if hasCreateFlag(d, ipset.WithCounters) {
+		b.WriteString(" counters")
+	}
+	if hasCreateFlag(d, ipset.WithComment) {
+		b.WriteString(" comment")
+	}
+	if hasCreateFlag(d, ipset.WithForceDdd) {
+		b.WriteString(" forceadd")
+	}
+	if hasCreateFlag(d, ipset.WithSkbInfo) {
+		b.WriteString(" skbinfo")
+	}
+	if d.Probes.IsSet() {
+		fmt.Fprintf(b, " bucketsize %d", d.Probes.Get())
+	}
+	if d.InitVal.IsSet() {
+		fmt.Fprintf(b, " initval 0x%08x", d.InitVal.Get())
+	}
+}
@@ -0,0 +1,199 @@
+package restore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	ipset "github.com/digineo/go-ipset/v2"
+)
+
+// Decoder reads commands from a restore file.
+type Decoder struct {
+	s     *bufio.Scanner
+	line  int
+	types map[string]string
+}
+
+// NewDecoder returns a Decoder reading from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		s:     bufio.NewScanner(r),
+		types: make(map[string]string),
+	}
+}
+
+// SetType declares the type of a set which is not created by the input.
+// The type of a set is required to parse the elements of add and del commands.
+func (d *Decoder) SetType(name, typeName string) {
+	d.types[name] = typeName
+}
+
+// Decode returns the next command, or io.EOF once the input is exhausted.
+// Malformed lines are reported as *SyntaxError.
+func (d *Decoder) Decode() (*Command, error) {
+	for d.s.Scan() {
+		d.line++
+
+		line := strings.TrimSpace(d.s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		c, err := d.parse(line)
+		if err != nil {
+			return nil, &SyntaxError{Line: d.line, Msg: err.Error()}
+		}
+		return c, nil
+	}
+
+	if err := d.s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (d *Decoder) parse(line string) (*Command, error) {
+	args, err := tokenize(line)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Command{Line: d.line}
+	args = filterExist(args, &c.Exist)
+	if len(args) == 0 {
+		return nil, errors.New("missing command")
+	}
+
+	op, ok := opAliases[args[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown command %q", args[0])
+	}
+	c.Op, args = op, args[1:]
+
+	switch c.Op {
+	case OpCreate:
+		if len(args) < 2 {
+			return nil, errors.New("missing set name or type")
+		}
+		c.Set = args[0]
+		c.Create = newCreatePolicy(args[0], args[1])
+		if err := parseCreateOptions(args[2:], c.Create); err != nil {
+			return nil, err
+		}
+		d.types[c.Set] = args[1]
+
+	case OpAdd, OpDel:
+		if len(args) < 2 {
+			return nil, errors.New("missing set name or element")
+		}
+		c.Set = args[0]
+		typeName := d.types[c.Set]
+		if typeName == "" {
+			return nil, fmt.Errorf("unknown set %q", c.Set)
+		}
+		c.Entry = ipset.NewEntry(ipset.EntryLineno(uint32(c.Line)))
+		if err := parseElement(typeName, args[1], c.Entry); err != nil {
+			return nil, err
+		}
+		if err := parseEntryOptions(args[2:], c.Entry); err != nil {
+			return nil, err
+		}
+
+	case OpFlush, OpDestroy:
+		if len(args) > 1 {
+			return nil, fmt.Errorf("unexpected argument %q", args[1])
+		}
+		if len(args) == 1 {
+			c.Set = args[0]
+		}
+		if c.Op == OpDestroy {
+			if c.Set == "" {
+				d.types = make(map[string]string)
+			} else {
+				delete(d.types, c.Set)
+			}
+		}
+
+	case OpSwap, OpRename:
+		if len(args) != 2 {
+			return nil, errors.New("expected two set names")
+		}
+		c.Set, c.To = args[0], args[1]
+		if c.Op == OpSwap {
+			d.types[c.Set], d.types[c.To] = d.types[c.To], d.types[c.Set]
+		} else {
+			d.types[c.To] = d.types[c.Set]
+			delete(d.types, c.Set)
+		}
+	}
+
+	return c, nil
+}
+
+// Parse reads all commands from r.
+func Parse(r io.Reader) ([]Command, error) {
+	d := NewDecoder(r)
+
+	var cmds []Command
+	for {
+		c, err := d.Decode()
+		if err == io.EOF {
+			return cmds, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, *c)
+	}
+}
+
+// tokenize splits a line at whitespace. Double quoted strings form a single
+// token, as used by comments.
+func tokenize(line string) ([]string, error) {
+	var (
+		args   []string
+		b      strings.Builder
+		quoted bool
+		inArg  bool
+	)
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inArg {
+				args = append(args, b.String())
+				b.Reset()
+				inArg = false
+			}
+		default:
+			b.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quoted string")
+	}
+	if inArg {
+		args = append(args, b.String())
+	}
+	return args, nil
+}
+
+// filterExist removes the -exist option from args.
+func filterExist(args []string, exist *bool) []string {
+	n := 0
+	for _, arg := range args {
+		if arg == "-exist" || arg == "-!" {
+			*exist = true
+			continue
+		}
+		args[n] = arg
+		n++
+	}
+	return args[:n]
+}
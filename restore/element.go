@@ -0,0 +1,424 @@
+package restore
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	ipset "github.com/digineo/go-ipset/v2"
+)
+
+// dimensions returns the components of the elements of a set type,
+// e.g. ["ip", "port"] for hash:ip,port.
+func dimensions(typeName string) ([]string, error) {
+	i := strings.IndexByte(typeName, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("invalid set type %q", typeName)
+	}
+	return strings.Split(typeName[i+1:], ","), nil
+}
+
+func isHash(typeName string) bool {
+	return strings.HasPrefix(typeName, "hash:")
+}
+
+func addFlag(e *ipset.Entry, flag ipset.CadtFlags) {
+	e.CadtFlags = ipset.NewUInt32Box(e.CadtFlags.Get() | uint32(flag))
+}
+
+func hasFlag(e *ipset.Entry, flag ipset.CadtFlags) bool {
+	return ipset.CadtFlags(e.CadtFlags.Get())&flag != 0
+}
+
+// parseElement parses the element s of a set of the given type into e.
+func parseElement(typeName, s string, e *ipset.Entry) error {
+	dims, err := dimensions(typeName)
+	if err != nil {
+		return err
+	}
+
+	parts := strings.Split(s, ",")
+	if len(dims) == 1 && dims[0] == "set" {
+		// Set names may contain commas.
+		parts = []string{s}
+	}
+	if len(parts) != len(dims) {
+		// The MAC address of bitmap:ip,mac elements is optional.
+		optional := !isHash(typeName) && dims[len(dims)-1] == "mac"
+		if !optional || len(parts) != len(dims)-1 {
+			return fmt.Errorf("element %q does not match set type %s", s, typeName)
+		}
+	}
+
+	second := false
+	for i, part := range parts {
+		switch dims[i] {
+		case "ip", "net":
+			ip, to, cidr, err := parseIP(part)
+			if err != nil {
+				return err
+			}
+			if !second {
+				e.IP, e.IPTo, e.Cidr = ip, to, cidr
+			} else {
+				e.IP2, e.IP2To, e.Cidr2 = ip, to, cidr
+			}
+			second = true
+		case "port":
+			if err := parsePort(typeName, part, e); err != nil {
+				return err
+			}
+		case "mac":
+			mac, err := net.ParseMAC(part)
+			if err != nil {
+				return err
+			}
+			e.Ether = ipset.NewHardwareAddrBox(mac)
+		case "iface":
+			if strings.HasPrefix(part, "physdev:") {
+				part = strings.TrimPrefix(part, "physdev:")
+				addFlag(e, ipset.PhysDev)
+			}
+			e.Iface = ipset.NewNullStringBox(part)
+		case "mark":
+			v, err := strconv.ParseUint(part, 0, 32)
+			if err != nil {
+				return fmt.Errorf("invalid mark %q", part)
+			}
+			e.Mark = ipset.NewUInt32Box(uint32(v))
+		case "set":
+			e.Name = ipset.NewNullStringBox(part)
+		default:
+			return fmt.Errorf("set type %s is not supported", typeName)
+		}
+	}
+
+	return nil
+}
+
+// parseIP parses an address, a prefix or an address range.
+func parseIP(s string) (ip, to *ipset.IPAddrBox, cidr *ipset.UInt8Box, err error) {
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		a, err := parseAddr(s[:i])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		n, err := strconv.ParseUint(s[i+1:], 10, 8)
+		if err != nil || int(n) > len(a)*8 {
+			return nil, nil, nil, fmt.Errorf("invalid prefix length in %q", s)
+		}
+		return ipset.NewIPAddrBox(a), nil, ipset.NewUInt8Box(uint8(n)), nil
+	}
+
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		a, err := parseAddr(s[:i])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		b, err := parseAddr(s[i+1:])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return ipset.NewIPAddrBox(a), ipset.NewIPAddrBox(b), nil, nil
+	}
+
+	a, err := parseAddr(s)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return ipset.NewIPAddrBox(a), nil, nil, nil
+}
+
+func parseAddr(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, nil
+	}
+	return ip, nil
+}
+
+// parsePort parses [proto:]port[-port] into e. Hash types default
+// to TCP if no protocol is given.
+func parsePort(typeName, s string, e *ipset.Entry) error {
+	proto := ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		proto, s = s[:i], s[i+1:]
+	} else if isHash(typeName) {
+		proto = "tcp"
+	}
+
+	if proto != "" {
+		p, err := parseProto(proto)
+		if err != nil {
+			return err
+		}
+		e.Proto = ipset.NewUInt8Box(p)
+
+		switch p {
+		case protoICMP, protoICMPv6:
+			types := icmpTypes
+			if p == protoICMPv6 {
+				types = icmpv6Types
+			}
+			v, err := parseICMP(types, s)
+			if err != nil {
+				return err
+			}
+			e.Port = ipset.NewUInt16Box(v)
+			return nil
+		}
+	}
+
+	from, to := s, ""
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+
+	v, err := strconv.ParseUint(from, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", from)
+	}
+	e.Port = ipset.NewUInt16Box(uint16(v))
+
+	if to != "" {
+		v, err := strconv.ParseUint(to, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", to)
+		}
+		e.PortTo = ipset.NewUInt16Box(uint16(v))
+	}
+
+	return nil
+}
+
+// FormatElement formats the element of e for a set of the given type,
+// as printed by `ipset save`.
+func FormatElement(typeName string, e *ipset.Entry) (string, error) {
+	dims, err := dimensions(typeName)
+	if err != nil {
+		return "", err
+	}
+
+	parts := make([]string, 0, len(dims))
+	second := false
+	for _, dim := range dims {
+		switch dim {
+		case "ip", "net":
+			if !second {
+				parts = append(parts, formatIP(e.IP, e.IPTo, e.Cidr))
+			} else {
+				parts = append(parts, formatIP(e.IP2, e.IP2To, e.Cidr2))
+			}
+			second = true
+		case "port":
+			parts = append(parts, formatPort(e))
+		case "mac":
+			if !e.Ether.IsSet() && !isHash(typeName) {
+				continue
+			}
+			parts = append(parts, strings.ToUpper(e.Ether.Get().String()))
+		case "iface":
+			iface := e.Iface.Get()
+			if hasFlag(e, ipset.PhysDev) {
+				iface = "physdev:" + iface
+			}
+			parts = append(parts, iface)
+		case "mark":
+			parts = append(parts, fmt.Sprintf("0x%08x", e.Mark.Get()))
+		case "set":
+			parts = append(parts, e.Name.Get())
+		default:
+			return "", fmt.Errorf("set type %s is not supported", typeName)
+		}
+	}
+
+	return strings.Join(parts, ","), nil
+}
+
+func formatIP(ip, to *ipset.IPAddrBox, cidr *ipset.UInt8Box) string {
+	s := ip.Get().String()
+	if to.IsSet() {
+		return s + "-" + to.Get().String()
+	}
+
+	bits := net.IPv6len * 8
+	if ip.Get().To4() != nil {
+		bits = net.IPv4len * 8
+	}
+	if cidr.IsSet() && int(cidr.Get()) != bits {
+		s += "/" + strconv.Itoa(int(cidr.Get()))
+	}
+	return s
+}
+
+func formatPort(e *ipset.Entry) string {
+	var b strings.Builder
+	if e.Proto.IsSet() {
+		switch p := e.Proto.Get(); p {
+		case protoICMP:
+			return "icmp:" + formatICMP(icmpTypes, e.Port.Get())
+		case protoICMPv6:
+			return "icmpv6:" + formatICMP(icmpv6Types, e.Port.Get())
+		default:
+			b.WriteString(formatProto(p))
+			b.WriteByte(':')
+		}
+	}
+
+	b.WriteString(strconv.Itoa(int(e.Port.Get())))
+	if e.PortTo.IsSet() {
+		b.WriteByte('-')
+		b.WriteString(strconv.Itoa(int(e.PortTo.Get())))
+	}
+	return b.String()
+}
+
+// parseEntryOptions parses the extensions following the element of
+// an add or del command.
+func parseEntryOptions(args []string, e *ipset.Entry) error {
+	for len(args) > 0 {
+		opt := args[0]
+		if opt == "nomatch" {
+			addFlag(e, ipset.NoMatch)
+			args = args[1:]
+			continue
+		}
+
+		if len(args) < 2 {
+			return fmt.Errorf("missing value for option %q", opt)
+		}
+		val := args[1]
+		args = args[2:]
+
+		switch opt {
+		case "before":
+			ipset.EntryBefore(val)(e)
+		case "after":
+			ipset.EntryAfter(val)(e)
+		case "timeout":
+			v, err := strconv.ParseUint(val, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid timeout %q", val)
+			}
+			e.Timeout = ipset.NewUInt32SecondsDurationBox(time.Duration(v) * time.Second)
+		case "packets":
+			v, err := strconv.ParseUint(val, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid packets %q", val)
+			}
+			e.Packets = ipset.NewUInt64Box(v)
+		case "bytes":
+			v, err := strconv.ParseUint(val, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid bytes %q", val)
+			}
+			e.Bytes = ipset.NewUInt64Box(v)
+		case "comment":
+			if len(val) > ipset.MaxCommentSize {
+				return fmt.Errorf("comment is longer than %d bytes", ipset.MaxCommentSize)
+			}
+			e.Comment = ipset.NewNullStringBox(val)
+		case "skbmark":
+			m, err := parseSkbMark(val)
+			if err != nil {
+				return err
+			}
+			ipset.EntrySkbMarkMask(m.Mark, m.Mask)(e)
+		case "skbprio":
+			c, err := parseSkbPrio(val)
+			if err != nil {
+				return err
+			}
+			ipset.EntrySkbClass(c.Major, c.Minor)(e)
+		case "skbqueue":
+			v, err := strconv.ParseUint(val, 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid skbqueue %q", val)
+			}
+			e.Skbqueue = ipset.NewUInt16Box(uint16(v))
+		default:
+			return fmt.Errorf("unknown option %q", opt)
+		}
+	}
+
+	return nil
+}
+
+// formatEntryOptions appends the extensions of e in the order ipset(8) prints them.
+func formatEntryOptions(b *strings.Builder, e *ipset.Entry) {
+	if e.NameRef.IsSet() {
+		if hasFlag(e, ipset.Before) {
+			b.WriteString(" before ")
+		} else {
+			b.WriteString(" after ")
+		}
+		b.WriteString(e.NameRef.Get())
+	}
+	if e.Timeout.IsSet() {
+		fmt.Fprintf(b, " timeout %d", e.Timeout.Get()/time.Second)
+	}
+	if hasFlag(e, ipset.NoMatch) {
+		b.WriteString(" nomatch")
+	}
+	if e.Packets.IsSet() {
+		fmt.Fprintf(b, " packets %d", e.Packets.Get())
+	}
+	if e.Bytes.IsSet() {
+		fmt.Fprintf(b, " bytes %d", e.Bytes.Get())
+	}
+	if e.Comment.IsSet() {
+		b.WriteString(` comment "`)
+		b.WriteString(e.Comment.Get())
+		b.WriteByte('"')
+	}
+	if m, ok := e.SkbMarkMask(); ok {
+		b.WriteString(" skbmark ")
+		b.WriteString(m.String())
+	}
+	if c, ok := e.SkbClass(); ok {
+		b.WriteString(" skbprio ")
+		b.WriteString(c.String())
+	}
+	if e.Skbqueue.IsSet() {
+		fmt.Fprintf(b, " skbqueue %d", e.Skbqueue.Get())
+	}
+}
+
+// parseSkbMark parses mark[/mask], the mask defaulting to all bits.
+func parseSkbMark(s string) (ipset.SkbMark, error) {
+	mark, mask := s, "0xffffffff"
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		mark, mask = s[:i], s[i+1:]
+	}
+	m, err := strconv.ParseUint(mark, 0, 32)
+	if err != nil {
+		return ipset.SkbMark{}, fmt.Errorf("invalid skbmark %q", s)
+	}
+	k, err := strconv.ParseUint(mask, 0, 32)
+	if err != nil {
+		return ipset.SkbMark{}, fmt.Errorf("invalid skbmark %q", s)
+	}
+	return ipset.SkbMark{Mark: uint32(m), Mask: uint32(k)}, nil
+}
+
+// parseSkbPrio parses a tc class major:minor given in hex.
+func parseSkbPrio(s string) (ipset.SkbClass, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return ipset.SkbClass{}, fmt.Errorf("invalid skbprio %q", s)
+	}
+	major, err := strconv.ParseUint(s[:i], 16, 16)
+	if err != nil {
+		return ipset.SkbClass{}, fmt.Errorf("invalid skbprio %q", s)
+	}
+	minor, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil {
+		return ipset.SkbClass{}, fmt.Errorf("invalid skbprio %q", s)
+	}
+	return ipset.SkbClass{Major: uint16(major), Minor: uint16(minor)}, nil
+}
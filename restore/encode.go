@@ -0,0 +1,124 @@
+package restore
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	ipset "github.com/digineo/go-ipset/v2"
+)
+
+// Encoder writes commands in the format of a restore file.
+type Encoder struct {
+	w     io.Writer
+	types map[string]string
+}
+
+// NewEncoder returns an Encoder writing to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w:     w,
+		types: make(map[string]string),
+	}
+}
+
+// SetType declares the type of a set which is not created by the output.
+// The type of a set is required to format the elements of add and del commands.
+func (e *Encoder) SetType(name, typeName string) {
+	e.types[name] = typeName
+}
+
+// Encode writes c as a single line.
+func (e *Encoder) Encode(c *Command) error {
+	var b strings.Builder
+	b.WriteString(c.Op.String())
+
+	switch c.Op {
+	case OpCreate:
+		if c.Create == nil {
+			return fmt.Errorf("restore: create command for set %q without header", c.Set)
+		}
+		typeName := c.Create.TypeName.Get()
+		b.WriteByte(' ')
+		b.WriteString(c.Set)
+		b.WriteByte(' ')
+		b.WriteString(typeName)
+		formatCreateOptions(&b, c.Create)
+		e.types[c.Set] = typeName
+
+	case OpAdd, OpDel:
+		typeName := e.types[c.Set]
+		if typeName == "" {
+			return fmt.Errorf("restore: unknown set %q", c.Set)
+		}
+		elem, err := FormatElement(typeName, c.Entry)
+		if err != nil {
+			return fmt.Errorf("restore: %v", err)
+		}
+		b.WriteByte(' ')
+		b.WriteString(c.Set)
+		b.WriteByte(' ')
+		b.WriteString(elem)
+		formatEntryOptions(&b, c.Entry)
+
+	case OpFlush, OpDestroy:
+		if c.Set != "" {
+			b.WriteByte(' ')
+			b.WriteString(c.Set)
+		}
+
+	case OpSwap, OpRename:
+		b.WriteByte(' ')
+		b.WriteString(c.Set)
+		b.WriteByte(' ')
+		b.WriteString(c.To)
+		if c.Op == OpSwap {
+			e.types[c.Set], e.types[c.To] = e.types[c.To], e.types[c.Set]
+		} else {
+			e.types[c.To] = e.types[c.Set]
+		}
+
+	default:
+		return fmt.Errorf("restore: invalid command %v", c.Op)
+	}
+
+	if c.Exist {
+		b.WriteString(" -exist")
+	}
+	b.WriteByte('\n')
+
+	_, err := io.WriteString(e.w, b.String())
+	return err
+}
+
+// Commands returns the commands recreating the given sets, in the
+// order `ipset save` prints them.
+func Commands(sets []ipset.SetPolicy) []Command {
+	var cmds []Command
+	for i := range sets {
+		p := &sets[i]
+		name := p.Name.Get()
+
+		cmds = append(cmds, Command{
+			Op:     OpCreate,
+			Set:    name,
+			Create: &ipset.CreatePolicy{HeaderPolicy: p.HeaderPolicy},
+		})
+		for _, e := range p.Entries {
+			cmds = append(cmds, Command{Op: OpAdd, Set: name, Entry: e})
+		}
+	}
+	return cmds
+}
+
+// Save writes the given sets in the format of `ipset save`.
+func Save(w io.Writer, sets []ipset.SetPolicy) error {
+	enc := NewEncoder(w)
+	cmds := Commands(sets)
+	for i := range cmds {
+		if err := enc.Encode(&cmds[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
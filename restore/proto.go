@@ -0,0 +1,152 @@
+package restore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	protoICMP    = 1
+	protoTCP     = 6
+	protoUDP     = 17
+	protoICMPv6  = 58
+	protoSCTP    = 132
+	protoUDPLite = 136
+)
+
+var protoNames = map[uint8]string{
+	protoICMP:    "icmp",
+	protoTCP:     "tcp",
+	protoUDP:     "udp",
+	47:           "gre",
+	50:           "esp",
+	51:           "ah",
+	protoICMPv6:  "icmpv6",
+	112:          "vrrp",
+	protoSCTP:    "sctp",
+	protoUDPLite: "udplite",
+}
+
+var protoNumbers = map[string]uint8{
+	"ipv6-icmp": protoICMPv6,
+}
+
+func init() {
+	for n, s := range protoNames {
+		protoNumbers[s] = n
+	}
+}
+
+type icmpType struct {
+	name      string
+	typ, code uint8
+}
+
+// ICMP type names as understood by ipset(8). The first name of a
+// type/code pair is used when printing.
+var icmpTypes = []icmpType{
+	{"echo-reply", 0, 0},
+	{"pong", 0, 0},
+	{"network-unreachable", 3, 0},
+	{"host-unreachable", 3, 1},
+	{"protocol-unreachable", 3, 2},
+	{"port-unreachable", 3, 3},
+	{"fragmentation-needed", 3, 4},
+	{"source-route-failed", 3, 5},
+	{"network-unknown", 3, 6},
+	{"host-unknown", 3, 7},
+	{"network-prohibited", 3, 9},
+	{"host-prohibited", 3, 10},
+	{"TOS-network-unreachable", 3, 11},
+	{"TOS-host-unreachable", 3, 12},
+	{"communication-prohibited", 3, 13},
+	{"host-precedence-violation", 3, 14},
+	{"precedence-cutoff", 3, 15},
+	{"source-quench", 4, 0},
+	{"network-redirect", 5, 0},
+	{"host-redirect", 5, 1},
+	{"TOS-network-redirect", 5, 2},
+	{"TOS-host-redirect", 5, 3},
+	{"echo-request", 8, 0},
+	{"ping", 8, 0},
+	{"router-advertisement", 9, 0},
+	{"router-solicitation", 10, 0},
+	{"ttl-zero-during-transit", 11, 0},
+	{"ttl-zero-during-reassembly", 11, 1},
+	{"ip-header-bad", 12, 0},
+	{"required-option-missing", 12, 1},
+	{"timestamp-request", 13, 0},
+	{"timestamp-reply", 14, 0},
+	{"address-mask-request", 17, 0},
+	{"address-mask-reply", 18, 0},
+}
+
+var icmpv6Types = []icmpType{
+	{"no-route", 1, 0},
+	{"communication-prohibited", 1, 1},
+	{"address-unreachable", 1, 3},
+	{"port-unreachable", 1, 4},
+	{"packet-too-big", 2, 0},
+	{"ttl-zero-during-transit", 3, 0},
+	{"ttl-zero-during-reassembly", 3, 1},
+	{"bad-header", 4, 0},
+	{"unknown-header-type", 4, 1},
+	{"unknown-option", 4, 2},
+	{"echo-request", 128, 0},
+	{"ping", 128, 0},
+	{"echo-reply", 129, 0},
+	{"pong", 129, 0},
+}
+
+func parseProto(s string) (uint8, error) {
+	if n, ok := protoNumbers[s]; ok {
+		return n, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown protocol %q", s)
+	}
+	return uint8(n), nil
+}
+
+func formatProto(n uint8) string {
+	if s, ok := protoNames[n]; ok {
+		return s
+	}
+	return strconv.Itoa(int(n))
+}
+
+// parseICMP parses an ICMP type given by name or as type/code into
+// the port value the kernel expects.
+func parseICMP(types []icmpType, s string) (uint16, error) {
+	for _, t := range types {
+		if strings.EqualFold(t.name, s) {
+			return uint16(t.typ)<<8 | uint16(t.code), nil
+		}
+	}
+
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid ICMP type %q", s)
+	}
+	typ, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ICMP type %q", s)
+	}
+	code, err := strconv.ParseUint(parts[1], 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ICMP code %q", s)
+	}
+	return uint16(typ)<<8 | uint16(code), nil
+}
+
+func formatICMP(types []icmpType, v uint16) string {
+	typ, code := uint8(v>>8), uint8(v)
+	for _, t := range types {
+		if t.typ == typ && t.code == code {
+			return t.name
+		}
+	}
+	return fmt.Sprintf("%d/%d", typ, code)
+}
@@ -0,0 +1,19 @@
+package restore
+
+import (
+	"io"
+
+	ipset "github.com/digineo/go-ipset/v2"
+)
+
+// Restore reads a restore file from r and applies it to c.
+// It is a shorthand for c.Restore(NewDecoder(r)).
+func Restore(c *ipset.Conn, r io.Reader) error {
+	return c.Restore(NewDecoder(r))
+}
+
+// Apply executes cmds on c like Restore.
+// It is a shorthand for c.RestoreCommands(cmds).
+func Apply(c *ipset.Conn, cmds []Command) error {
+	return c.RestoreCommands(cmds)
+}
@@ -0,0 +1,312 @@
+package restore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	ipset "github.com/digineo/go-ipset/v2"
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+const saved = `create foo hash:ip family inet hashsize 1024 maxelem 65536 bucketsize 12 initval 0x4b2785cd
+add foo 192.168.1.1
+add foo 192.168.1.2
+create bar hash:net,port family inet6 hashsize 2048 maxelem 1000 timeout 300 counters comment
+add bar 2001:db8::/64,tcp:80 timeout 100 packets 1 bytes 60 comment "web server"
+add bar 2001:db8:1::1,icmpv6:echo-request timeout 0 nomatch packets 0 bytes 0
+create baz hash:net,iface family inet hashsize 1024 maxelem 65536 skbinfo
+add baz 10.0.0.0/8,physdev:eth0 skbmark 0x1/0xff skbprio 1:10 skbqueue 3
+create mac bitmap:ip,mac range 10.0.0.0-10.0.255.255
+create ports bitmap:port range 1024-65535
+add ports 1024
+create marks hash:ip,mark family inet markmask 0x000000ff hashsize 1024 maxelem 65536
+add marks 10.1.1.1,0x0000002a
+create macs hash:mac hashsize 1024 maxelem 65536
+add macs 01:23:45:67:89:AB
+create chain list:set size 8 timeout 60
+add chain foo timeout 0
+add chain bar before foo timeout 30
+add chain baz after foo
+`
+
+func TestRoundTrip(t *testing.T) {
+	assert2 := assert.New(t)
+
+	cmds, err := Parse(strings.NewReader(saved))
+	if !assert2.NoError(err) {
+		return
+	}
+	assert2.Len(cmds, 19)
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for i := range cmds {
+		assert2.NoError(enc.Encode(&cmds[i]))
+	}
+	assert2.Equal(saved, buf.String())
+}
+
+func TestParse(t *testing.T) {
+	assert2 := assert.New(t)
+
+	cmds, err := Parse(strings.NewReader(saved))
+	if !assert2.NoError(err) {
+		return
+	}
+
+	c := cmds[0]
+	assert2.Equal(OpCreate, c.Op)
+	assert2.Equal(1, c.Line)
+	assert2.Equal("hash:ip", c.Create.TypeName.Get())
+	assert2.Equal(uint32(1024), c.Create.Data.HashSize.Get())
+	assert2.Equal(uint8(12), c.Create.Data.Probes.Get())
+
+	c = cmds[4]
+	assert2.Equal(OpAdd, c.Op)
+	assert2.Equal("bar", c.Set)
+	assert2.Equal(net.ParseIP("2001:db8::"), c.Entry.IP.Get())
+	assert2.Equal(uint8(64), c.Entry.Cidr.Get())
+	assert2.Equal(uint8(6), c.Entry.Proto.Get())
+	assert2.Equal(uint16(80), c.Entry.Port.Get())
+	assert2.Equal(100*time.Second, c.Entry.Timeout.Get())
+	assert2.Equal("web server", c.Entry.Comment.Get())
+
+	c = cmds[5]
+	assert2.Equal(uint16(128<<8), c.Entry.Port.Get())
+	assert2.Equal(uint32(ipset.NoMatch), c.Entry.CadtFlags.Get())
+
+	c = cmds[7]
+	assert2.Equal("eth0", c.Entry.Iface.Get())
+	assert2.Equal(uint32(ipset.PhysDev), c.Entry.CadtFlags.Get())
+	assert2.Equal(uint64(0x1<<32|0xff), c.Entry.Skbmark.Get())
+	assert2.Equal(uint32(0x1<<16|0x10), c.Entry.Skbprio.Get())
+
+	c = cmds[8]
+	assert2.Equal(net.ParseIP("10.0.0.0").To4(), c.Create.Data.IP.Get())
+	assert2.Equal(net.ParseIP("10.0.255.255").To4(), c.Create.Data.IPTo.Get())
+	assert2.False(c.Create.Data.Cidr.IsSet())
+	c = cmds[9]
+	assert2.Equal(uint16(1024), c.Create.Data.Port.Get())
+	assert2.Equal(uint16(65535), c.Create.Data.PortTo.Get())
+	c = cmds[10]
+	assert2.Equal(uint16(1024), c.Entry.Port.Get())
+	assert2.False(c.Entry.PortTo.IsSet())
+
+	c = cmds[17]
+	assert2.Equal("bar", c.Entry.Name.Get())
+	assert2.Equal("foo", c.Entry.NameRef.Get())
+	assert2.Equal(uint32(ipset.Before), c.Entry.CadtFlags.Get())
+	c = cmds[18]
+	assert2.Equal("foo", c.Entry.NameRef.Get())
+	assert2.False(c.Entry.CadtFlags.IsSet())
+}
+
+func TestParse_Commands(t *testing.T) {
+	assert2 := assert.New(t)
+
+	d := NewDecoder(strings.NewReader(`# comment
+-A existing 10.0.0.1 -exist
+swap existing other
+rename other renamed
+add renamed 10.0.0.2
+flush
+destroy renamed
+`))
+	d.SetType("existing", "hash:ip")
+
+	var ops []Op
+	for {
+		c, err := d.Decode()
+		if err != nil {
+			assert2.EqualError(err, "EOF")
+			break
+		}
+		ops = append(ops, c.Op)
+		if c.Op == OpAdd {
+			assert2.Equal(c.Line == 2, c.Exist)
+		}
+	}
+	assert2.Equal([]Op{OpAdd, OpSwap, OpRename, OpAdd, OpFlush, OpDestroy}, ops)
+}
+
+func TestParse_Errors(t *testing.T) {
+	for line, msg := range map[string]string{
+		"add foo 10.0.0.1":                                        "restore: line 1: unknown set \"foo\"",
+		"create foo hash:ip family ipx":                           "restore: line 1: invalid family \"ipx\"",
+		"create foo hash:ip hashsize":                             "restore: line 1: missing value for option \"hashsize\"",
+		"create foo bitmap:port range 1024":                       "restore: line 1: invalid range \"1024\"",
+		"create foo hash:ip range 10.0.0.0/8":                     "restore: line 1: option range is not supported by hash:ip",
+		"list foo":                                                "restore: line 1: unknown command \"list\"",
+		"create foo hash:ip,port\nadd foo 1.2.3.4":                "restore: line 2: element \"1.2.3.4\" does not match set type hash:ip,port",
+		"create foo hash:ip comment\nadd foo 1.2.3.4 comment \"x": "restore: line 2: unterminated quoted string",
+		"create foo hash:ip comment\nadd foo 1.2.3.4 comment " + strings.Repeat("x", 256): "restore: line 2: comment is longer than 255 bytes",
+	} {
+		_, err := Parse(strings.NewReader(line))
+		assert.EqualError(t, err, msg)
+	}
+}
+
+func TestSave(t *testing.T) {
+	assert2 := assert.New(t)
+
+	sets := []ipset.SetPolicy{{
+		HeaderPolicy: ipset.HeaderPolicy{
+			NamePolicy: ipset.NamePolicy{Name: ipset.NewNullStringBox("foo")},
+			TypeName:   ipset.NewNullStringBox("hash:ip"),
+			Family:     ipset.NewUInt8Box(2),
+		},
+		Entries: ipset.Entries{
+			ipset.NewEntry(ipset.EntryIP(net.IP{10, 0, 0, 1})),
+			ipset.NewEntry(ipset.EntryIP(net.IP{10, 0, 0, 2}), ipset.EntryTimeout(5*time.Second)),
+		},
+	}, {
+		HeaderPolicy: ipset.HeaderPolicy{
+			NamePolicy: ipset.NamePolicy{Name: ipset.NewNullStringBox("marks")},
+			TypeName:   ipset.NewNullStringBox("hash:ip,mark"),
+			Family:     ipset.NewUInt8Box(2),
+			Data: &ipset.CreateData{
+				HashSize: ipset.NewUInt32Box(1024),
+				MaxElem:  ipset.NewUInt32Box(65536),
+				MarkMask: ipset.NewUInt32Box(0xffff0000),
+				Probes:   ipset.NewUInt8Box(12),
+				InitVal:  ipset.NewUInt32Box(0x2cb1a6d4),
+			},
+		},
+		Entries: ipset.Entries{
+			ipset.NewEntry(ipset.EntryIP(net.IP{10, 0, 0, 1}), ipset.EntryMark(0x10000)),
+		},
+	}}
+
+	// As printed by ipset save.
+	want := `create foo hash:ip family inet
+add foo 10.0.0.1
+add foo 10.0.0.2 timeout 5
+create marks hash:ip,mark family inet markmask 0xffff0000 hashsize 1024 maxelem 65536 bucketsize 12 initval 0x2cb1a6d4
+add marks 10.0.0.1,0x00010000
+`
+	var buf bytes.Buffer
+	if assert2.NoError(Save(&buf, sets)) {
+		assert2.Equal(want, buf.String())
+	}
+}
+
+// recorder is a connector recording the requests sent by Restore.
+type recorder struct {
+	cmds    []netfilter.MessageType
+	entries []int
+}
+
+func (r *recorder) Close() error { return nil }
+
+func (r *recorder) Query(nlm netlink.Message) ([]netlink.Message, error) {
+	h, attrs, err := netfilter.UnmarshalNetlink(nlm)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries int
+	for _, attr := range attrs {
+		if attr.Type == uint16(ipset.AttrADT) {
+			entries = len(attr.Children)
+		}
+	}
+	r.cmds = append(r.cmds, h.MessageType)
+	r.entries = append(r.entries, entries)
+
+	if h.MessageType == netfilter.MessageType(ipset.CmdType) {
+		res, err := netfilter.MarshalNetlink(netfilter.Header{}, []netfilter.Attribute{
+			{Type: uint16(ipset.AttrRevision), Data: []byte{6}},
+		})
+		return []netlink.Message{res}, err
+	}
+	return nil, nil
+}
+
+func TestRestore(t *testing.T) {
+	assert2 := assert.New(t)
+
+	var b strings.Builder
+	b.WriteString("create foo hash:ip\ncreate bar hash:ip\n")
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(&b, "add foo 10.0.%d.%d\n", i/256, i%256)
+	}
+	b.WriteString("add bar 10.1.0.1\ndel foo 10.0.0.1\ncreate -exist baz hash:ip\nswap foo bar\n")
+
+	r := &recorder{}
+	err := Restore(&ipset.Conn{Family: netfilter.ProtoIPv4, Conn: r, BatchSize: 4}, strings.NewReader(b.String()))
+	if !assert2.NoError(err) {
+		return
+	}
+
+	// The revision of hash:ip is queried once.
+	assert2.Equal([]netfilter.MessageType{
+		netfilter.MessageType(ipset.CmdType), netfilter.MessageType(ipset.CmdCreate), netfilter.MessageType(ipset.CmdCreate),
+		netfilter.MessageType(ipset.CmdAdd), netfilter.MessageType(ipset.CmdAdd), netfilter.MessageType(ipset.CmdAdd),
+		netfilter.MessageType(ipset.CmdDel), netfilter.MessageType(ipset.CmdCreate), netfilter.MessageType(ipset.CmdSwap),
+	}, r.cmds)
+	assert2.Equal([]int{0, 0, 0, 4, 1, 1, 1, 0, 0}, r.entries)
+}
+
+func TestRestore_Exist(t *testing.T) {
+	assert2 := assert.New(t)
+	c := &ipset.Conn{Family: netfilter.ProtoIPv4, Conn: ipset.NewFakeKernel()}
+
+	assert2.NoError(Restore(c, strings.NewReader("create foo hash:ip\nadd foo 10.0.0.1\nadd -exist foo 10.0.0.1\ndel -exist foo 10.0.0.2\n")))
+
+	// Without -exist, adding present elements and deleting missing ones fails.
+	err := Restore(c, strings.NewReader("create -exist foo hash:ip\nadd foo 10.0.0.2\nadd foo 10.0.0.1\n"))
+	assert2.True(errors.Is(err, ipset.ErrElementExists))
+	err = Restore(c, strings.NewReader("create -exist foo hash:ip\ndel foo 10.0.0.2\ndel foo 10.0.0.3\n"))
+	assert2.True(errors.Is(err, ipset.ErrElementNotFound))
+
+	p, err := c.List("foo")
+	if assert2.NoError(err) {
+		assert2.Len(p.Entries, 1)
+	}
+}
+
+func TestRestore_ListSet(t *testing.T) {
+	assert2 := assert.New(t)
+	c := &ipset.Conn{Family: netfilter.ProtoIPv4, Conn: ipset.NewFakeKernel()}
+
+	err := Restore(c, strings.NewReader(`create foo hash:ip
+create bar hash:ip
+create baz hash:net
+create chain list:set
+add chain foo
+add chain bar before foo
+add chain baz after foo
+`))
+	if !assert2.NoError(err) {
+		return
+	}
+
+	members, err := c.Members("chain")
+	if assert2.NoError(err) {
+		assert2.Equal([]string{"bar", "foo", "baz"}, members)
+	}
+
+	err = Restore(c, strings.NewReader("create -exist chain list:set\nadd chain missing\n"))
+	assert2.True(errors.Is(err, ipset.ErrMemberSetNotFound))
+}
+
+func TestRestore_SyntaxError(t *testing.T) {
+	assert2 := assert.New(t)
+
+	r := &recorder{}
+	err := Restore(&ipset.Conn{Conn: r}, strings.NewReader("create foo hash:ip\nadd foo 10.0.0.1\nadd foo bogus\n"))
+
+	var serr *SyntaxError
+	if assert2.True(errors.As(err, &serr)) {
+		assert2.Equal(3, serr.Line)
+	}
+	// Commands preceding the malformed line have been applied.
+	assert2.Equal([]int{0, 0, 1}, r.entries)
+}
@@ -0,0 +1,80 @@
+package ipset
+
+import (
+	"context"
+	stderrors "errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+// commandList is a RestoreDecoder returning cmds, followed by err.
+type commandList struct {
+	cmds []RestoreCommand
+	err  error
+}
+
+func (l *commandList) Decode() (*RestoreCommand, error) {
+	if len(l.cmds) == 0 {
+		return nil, l.err
+	}
+	cmd := &l.cmds[0]
+	l.cmds = l.cmds[1:]
+	return cmd, nil
+}
+
+func restoreAdd(set string, line int, ip string) RestoreCommand {
+	entry := NewEntry(EntryLineno(uint32(line)), EntryIP(net.ParseIP(ip)))
+	return RestoreCommand{Op: RestoreAdd, Line: line, Set: set, Entry: entry}
+}
+
+func TestConn_Restore(t *testing.T) {
+	assert2 := assert.New(t)
+	c, _ := newFakeConn()
+
+	create := &CreatePolicy{HeaderPolicy: HeaderPolicy{TypeName: NewNullStringBox(HashIP.Name)}}
+	err := c.Restore(&commandList{cmds: []RestoreCommand{
+		{Op: RestoreCreate, Line: 1, Set: "foo", Create: create},
+		restoreAdd("foo", 2, "10.0.0.1"),
+		restoreAdd("foo", 3, "10.0.0.2"),
+		{Op: RestoreRename, Line: 4, Set: "foo", To: "bar"},
+	}, err: io.EOF})
+	assert2.NoError(err)
+	assert2.Equal([]string{"10.0.0.1", "10.0.0.2"}, listIPs(t, c, "bar"))
+
+	// The kernel reports the input line of a rejected entry.
+	err = c.Restore(&commandList{cmds: []RestoreCommand{
+		restoreAdd("bar", 1, "10.0.0.3"),
+		restoreAdd("bar", 2, "10.0.0.1"),
+	}, err: io.EOF})
+	assert2.True(stderrors.Is(err, ErrElementExists), "%v", err)
+	var e *Error
+	if assert2.True(stderrors.As(err, &e)) {
+		assert2.Equal(uint32(2), e.Line)
+	}
+
+	// Pending commands are applied before a decoding error is returned.
+	errDecode := stderrors.New("decode")
+	err = c.Restore(&commandList{cmds: []RestoreCommand{restoreAdd("bar", 1, "10.0.0.4")}, err: errDecode})
+	assert2.Equal(errDecode, err)
+	assert2.Contains(listIPs(t, c, "bar"), "10.0.0.4")
+}
+
+func TestRestorer_MaxPending(t *testing.T) {
+	assert2 := assert.New(t)
+	c, _ := newFakeConn()
+	assert2.NoError(c.Create("foo", HashIP.Name, 0, netfilter.ProtoIPv4, CreateDataMaxElem(2*maxPending)))
+
+	rs := newRestorer(context.Background(), c)
+	for i := 0; i < maxPending; i++ {
+		cmd := restoreAdd("foo", i+1, net.IPv4(10, 0, byte(i>>8), byte(i)).String())
+		assert2.NoError(rs.apply(&cmd))
+	}
+
+	// The pending entries are sent once there are maxPending of them.
+	assert2.Empty(rs.entries)
+	assert2.Len(listIPs(t, c, "foo"), maxPending)
+}
@@ -0,0 +1,595 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/netfilter"
+)
+
+// SetType describes a set type of the kernel: the Entry fields its elements
+// consist of and the CreateData options it accepts. Extensions and options
+// introduced by a later revision of the type are only accepted from that
+// revision on.
+//
+// Set types validate entries client-side, so that mistakes like a port in
+// an entry of a hash:ip set are reported without a round trip to the kernel:
+//
+//	s := c.Set("blocklist", ipset.HashNet)
+//	err := s.Create(netfilter.ProtoIPv4, ipset.CreateDataTimeout(time.Hour))
+//	err = s.Add(ipset.NewEntry(ipset.EntryIP(ip), ipset.EntryCidr(24)))
+type SetType struct {
+	// Name is the name of the type as known to the kernel.
+	Name string
+	// Revision is the latest revision of the type described.
+	Revision uint8
+
+	dims []string
+	revs featureRevisions
+}
+
+// featureRevisions holds the revisions a set type gained support
+// for optional features with, or unsupported if it lacks them.
+type featureRevisions struct {
+	counters   uint8
+	comment    uint8
+	forceadd   uint8
+	skbinfo    uint8
+	bucketsize uint8
+	nomatch    uint8
+	netmask    uint8
+}
+
+const unsupported = 0xff
+
+// Set types supported by the kernel, at the revision of Linux 6.x.
+var (
+	HashIP = &SetType{Name: "hash:ip", Revision: 6, dims: []string{"ip"},
+		revs: featureRevisions{1, 2, 3, 4, 5, unsupported, 0}}
+	HashIPMac = &SetType{Name: "hash:ip,mac", Revision: 1, dims: []string{"ip", "mac"},
+		revs: featureRevisions{0, 0, 0, 0, 1, unsupported, unsupported}}
+	HashIPMark = &SetType{Name: "hash:ip,mark", Revision: 3, dims: []string{"ip", "mark"},
+		revs: featureRevisions{0, 0, 1, 2, 3, unsupported, unsupported}}
+	HashIPPort = &SetType{Name: "hash:ip,port", Revision: 7, dims: []string{"ip", "port"},
+		revs: featureRevisions{2, 3, 4, 5, 6, unsupported, 7}}
+	HashIPPortIP = &SetType{Name: "hash:ip,port,ip", Revision: 6, dims: []string{"ip", "port", "ip"},
+		revs: featureRevisions{2, 3, 4, 5, 6, unsupported, unsupported}}
+	HashIPPortNet = &SetType{Name: "hash:ip,port,net", Revision: 8, dims: []string{"ip", "port", "net"},
+		revs: featureRevisions{4, 5, 6, 7, 8, 3, unsupported}}
+	HashMac = &SetType{Name: "hash:mac", Revision: 1, dims: []string{"mac"},
+		revs: featureRevisions{0, 0, 0, 0, 1, unsupported, unsupported}}
+	HashNet = &SetType{Name: "hash:net", Revision: 7, dims: []string{"net"},
+		revs: featureRevisions{3, 4, 5, 6, 7, 2, unsupported}}
+	HashNetIface = &SetType{Name: "hash:net,iface", Revision: 8, dims: []string{"net", "iface"},
+		revs: featureRevisions{3, 4, 5, 6, 8, 1, unsupported}}
+	HashNetNet = &SetType{Name: "hash:net,net", Revision: 4, dims: []string{"net", "net"},
+		revs: featureRevisions{0, 0, 1, 2, 3, 0, 4}}
+	HashNetPort = &SetType{Name: "hash:net,port", Revision: 8, dims: []string{"net", "port"},
+		revs: featureRevisions{4, 5, 6, 7, 8, 3, unsupported}}
+	HashNetPortNet = &SetType{Name: "hash:net,port,net", Revision: 3, dims: []string{"net", "port", "net"},
+		revs: featureRevisions{0, 0, 1, 2, 3, 0, unsupported}}
+	BitmapIP = &SetType{Name: "bitmap:ip", Revision: 3, dims: []string{"ip"},
+		revs: featureRevisions{1, 2, unsupported, 3, unsupported, unsupported, 0}}
+	BitmapIPMac = &SetType{Name: "bitmap:ip,mac", Revision: 3, dims: []string{"ip", "mac"},
+		revs: featureRevisions{1, 2, unsupported, 3, unsupported, unsupported, unsupported}}
+	BitmapPort = &SetType{Name: "bitmap:port", Revision: 3, dims: []string{"port"},
+		revs: featureRevisions{1, 2, unsupported, 3, unsupported, unsupported, unsupported}}
+	ListSet = &SetType{Name: "list:set", Revision: 3, dims: []string{"set"},
+		revs: featureRevisions{1, 2, unsupported, 3, unsupported, unsupported, unsupported}}
+)
+
+var setTypes = []*SetType{
+	HashIP, HashIPMac, HashIPMark, HashIPPort, HashIPPortIP, HashIPPortNet,
+	HashMac, HashNet, HashNetIface, HashNetNet, HashNetPort, HashNetPortNet,
+	BitmapIP, BitmapIPMac, BitmapPort, ListSet,
+}
+
+// LookupSetType returns the set type with the given name, or nil if it is unknown.
+func LookupSetType(name string) *SetType {
+	for _, t := range setTypes {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (t *SetType) String() string {
+	return t.Name
+}
+
+func (t *SetType) hash() bool {
+	return strings.HasPrefix(t.Name, "hash:")
+}
+
+func (t *SetType) bitmap() bool {
+	return strings.HasPrefix(t.Name, "bitmap:")
+}
+
+func (t *SetType) list() bool {
+	return strings.HasPrefix(t.Name, "list:")
+}
+
+func (t *SetType) has(dim string) bool {
+	for _, d := range t.dims {
+		if d == dim {
+			return true
+		}
+	}
+	return false
+}
+
+// Errors returned by the validation of entries and create options.
+var (
+	ErrFieldUnsupported = errors.New("not supported by the set type")
+	ErrFieldMissing     = errors.New("required by the set type")
+	ErrCommentTooLong   = errors.New("is longer than MaxCommentSize")
+)
+
+// FieldError reports an Entry field or CreateData option a set type
+// does not support at a revision, or a field it requires.
+type FieldError struct {
+	// Type is the set type the value was validated against.
+	Type *SetType
+	// Revision is the revision of Type.
+	Revision uint8
+	// Field is the name of the Entry or CreateData field.
+	Field string
+	// Err is ErrFieldUnsupported, ErrFieldMissing or ErrCommentTooLong.
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	return e.Type.Name + ": " + e.Field + " " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+type field struct {
+	name string
+	set  bool
+}
+
+// entryFields lists the fields of e the element is made up of.
+func entryFields(e *Entry) []field {
+	return []field{
+		{"IP", e.IP.IsSet()},
+		{"IPTo", e.IPTo.IsSet()},
+		{"Cidr", e.Cidr.IsSet()},
+		{"Port", e.Port.IsSet()},
+		{"PortTo", e.PortTo.IsSet()},
+		{"Proto", e.Proto.IsSet()},
+		{"IP2", e.IP2.IsSet()},
+		{"IP2To", e.IP2To.IsSet()},
+		{"Cidr2", e.Cidr2.IsSet()},
+		{"Ether", e.Ether.IsSet()},
+		{"Iface", e.Iface.IsSet()},
+		{"Mark", e.Mark.IsSet()},
+		{"Name", e.Name.IsSet()},
+		{"NameRef", e.NameRef.IsSet()},
+		{"Packets", e.Packets.IsSet()},
+		{"Bytes", e.Bytes.IsSet()},
+		{"Comment", e.Comment.IsSet()},
+		{"Skbmark", e.Skbmark.IsSet()},
+		{"Skbprio", e.Skbprio.IsSet()},
+		{"Skbqueue", e.Skbqueue.IsSet()},
+	}
+}
+
+// entryFields returns the element fields a set of type t accepts
+// at the revision and those which are required.
+func (t *SetType) entryFields(revision uint8) (allowed, required map[string]bool) {
+	allowed, required = make(map[string]bool), make(map[string]bool)
+	add := func(req bool, names ...string) {
+		for _, name := range names {
+			allowed[name] = true
+		}
+		if req {
+			required[names[0]] = true
+		}
+	}
+
+	second := false
+	for _, dim := range t.dims {
+		switch dim {
+		case "ip", "net":
+			switch {
+			case !second:
+				add(true, "IP", "IPTo", "Cidr")
+			case dim == "ip":
+				add(true, "IP2")
+			default:
+				add(true, "IP2", "IP2To", "Cidr2")
+			}
+			second = true
+		case "port":
+			add(true, "Port", "PortTo")
+			add(t.hash(), "Proto")
+		case "mac":
+			add(t.hash(), "Ether")
+		case "iface":
+			add(true, "Iface")
+		case "mark":
+			add(true, "Mark")
+		case "set":
+			add(true, "Name", "NameRef")
+		}
+	}
+	if t.bitmap() && t.has("mac") {
+		// bitmap:ip,mac stores single addresses only.
+		delete(allowed, "IPTo")
+		delete(allowed, "Cidr")
+	}
+
+	if revision >= t.revs.counters {
+		add(false, "Packets", "Bytes")
+	}
+	if revision >= t.revs.comment {
+		add(false, "Comment")
+	}
+	if revision >= t.revs.skbinfo {
+		add(false, "Skbmark", "Skbprio", "Skbqueue")
+	}
+	return allowed, required
+}
+
+// entryFlags returns the CadtFlags the elements of t accept at the revision.
+func (t *SetType) entryFlags(revision uint8) CadtFlags {
+	var flags CadtFlags
+	if revision >= t.revs.nomatch {
+		flags |= NoMatch
+	}
+	if t.has("iface") {
+		flags |= PhysDev
+	}
+	if t.list() {
+		flags |= Before
+	}
+	return flags
+}
+
+// ValidateEntry checks that e consists of the fields the elements of
+// a set of type t at the revision are made of. The timeout and line
+// number are accepted for any type. A *FieldError is returned for the
+// first unsupported field or, if there is none, the first missing one,
+// including the NameRef the Before flag requires, or for a comment longer
+// than MaxCommentSize.
+func (t *SetType) ValidateEntry(revision uint8, e *Entry) error {
+	allowed, required := t.entryFields(revision)
+	fields := entryFields(e)
+	for _, f := range fields {
+		if f.set && !allowed[f.name] {
+			return t.fieldError(revision, f.name, ErrFieldUnsupported)
+		}
+	}
+	if CadtFlags(e.CadtFlags.Get())&^t.entryFlags(revision) != 0 {
+		return t.fieldError(revision, "CadtFlags", ErrFieldUnsupported)
+	}
+
+	for _, f := range fields {
+		if !f.set && required[f.name] {
+			return t.fieldError(revision, f.name, ErrFieldMissing)
+		}
+	}
+	if CadtFlags(e.CadtFlags.Get())&Before != 0 && !e.NameRef.IsSet() {
+		return t.fieldError(revision, "NameRef", ErrFieldMissing)
+	}
+
+	if len(e.Comment.Get()) > MaxCommentSize {
+		return t.fieldError(revision, "Comment", ErrCommentTooLong)
+	}
+	return nil
+}
+
+// createFlags returns the CadtFlags t accepts on creation at the revision.
+func (t *SetType) createFlags(revision uint8) CadtFlags {
+	var flags CadtFlags
+	if revision >= t.revs.counters {
+		flags |= WithCounters
+	}
+	if revision >= t.revs.comment {
+		flags |= WithComment
+	}
+	if revision >= t.revs.forceadd {
+		flags |= WithForceDdd
+	}
+	if revision >= t.revs.skbinfo {
+		flags |= WithSkbInfo
+	}
+	return flags
+}
+
+// ValidateCreateData checks that d only holds options a set of type t
+// accepts at the revision, and the range bitmap types require. A nil d
+// is treated like empty options. A *FieldError is returned for the first
+// unsupported option or, if there is none, the first missing one.
+func (t *SetType) ValidateCreateData(revision uint8, d *CreateData) error {
+	if d == nil {
+		d = &CreateData{}
+	}
+
+	ipRange := t.bitmap() && t.has("ip")
+	portRange := t.bitmap() && t.has("port")
+	bucketsize := revision >= t.revs.bucketsize
+	options := []struct {
+		field
+		allowed bool
+	}{
+		{field{"HashSize", d.HashSize.IsSet()}, t.hash()},
+		{field{"MaxElem", d.MaxElem.IsSet()}, t.hash()},
+		{field{"Resize", d.Resize.IsSet()}, t.hash()},
+		{field{"Probes", d.Probes.IsSet()}, bucketsize},
+		{field{"InitVal", d.InitVal.IsSet()}, bucketsize},
+		{field{"NetMask", d.NetMask.IsSet()}, revision >= t.revs.netmask},
+		{field{"MarkMask", d.MarkMask.IsSet()}, t.has("mark")},
+		{field{"Size", d.Size.IsSet()}, t.list()},
+		{field{"Proto", d.Proto.IsSet()}, false},
+		{field{"IP", d.IP.IsSet()}, ipRange},
+		{field{"IPTo", d.IPTo.IsSet()}, ipRange},
+		{field{"Cidr", d.Cidr.IsSet()}, ipRange},
+		{field{"Port", d.Port.IsSet()}, portRange},
+		{field{"PortTo", d.PortTo.IsSet()}, portRange},
+	}
+	for _, o := range options {
+		if o.set && !o.allowed {
+			return t.fieldError(revision, o.name, ErrFieldUnsupported)
+		}
+	}
+
+	if CadtFlags(d.CadtFlags.Get())&^t.createFlags(revision) != 0 {
+		return t.fieldError(revision, "CadtFlags", ErrFieldUnsupported)
+	}
+
+	// The range of bitmaps is given as first and last value,
+	// or as network for addresses.
+	switch {
+	case ipRange && !d.IP.IsSet():
+		return t.fieldError(revision, "IP", ErrFieldMissing)
+	case ipRange && !d.IPTo.IsSet() && !d.Cidr.IsSet():
+		return t.fieldError(revision, "IPTo", ErrFieldMissing)
+	case portRange && !d.Port.IsSet():
+		return t.fieldError(revision, "Port", ErrFieldMissing)
+	case portRange && !d.PortTo.IsSet():
+		return t.fieldError(revision, "PortTo", ErrFieldMissing)
+	}
+	return nil
+}
+
+func (t *SetType) fieldError(revision uint8, name string, err error) error {
+	return &FieldError{Type: t, Revision: revision, Field: name, Err: err}
+}
+
+// Set is a set of a known type. Its methods validate entries and create
+// options against the type and revision before passing them on to the Conn.
+// Validation errors are returned as *Error wrapping a *FieldError, or
+// ErrOutOfRange for entries outside the range of a bitmap set.
+type Set struct {
+	// Name is the name of the set.
+	Name string
+	// Type is the type of the set.
+	Type *SetType
+	// Revision is the revision of the type the set is created with and
+	// entries are validated against. It defaults to Type.Revision and may
+	// be lowered to the revision reported by Conn.Type for older kernels.
+	Revision uint8
+	// ExpandRanges makes Add and Delete split address ranges of network
+	// dimensions into networks before sending them, like the kernel does
+	// with ranges it receives. The entries sent then match the elements
+	// stored, and ranges work for IPv6 sets as well.
+	ExpandRanges bool
+
+	c *Conn
+
+	mu    sync.Mutex
+	data  *CreateData // create options of bitmap sets
+	known bool        // whether data was determined, it is nil if that failed
+}
+
+// Set returns a handle to the set name of type t.
+func (c *Conn) Set(name string, t *SetType) *Set {
+	return &Set{Name: name, Type: t, Revision: t.Revision, c: c}
+}
+
+// Create creates the set, failing if it exists.
+func (s *Set) Create(family netfilter.ProtoFamily, options ...CreateDataOption) error {
+	if err := s.validateCreateData(CmdCreate, options); err != nil {
+		return err
+	}
+	if err := s.c.Create(s.Name, s.Type.Name, s.Revision, family, options...); err != nil {
+		return err
+	}
+	s.setCreateData(options)
+	return nil
+}
+
+// Replace creates the set, succeeding if an identical set exists.
+func (s *Set) Replace(family netfilter.ProtoFamily, options ...CreateDataOption) error {
+	if err := s.validateCreateData(CmdCreate, options); err != nil {
+		return err
+	}
+	if err := s.c.Replace(s.Name, s.Type.Name, s.Revision, family, options...); err != nil {
+		return err
+	}
+	s.setCreateData(options)
+	return nil
+}
+
+// Add validates all entries and adds them to the set. The entries of
+// bitmap sets are checked against the range of the set, which is taken
+// from Create or Replace, or else read from the kernel once. Entries out
+// of that range make it read again, in case the set was recreated.
+func (s *Set) Add(entries ...*Entry) error {
+	if err := s.validateEntries(CmdAdd, entries); err != nil {
+		return err
+	}
+	return s.executeEntries(CmdAdd, 0, entries)
+}
+
+// AddExclusive validates all entries and adds them to the set,
+// failing for elements already in it.
+func (s *Set) AddExclusive(entries ...*Entry) error {
+	if err := s.validateEntries(CmdAdd, entries); err != nil {
+		return err
+	}
+	return s.executeEntries(CmdAdd, netlink.Excl, entries)
+}
+
+// Delete validates all entries and deletes them from the set.
+func (s *Set) Delete(entries ...*Entry) error {
+	if err := s.validateEntries(CmdDel, entries); err != nil {
+		return err
+	}
+	return s.executeEntries(CmdDel, 0, entries)
+}
+
+// DeleteExclusive validates all entries and deletes them from the set,
+// failing for elements not in it.
+func (s *Set) DeleteExclusive(entries ...*Entry) error {
+	if err := s.validateEntries(CmdDel, entries); err != nil {
+		return err
+	}
+	return s.executeEntries(CmdDel, netlink.Excl, entries)
+}
+
+// Test validates the entry and tests whether it is in the set.
+func (s *Set) Test(options ...EntryOption) error {
+	e := NewEntry(options...)
+	if err := s.Type.ValidateEntry(s.Revision, e); err != nil {
+		return &Error{Cmd: CmdTest, Set: s.Name, Entry: e, Err: err}
+	}
+	return s.c.test(context.Background(), s.Name, s.Type.Name, e)
+}
+
+func (s *Set) validateCreateData(cmd messageType, options []CreateDataOption) error {
+	if err := s.Type.ValidateCreateData(s.Revision, newCreateData(options...)); err != nil {
+		return &Error{Cmd: cmd, Set: s.Name, Err: err}
+	}
+	return nil
+}
+
+// Reset forgets the range of a bitmap set, so that it is read from the
+// kernel again before entries are validated, e.g. after the set has been
+// created other than by s.
+func (s *Set) Reset() {
+	s.mu.Lock()
+	s.data, s.known = nil, false
+	s.mu.Unlock()
+}
+
+// setCreateData remembers the create options of bitmap sets,
+// which hold the range of the set.
+func (s *Set) setCreateData(options []CreateDataOption) {
+	if !s.Type.bitmap() {
+		return
+	}
+	s.mu.Lock()
+	s.data, s.known = newCreateData(options...), true
+	s.mu.Unlock()
+}
+
+// createData returns the create options of a bitmap set, reading them from
+// the kernel if unknown, and whether they were read just now. It returns
+// nil if they cannot be determined, so that the kernel checks the entries
+// instead. A failed attempt is not repeated until Reset.
+func (s *Set) createData() (*CreateData, bool) {
+	if !s.Type.bitmap() {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.known {
+		return s.data, false
+	}
+	s.data = nil
+	if h, err := s.c.Header(s.Name); err == nil && h.TypeName.Get() == s.Type.Name {
+		s.data = h.Data
+	}
+	s.known = true
+	return s.data, true
+}
+
+// result forgets the range of the set if the kernel rejected an entry
+// out of range, which the range at hand let pass, and restores the entry
+// of an *Error.
+func (s *Set) result(err error, entries []*Entry) error {
+	if errors.Is(err, ErrOutOfRange) {
+		s.Reset()
+	}
+	return s.restoreEntry(err, entries)
+}
+
+// expandRanges splits the ranges of entries if ExpandRanges is set. The
+// networks of a range share the line number of the range.
+func (s *Set) expandRanges(entries []*Entry) ([]*Entry, error) {
+	if !s.ExpandRanges {
+		return entries, nil
+	}
+	return s.Type.ExpandRanges(Entries(entries).numbered(0))
+}
+
+// executeEntries sends the entries like Conn.Add and Conn.Delete do,
+// resolving errors with the type of the set.
+func (s *Set) executeEntries(t messageType, flags netlink.HeaderFlags, entries []*Entry) error {
+	expanded, err := s.expandRanges(entries)
+	if err != nil {
+		// Nothing has been sent for a range the kernel would reject.
+		var e *Error
+		if errors.As(err, &e) {
+			e.Cmd, e.Set = t, s.Name
+			e.Entry = Entries(entries).lookup(0, e.Line)
+		}
+		return err
+	}
+	err = s.c.executeEntries(context.Background(), t, flags, s.Name, s.Type.Name, expanded)
+	return s.result(err, entries)
+}
+
+// restoreEntry replaces the entry of an *Error returned for expanded
+// entries by the one passed in by the caller, and counts the entries
+// applied before it. The networks of the rejected range may have been
+// applied in part.
+func (s *Set) restoreEntry(err error, entries []*Entry) error {
+	var e *Error
+	if s.ExpandRanges && errors.As(err, &e) && e.Line != 0 {
+		e.Entry = Entries(entries).lookup(0, e.Line)
+		e.Applied = applied(entries, e.Entry)
+	}
+	return err
+}
+
+// validateEntries checks the entries against the set type and the range
+// of the set. If a range known before rejects an entry, it is read from
+// the kernel again and the entries are checked once more.
+func (s *Set) validateEntries(cmd messageType, entries []*Entry) error {
+	d, fresh := s.createData()
+	err := s.checkEntries(cmd, entries, d)
+	if !fresh && errors.Is(err, ErrOutOfRange) {
+		s.Reset()
+		d, _ = s.createData()
+		err = s.checkEntries(cmd, entries, d)
+	}
+	return err
+}
+
+func (s *Set) checkEntries(cmd messageType, entries []*Entry, d *CreateData) error {
+	for i, e := range entries {
+		err := s.Type.ValidateEntry(s.Revision, e)
+		if err == nil {
+			err = s.Type.ValidateRange(d, e)
+		}
+		if err != nil {
+			line := uint32(i + 1)
+			if e.Lineno.IsSet() {
+				line = e.Lineno.Get()
+			}
+			return &Error{Cmd: cmd, Set: s.Name, Entry: e, Line: line, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package ipset
+
+import (
+	stderrors "errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+func TestSetType_ValidateEntry(t *testing.T) {
+	ip := EntryIP(net.ParseIP("10.0.0.1"))
+
+	tests := []struct {
+		typ      *SetType
+		revision uint8
+		entry    *Entry
+		field    string
+		err      error
+	}{
+		{HashIP, 6, NewEntry(ip, EntryCidr(24), EntryTimeout(time.Minute)), "", nil},
+		{HashIP, 6, NewEntry(ip, EntryPort(80)), "Port", ErrFieldUnsupported},
+		{HashIP, 6, NewEntry(EntryComment("x")), "IP", ErrFieldMissing},
+		{HashIP, 6, NewEntry(ip, EntryCadtFlags(uint32(NoMatch))), "CadtFlags", ErrFieldUnsupported},
+		{HashIP, 1, NewEntry(ip, EntryPackets(1)), "", nil},
+		{HashIP, 1, NewEntry(ip, EntryComment("x")), "Comment", ErrFieldUnsupported},
+		{HashIP, 6, NewEntry(ip, EntryComment(strings.Repeat("x", MaxCommentSize))), "", nil},
+		{HashIP, 6, NewEntry(ip, EntryComment(strings.Repeat("x", MaxCommentSize+1))), "Comment", ErrCommentTooLong},
+		{HashIPPort, 7, NewEntry(ip, EntryPort(80), EntryPortTo(88), EntryProto(syscall.IPPROTO_TCP)), "", nil},
+		{HashIPPort, 7, NewEntry(ip, EntryPort(80)), "Proto", ErrFieldMissing},
+		{HashIPPort, 7, NewEntry(ip, EntryProto(syscall.IPPROTO_TCP)), "Port", ErrFieldMissing},
+		{HashIPPort, 2, NewEntry(ip, EntryPort(80), EntryProto(syscall.IPPROTO_TCP), EntryPackets(1)), "", nil},
+		{HashIPPort, 1, NewEntry(ip, EntryPort(80), EntryProto(syscall.IPPROTO_TCP), EntryPackets(1)), "Packets", ErrFieldUnsupported},
+		{HashIPPort, 3, NewEntry(ip, EntryPort(80), EntryProto(syscall.IPPROTO_TCP), EntryComment("x")), "", nil},
+		{HashIPPortIP, 6, NewEntry(ip, EntryPort(80), EntryProto(syscall.IPPROTO_TCP), EntryIP2(net.ParseIP("10.0.0.2")), EntryCidr2(24)), "Cidr2", ErrFieldUnsupported},
+		{HashNet, 7, NewEntry(ip, EntryCadtFlags(uint32(NoMatch))), "", nil},
+		{HashNet, 1, NewEntry(ip, EntryCadtFlags(uint32(NoMatch))), "CadtFlags", ErrFieldUnsupported},
+		{HashNetIface, 8, NewEntry(ip, EntryIface("eth0"), EntryCadtFlags(uint32(PhysDev))), "", nil},
+		{HashNetIface, 8, NewEntry(ip), "Iface", ErrFieldMissing},
+		{HashNetNet, 3, NewEntry(ip, EntryIP2(net.ParseIP("10.0.0.2")), EntryIP2To(net.ParseIP("10.0.0.9"))), "", nil},
+		{BitmapPort, 3, NewEntry(EntryPort(80), EntryPortTo(88)), "", nil},
+		{BitmapPort, 3, NewEntry(EntryPort(80), EntryIP(net.ParseIP("10.0.0.1"))), "IP", ErrFieldUnsupported},
+		{BitmapIPMac, 3, NewEntry(ip), "", nil},
+		{BitmapIPMac, 3, NewEntry(ip, EntryCidr(24)), "Cidr", ErrFieldUnsupported},
+		{ListSet, 3, NewEntry(ip), "IP", ErrFieldUnsupported},
+		{ListSet, 3, NewEntry(EntryName("foo"), EntryBefore("bar"), EntryTimeout(time.Minute)), "", nil},
+		{ListSet, 3, NewEntry(EntryName("foo"), EntryCadtFlags(uint32(Before))), "NameRef", ErrFieldMissing},
+		{ListSet, 3, NewEntry(EntryBefore("bar")), "Name", ErrFieldMissing},
+		{HashIP, 6, NewEntry(ip, EntryName("foo")), "Name", ErrFieldUnsupported},
+	}
+
+	for _, tt := range tests {
+		err := tt.typ.ValidateEntry(tt.revision, tt.entry)
+		if tt.err == nil {
+			assert.NoError(t, err, "%s/%d", tt.typ, tt.revision)
+			continue
+		}
+
+		var fe *FieldError
+		if assert.True(t, stderrors.As(err, &fe), "%s/%d: %v", tt.typ, tt.revision, err) {
+			assert.Equal(t, tt.field, fe.Field, "%s/%d", tt.typ, tt.revision)
+			assert.True(t, stderrors.Is(err, tt.err), "%s/%d: %v", tt.typ, tt.revision, err)
+		}
+	}
+}
+
+func TestSetType_ValidateCreateData(t *testing.T) {
+	assert2 := assert.New(t)
+
+	assert2.NoError(HashIP.ValidateCreateData(6, nil))
+	assert2.NoError(HashIP.ValidateCreateData(6, newCreateData(
+		CreateDataNetMask(24), CreateDataBucketSize(12), CreateDataTimeout(time.Hour),
+		CreateDataCadtFlags(uint32(WithCounters|WithComment|WithForceDdd|WithSkbInfo)))))
+	assert2.NoError(ListSet.ValidateCreateData(3, newCreateData(CreateDataSize(8))))
+
+	err := HashIP.ValidateCreateData(4, newCreateData(CreateDataBucketSize(12)))
+	assert2.EqualError(err, "hash:ip: Probes not supported by the set type")
+	err = HashIP.ValidateCreateData(1, newCreateData(CreateDataCadtFlags(uint32(WithComment))))
+	assert2.EqualError(err, "hash:ip: CadtFlags not supported by the set type")
+	assert2.NoError(HashIPPort.ValidateCreateData(6, newCreateData(CreateDataBucketSize(12))))
+	assert2.NoError(HashIPPort.ValidateCreateData(7, newCreateData(CreateDataNetMask(24))))
+	err = HashIPPort.ValidateCreateData(6, newCreateData(CreateDataNetMask(24)))
+	assert2.EqualError(err, "hash:ip,port: NetMask not supported by the set type")
+	assert2.NoError(HashNetNet.ValidateCreateData(3, newCreateData(CreateDataBucketSize(12))))
+	assert2.NoError(HashNetNet.ValidateCreateData(4, newCreateData(CreateDataNetMask(24))))
+	err = HashNetNet.ValidateCreateData(3, newCreateData(CreateDataNetMask(24)))
+	assert2.EqualError(err, "hash:net,net: NetMask not supported by the set type")
+	err = HashNet.ValidateCreateData(7, newCreateData(CreateDataNetMask(24)))
+	assert2.True(stderrors.Is(err, ErrFieldUnsupported))
+	err = BitmapPort.ValidateCreateData(3, newCreateData(CreateDataMaxElem(8)))
+	assert2.True(stderrors.Is(err, ErrFieldUnsupported))
+	err = BitmapPort.ValidateCreateData(3, newCreateData(CreateDataCadtFlags(uint32(WithForceDdd))))
+	assert2.True(stderrors.Is(err, ErrFieldUnsupported))
+	err = BitmapPort.ValidateCreateData(3, newCreateData(CreateDataPort(1024)))
+	assert2.EqualError(err, "bitmap:port: PortTo required by the set type")
+	assert2.NoError(BitmapPort.ValidateCreateData(3, newCreateData(CreateDataPortRange(1024, 2048))))
+	err = BitmapIP.ValidateCreateData(3, newCreateData(CreateDataIP(net.ParseIP("10.0.0.0"))))
+	assert2.EqualError(err, "bitmap:ip: IPTo required by the set type")
+	assert2.NoError(BitmapIP.ValidateCreateData(3, newCreateData(CreateDataIP(net.ParseIP("10.0.0.0")), CreateDataCidr(16))))
+	err = HashIP.ValidateCreateData(6, newCreateData(CreateDataPortRange(1024, 2048)))
+	assert2.True(stderrors.Is(err, ErrFieldUnsupported))
+}
+
+func TestLookupSetType(t *testing.T) {
+	assert2 := assert.New(t)
+
+	assert2.Equal(HashNetPort, LookupSetType("hash:net,port"))
+	assert2.Nil(LookupSetType("hash:foo"))
+}
+
+func TestConn_Set(t *testing.T) {
+	assert2 := assert.New(t)
+	c, _ := newFakeConn()
+
+	s := c.Set("foo", HashIP)
+	err := s.Create(netfilter.ProtoIPv4, CreateDataSize(8))
+	assert2.EqualError(err, "ipset create foo: hash:ip: Size not supported by the set type")
+	assert2.NoError(s.Create(netfilter.ProtoIPv4, CreateDataTimeout(time.Hour)))
+	assert2.NoError(s.Replace(netfilter.ProtoIPv4, CreateDataTimeout(time.Hour)))
+
+	entries := []*Entry{
+		NewEntry(EntryIP(net.ParseIP("10.0.0.1"))),
+		NewEntry(EntryIP(net.ParseIP("10.0.0.2")), EntryPort(80)),
+	}
+	err = s.Add(entries...)
+	assert2.True(stderrors.Is(err, ErrFieldUnsupported))
+
+	var e *Error
+	if assert2.True(stderrors.As(err, &e)) {
+		assert2.Equal(CmdAdd, e.Cmd)
+		assert2.Equal(uint32(2), e.Line)
+		assert2.Equal(entries[1], e.Entry)
+	}
+	// Nothing is sent if validation fails.
+	assert2.Equal([]string{}, listIPs(t, c, "foo"))
+
+	assert2.NoError(s.Add(entries[0]))
+	assert2.NoError(s.Test(EntryIP(net.ParseIP("10.0.0.1"))))
+	assert2.True(stderrors.Is(s.Test(EntryMark(1)), ErrFieldUnsupported))
+	assert2.NoError(s.Delete(entries[0]))
+	assert2.True(stderrors.Is(s.Delete(NewEntry()), ErrFieldMissing))
+
+	h, err := c.Header("foo")
+	if assert2.NoError(err) {
+		assert2.Equal(HashIP.Revision, h.Revision.Get())
+	}
+
+	// Lower revisions are created as requested.
+	s = c.Set("bar", HashIP)
+	s.Revision = 1
+	assert2.NoError(s.Create(netfilter.ProtoIPv4))
+	assert2.True(stderrors.Is(s.Add(NewEntry(EntryIP(net.ParseIP("10.0.0.1")), EntryComment("x"))), ErrFieldUnsupported))
+}
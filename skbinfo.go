@@ -0,0 +1,60 @@
+package ipset
+
+import "fmt"
+
+// SkbMark is the packet mark the skbinfo extension assigns to matching
+// packets: the bits of the mark selected by Mask are set to Mark.
+type SkbMark struct {
+	Mark uint32
+	Mask uint32
+}
+
+// String formats m as mark/mask in hex, like ipset(8). The mask
+// is left out if all bits are set.
+func (m SkbMark) String() string {
+	if m.Mask == 0xffffffff {
+		return fmt.Sprintf("0x%x", m.Mark)
+	}
+	return fmt.Sprintf("0x%x/0x%x", m.Mark, m.Mask)
+}
+
+// SkbClass is the tc class, major:minor, the skbinfo extension
+// assigns to matching packets as their priority.
+type SkbClass struct {
+	Major uint16
+	Minor uint16
+}
+
+// String formats c as major:minor in hex, like tc(8).
+func (c SkbClass) String() string {
+	return fmt.Sprintf("%x:%x", c.Major, c.Minor)
+}
+
+// EntrySkbMarkMask sets the skbmark of an entry to mark under mask.
+// Use a mask of 0xffffffff to replace the whole mark.
+func EntrySkbMarkMask(mark, mask uint32) EntryOption {
+	return EntrySkbMark(uint64(mark)<<32 | uint64(mask))
+}
+
+// EntrySkbClass sets the skbprio of an entry to the tc class major:minor.
+func EntrySkbClass(major, minor uint16) EntryOption {
+	return EntrySkbPrio(uint32(major)<<16 | uint32(minor))
+}
+
+// SkbMarkMask returns the skbmark of e and whether it is set.
+func (e *Entry) SkbMarkMask() (SkbMark, bool) {
+	v := e.Skbmark.Get()
+	return SkbMark{Mark: uint32(v >> 32), Mask: uint32(v)}, e.Skbmark.IsSet()
+}
+
+// SkbClass returns the skbprio of e as tc class and whether it is set.
+func (e *Entry) SkbClass() (SkbClass, bool) {
+	v := e.Skbprio.Get()
+	return SkbClass{Major: uint16(v >> 16), Minor: uint16(v)}, e.Skbprio.IsSet()
+}
+
+// CreateDataSkbInfo enables the skbinfo extension of the set,
+// like CreateDataCounters does for counters.
+func CreateDataSkbInfo() CreateDataOption {
+	return func(d *CreateData) { d.addFlags(WithSkbInfo) }
+}
@@ -0,0 +1,53 @@
+package ipset
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ti-mo/netfilter"
+)
+
+func TestEntry_SkbInfo(t *testing.T) {
+	assert2 := assert.New(t)
+
+	e := NewEntry(EntrySkbMarkMask(0x10, 0xff), EntrySkbClass(1, 0x10), EntrySkbQueue(3))
+	assert2.Equal(uint64(0x10_000000ff), e.Skbmark.Get())
+	assert2.Equal(uint32(0x1_0010), e.Skbprio.Get())
+
+	m, ok := e.SkbMarkMask()
+	assert2.True(ok)
+	assert2.Equal(SkbMark{Mark: 0x10, Mask: 0xff}, m)
+	assert2.Equal("0x10/0xff", m.String())
+	assert2.Equal("0x10", SkbMark{Mark: 0x10, Mask: 0xffffffff}.String())
+
+	c, ok := e.SkbClass()
+	assert2.True(ok)
+	assert2.Equal(SkbClass{Major: 1, Minor: 0x10}, c)
+	assert2.Equal("1:10", c.String())
+
+	_, ok = NewEntry().SkbMarkMask()
+	assert2.False(ok)
+	_, ok = NewEntry().SkbClass()
+	assert2.False(ok)
+}
+
+func TestConn_SkbInfo(t *testing.T) {
+	assert2 := assert.New(t)
+	c, _ := newFakeConn()
+
+	assert2.NoError(c.Create("foo", "hash:ip", 6, netfilter.ProtoIPv4, CreateDataSkbInfo()))
+	assert2.NoError(c.Add("foo", NewEntry(EntryIP(net.ParseIP("10.0.0.1")),
+		EntrySkbMarkMask(0x10, 0xff), EntrySkbClass(1, 0x10), EntrySkbQueue(3))))
+
+	p, err := c.List("foo")
+	if assert2.NoError(err) && assert2.Len(p.Entries, 1) {
+		assert2.Equal(uint32(WithSkbInfo), p.Data.CadtFlags.Get())
+
+		m, _ := p.Entries[0].SkbMarkMask()
+		assert2.Equal(SkbMark{Mark: 0x10, Mask: 0xff}, m)
+		class, _ := p.Entries[0].SkbClass()
+		assert2.Equal(SkbClass{Major: 1, Minor: 0x10}, class)
+		assert2.Equal(uint16(3), p.Entries[0].Skbqueue.Get())
+	}
+}
@@ -1,9 +1,16 @@
 package ipset
 
+import (
+	"github.com/ti-mo/netfilter"
+)
+
 type TestPolicy struct {
 	NamePolicy
 
 	Entry *Entry
+
+	// typ is the type of the set, if known, to resolve errors.
+	typ string
 }
 
 func (p TestPolicy) marshalAttributes() Attributes {
@@ -11,3 +18,19 @@ func (p TestPolicy) marshalAttributes() Attributes {
 	attrs.append(AttrData, p.Entry)
 	return attrs
 }
+
+func (p *TestPolicy) unmarshalAttribute(nfa netfilter.Attribute) {
+	if at := AttributeType(nfa.Type); at == AttrData {
+		p.Entry = unmarshalEntry(nfa)
+	} else {
+		p.NamePolicy.unmarshalAttribute(nfa)
+	}
+}
+
+func (p TestPolicy) entry() *Entry {
+	return p.Entry
+}
+
+func (p TestPolicy) typeName() string {
+	return p.typ
+}
@@ -0,0 +1,115 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mdlayher/netlink"
+)
+
+// ErrStopWalk can be returned by a WalkFunc to end a walk early.
+// Walk and WalkSet return nil in that case.
+var ErrStopWalk = errors.New("stop walk")
+
+// WalkFunc is called by Walk and WalkSet for every set and entry of a dump.
+// It is called once per set with a nil entry when the set header arrives,
+// followed by one call per entry of the set. The header is shared by all
+// calls for the same set and must not be modified.
+type WalkFunc func(set *HeaderPolicy, entry *Entry) error
+
+// streamer is implemented by connectors which are able to hand out
+// the response to a request message by message.
+type streamer interface {
+	Stream(nlm netlink.Message, fn func(netlink.Message) bool) error
+}
+
+// Walk dumps all sets and calls fn for every set and entry as they are
+// received from the kernel, without keeping the whole dump in memory.
+func (c *Conn) Walk(fn WalkFunc) error {
+	return c.WalkContext(context.Background(), fn)
+}
+
+// WalkContext is like Walk but aborts the dump once ctx is done.
+func (c *Conn) WalkContext(ctx context.Context, fn WalkFunc) error {
+	return c.walk(ctx, CmdList, newBasePolicy(), fn)
+}
+
+// WalkSet dumps a single set and calls fn for the set and each of its entries
+// as they are received from the kernel, without keeping the whole set in memory.
+func (c *Conn) WalkSet(name string, fn WalkFunc) error {
+	return c.WalkSetContext(context.Background(), name, fn)
+}
+
+// WalkSetContext is like WalkSet but aborts the dump once ctx is done.
+func (c *Conn) WalkSetContext(ctx context.Context, name string, fn WalkFunc) error {
+	return c.walk(ctx, CmdList, newNamePolicy(name), fn)
+}
+
+// walk issues a dump request and decodes the response one message at a time.
+// The kernel splits large sets across multiple messages, continuation messages
+// only carry the set name and further entries.
+func (c *Conn) walk(ctx context.Context, t messageType, m attributesMarshaller, fn WalkFunc) error {
+	var (
+		set  *HeaderPolicy
+		ferr error
+	)
+	handle := func(nlm netlink.Message) bool {
+		if ferr = ctx.Err(); ferr != nil {
+			return false
+		}
+		if !isDumpMessage(nlm) {
+			return true
+		}
+
+		var p SetPolicy
+		if ferr = unmarshalMessage(nlm, &p); ferr != nil {
+			return false
+		}
+
+		if set == nil || set.setName() != p.setName() {
+			set = &p.HeaderPolicy
+			if ferr = fn(set, nil); ferr != nil {
+				return false
+			}
+		}
+		for _, e := range p.Entries {
+			if ferr = fn(set, e); ferr != nil {
+				return false
+			}
+		}
+		return true
+	}
+
+	req, err := c.marshal(t, netlink.Dump, m)
+	if err != nil {
+		return err
+	}
+
+	if s, ok := c.Conn.(streamer); ok {
+		err = c.withContext(ctx, func() error {
+			return s.Stream(req, handle)
+		})
+	} else {
+		var nlm []netlink.Message
+		nlm, err = c.queryContext(ctx, req)
+		for i := range nlm {
+			if err != nil || !handle(nlm[i]) {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return newError(t, m, err)
+	}
+
+	if ferr == ErrStopWalk {
+		return nil
+	}
+	return ferr
+}
+
+// isDumpMessage reports whether nlm carries a payload, as opposed to
+// the control messages terminating a dump.
+func isDumpMessage(nlm netlink.Message) bool {
+	return nlm.Header.Type != netlink.Done && nlm.Header.Type != netlink.Error
+}